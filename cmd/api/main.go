@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
-	"log"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -13,67 +20,297 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
 
+	"manifold-test/internal/apidocs"
+	"manifold-test/internal/apierror"
+	"manifold-test/internal/cache"
 	"manifold-test/internal/config"
 	"manifold-test/internal/database"
+	"manifold-test/internal/database/migrations"
+	"manifold-test/internal/deadletter"
 	"manifold-test/internal/handlers"
 	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/middleware/accesslog"
+	"manifold-test/internal/middleware/admin"
+	"manifold-test/internal/middleware/auth"
 	"manifold-test/internal/middleware/ratelimit"
+	"manifold-test/internal/middleware/requestid"
+	"manifold-test/internal/middleware/userid"
+	"manifold-test/internal/resume"
 	"manifold-test/internal/services"
 )
 
+// Upper bound on waiting for background persistence at shutdown
+const persistShutdownTimeout = 10 * time.Second
+
 func main() {
-	// Load configuration
-	cfg := config.Load()
+	migrateOnly := flag.Bool("migrate-only", false, "apply database migrations and exit")
+	flag.Parse()
 
-	// Initialize database
-	log.Printf("Connecting to database with DSN: %s", cfg.DSN)
-	db, err := database.NewConnection(cfg.DSN)
+	// Load configuration
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Invalid configuration", err)
 	}
-	defer db.Close()
+	slog.SetDefault(newLogger(os.Stdout, cfg))
 
-	// Initialize Redis
-	redisClient, err := database.NewRedisConnection(cfg.RedisURL)
+	// Initialize storage
+	var (
+		db              *sql.DB
+		userService     services.UserRepository
+		requestService  services.RequestRepository
+		appCache        cache.Cache
+		batchingService *services.BatchingRequestService
+	)
+	cache.SetKeyPrefix(cfg.RedisPrefix)
+
+	// Persistence writes that fail after retries, including batched request
+	// rows, are kept here for replay. One breaker guards every DB write
+	deadLetters, err := deadletter.NewStore(cfg.DeadLetterPath)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		fatal("Failed to open dead letter store", err)
 	}
-	defer redisClient.Close()
+	writeBreaker := services.NewWriteBreaker(cfg.DBBreakerThreshold, cfg.DBBreakerCooldown)
+
+	if cfg.Storage == config.StorageMemory {
+		if *migrateOnly {
+			fatal("Invalid flags", errors.New("-migrate-only requires STORAGE=mysql"))
+		}
+		slog.Warn("Using in-memory storage; data will not survive a restart")
+		userService = services.NewMemoryUserRepository(cfg.DefaultQuota)
+		requestService = services.NewMemoryRequestRepository()
+		appCache = cache.NewMemoryCache()
+	} else {
+		slog.Info("Connecting to database", "dsn", cfg.RedactedDSN())
+		db, err = database.NewConnection(cfg)
+		if err != nil {
+			fatal("Failed to connect to database", err)
+		}
+		defer db.Close()
+
+		// Bring the schema up to date on every boot; -migrate-only stops here
+		migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), 2*time.Minute)
+		err = migrations.Apply(migrateCtx, db, cfg.Dialect())
+		cancelMigrate()
+		if err != nil {
+			fatal("Failed to run migrations", err)
+		}
+		if *migrateOnly {
+			return
+		}
 
-	// Initialize services
-	userService := services.NewUserService(db)
-	requestService := services.NewRequestService(db)
-	rateLimiter := ratelimit.NewRateLimiter()
+		// Initialize Redis
+		slog.Info("Connecting to Redis", "url", cfg.RedactedRedisURL())
+		redisClient, err := database.NewRedisConnection(cfg.RedisURL)
+		if err != nil {
+			fatal("Failed to connect to Redis", err)
+		}
+		defer redisClient.Close()
+		appCache = cache.NewRedisCache(redisClient)
+
+		userService = services.NewUserService(db, cfg.Dialect(), cfg.DefaultQuota, cfg.DBQueryTimeout)
+		if cfg.QuotaLockTimeout > 0 {
+			userService = services.NewQuotaLockingUserRepository(userService, appCache, cfg.QuotaLockTimeout, cfg.QuotaLockTTL)
+		}
+		requestService = services.NewRequestService(db, cfg.Dialect(), cfg.DBQueryTimeout, cfg.RequestMaxDataBytes)
+		if cfg.RequestBatchSize > 0 {
+			batchingService = services.NewBatchingRequestService(db, services.BatchingConfig{
+				Dialect:       cfg.Dialect(),
+				QueryTimeout:  cfg.DBQueryTimeout,
+				WriteTimeout:  cfg.DBWriteTimeout,
+				BatchSize:     cfg.RequestBatchSize,
+				FlushInterval: cfg.RequestBatchFlushInterval,
+				MaxDataBytes:  cfg.RequestMaxDataBytes,
+				Breaker:       writeBreaker,
+				OnFailure: func(ctx context.Context, failed []services.QueuedRequest, err error) {
+					for _, req := range failed {
+						deadLetters.Record(ctx, deadletter.Entry{
+							Op:         deadletter.OpSaveRequest,
+							RequestID:  req.RequestID,
+							UserID:     req.UserID,
+							Data:       req.Data,
+							DurationMs: req.DurationMs,
+						}, err)
+					}
+				},
+			})
+			requestService = batchingService
+		}
+	}
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	services.StartWordsLeftSampler(bgCtx, userService, cfg.WordsLeftSampleInterval)
+	if cfg.RetentionDays > 0 {
+		services.StartStaleUserPurger(bgCtx, userService, cfg.RetentionInterval, time.Duration(cfg.RetentionDays)*24*time.Hour)
+	}
+	rateLimiter := ratelimit.NewRateLimiter(cfg.RateLimitDefault, nil)
+	rateLimiter.Exempt(cfg.UnlimitedUsers...)
+	rateLimiter.SetMaxTracked(cfg.RateLimitMaxTracked)
+	rateLimiter.SetMaxWait(cfg.RateLimitMaxWait)
+	// Only the generate handlers report request_duration_seconds, so only
+	// their rejections join it
+	generateRoutes := []string{"/generate-data", "/generate-data/ws", "/generate"}
+	rateLimiter.TimeRoutes(generateRoutes...)
 
 	// Initialize Echo
 	e := echo.New()
+	e.HTTPErrorHandler = apierror.Handler
+	e.IPExtractor = echo.ExtractIPDirect()
+	if len(cfg.TrustedProxies) > 0 {
+		// Validate already parsed these
+		proxies, _ := cfg.TrustedProxyNets()
+		trust := []echo.TrustOption{
+			echo.TrustLoopback(false),
+			echo.TrustLinkLocal(false),
+			echo.TrustPrivateNet(false),
+		}
+		for _, proxy := range proxies {
+			trust = append(trust, echo.TrustIPRange(proxy))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(trust...)
+	}
 
 	// Core middleware
-	e.Use(middleware.Logger())
+	e.Use(requestid.Middleware())
+	e.Use(accesslog.Middleware(slog.Default()))
 	e.Use(middleware.Recover())
+	e.Use(middleware.BodyLimit(strconv.Itoa(cfg.MaxBodyBytes)))
 	e.Use(middleware.CORS())
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{Skipper: gzipSkipper}))
 
 	// Register Prometheus metrics
+	appmetrics.Init(appmetrics.Config{
+		RequestDurationBuckets: cfg.MetricsRequestDurationBuckets,
+		DBWriteDurationBuckets: cfg.MetricsDBWriteBuckets,
+		WordsPerSecondBuckets:  cfg.MetricsWordsPerSecondBuckets,
+	})
 	reg := prometheus.DefaultRegisterer
 	appmetrics.MustRegister(reg)
 
 	// Initialize handlers
-	h := handlers.NewHandler(userService, requestService, rateLimiter, redisClient)
+	resumeSecret := []byte(cfg.ResumeTokenSecret)
+	if len(resumeSecret) == 0 {
+		resumeSecret = make([]byte, 32)
+		if _, err := rand.Read(resumeSecret); err != nil {
+			fatal("Failed to generate resume token secret", err)
+		}
+		slog.Warn("RESUME_TOKEN_SECRET not set; resume tokens will not survive a restart")
+	}
+	words, err := services.LoadWordSource(cfg.WordListPath)
+	if err != nil {
+		fatal("Failed to load word list", err)
+	}
+	h := handlers.NewHandler(userService, requestService, appCache, resume.NewSigner(resumeSecret), services.NewWordBanks(words), deadLetters, writeBreaker, cfg)
+	deadLetters.Start(bgCtx, cfg.DeadLetterRetryInterval, h.ReplayDeadLetter)
+	if cfg.CacheWarmOnStart {
+		// In the background so a slow query doesn't hold up serving
+		go func() {
+			warmed, err := h.WarmStatsCache(bgCtx, cfg.CacheWarmUsers)
+			if err != nil {
+				slog.Error("Failed to warm stats cache", "error", err)
+				return
+			}
+			slog.Info("Warmed stats cache", "users", warmed)
+		}()
+	}
+
+	// Per-user routes: the IP limit comes first so rotating X-User-Id can't
+	// dodge it, then authenticate so the user limiter keys on the real user
+	var userMiddleware []echo.MiddlewareFunc
+	if cfg.RateLimitIP > 0 {
+		ipLimiter := ratelimit.NewIPRateLimiter(cfg.RateLimitIP)
+		ipLimiter.SetMaxTracked(cfg.RateLimitMaxTracked)
+		ipLimiter.TimeRoutes(generateRoutes...)
+		userMiddleware = append(userMiddleware, ipLimiter.Middleware())
+	}
+	switch {
+	case cfg.AuthEnabled:
+		userMiddleware = append(userMiddleware, auth.Middleware(services.NewAPIKeyService(db, cfg.Dialect(), cfg.DBQueryTimeout)))
+	case cfg.JWTSecret != "":
+		userMiddleware = append(userMiddleware, auth.JWTMiddleware(auth.NewHMACVerifier([]byte(cfg.JWTSecret))))
+	case cfg.JWTJWKSURL != "":
+		userMiddleware = append(userMiddleware, auth.JWTMiddleware(auth.NewJWKSVerifier(cfg.JWTJWKSURL)))
+	}
+	// Validate the (possibly token-derived) user ID before it reaches the
+	// limiter, the cache keys or the database
+	userMiddleware = append(userMiddleware, userid.Middleware())
+	limited := func(limit echo.MiddlewareFunc) []echo.MiddlewareFunc {
+		return append(userMiddleware[:len(userMiddleware):len(userMiddleware)], limit)
+	}
+	// Every route that generates words draws on one budget, so spreading
+	// requests across them doesn't multiply it
+	generateLimited := limited(rateLimiter.RateLimitFor("generate", cfg.RateLimitGenerateData))
+	defaultLimited := limited(rateLimiter.Middleware())
 
 	// Routes
 	e.GET("/", func(c echo.Context) error {
-		return c.String(http.StatusOK, "API is running! \n\nAvailable endpoints:\n- GET  /health \n- POST /generate-data\n- GET  /user/stats\n- GET  /metrics")
+		return c.String(http.StatusOK, "API is running! \n\nAvailable endpoints:\n"+
+			"- GET  /health\n- GET  /livez\n- GET  /readyz\n"+
+			"- POST /generate-data\n- POST /generate-data/preview\n- GET  /generate-data/ws\n- DELETE /generate-data/:id\n- POST /generate\n"+
+			"- GET  /user/stats\n- PUT  /user/profile\n- GET  /user/export (admin unless auth is on)\n- GET  /user/history (admin unless auth is on)\n"+
+			"- GET  /stats/global\n- GET  /metrics\n- GET  /openapi.yaml\n- GET  /docs\n"+
+			"- POST /user/reset (admin)\n- DELETE /user (admin)\n- POST /user/charge (admin)\n- POST /user/stats/batch (admin)\n"+
+			"- GET  /debug/ratelimit (admin)\n- POST /admin/cache/invalidate (admin)\n- POST /admin/cache/warm (admin)\n- GET  /admin/streams (admin)")
 	})
 	e.GET("/health", h.HealthCheck)
-	e.POST("/generate-data", h.GenerateData)
-	e.GET("/user/stats", h.GetUserStats)
+	e.GET("/livez", h.Livez)
+	e.GET("/readyz", h.Readyz)
+	e.POST("/generate-data", h.GenerateData, generateLimited...)
+	e.POST("/generate-data/preview", h.PreviewGeneration, generateLimited...)
+	e.GET("/generate-data/ws", h.GenerateDataWS, generateLimited...)
+	e.DELETE("/generate-data/:id", h.CancelStream, defaultLimited...)
+	e.POST("/generate", h.GenerateText, generateLimited...)
+	e.GET("/user/stats", h.GetUserStats, limited(rateLimiter.RateLimitFor("user_stats", cfg.RateLimitUserStats))...)
+	e.PUT("/user/profile", h.SetUserProfile, defaultLimited...)
+	e.GET("/stats/global", h.GlobalStats)
 	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/openapi.yaml", apidocs.Spec)
+	e.GET("/docs", apidocs.UI)
 
-	// Start server
+	// Admin routes
+	adminMiddleware := admin.Middleware(cfg.AdminToken)
+	e.POST("/user/reset", h.ResetUserQuota, adminMiddleware, userid.Middleware())
+	e.DELETE("/user", h.DeleteUser, adminMiddleware, userid.Middleware())
+	e.POST("/user/charge", h.ChargeUser, adminMiddleware, userid.Middleware())
+	e.POST("/user/stats/batch", h.GetUserStatsBatch, adminMiddleware)
+	e.GET("/debug/ratelimit", rateLimiter.DebugHandler, adminMiddleware)
+	e.POST("/admin/cache/invalidate", h.InvalidateCache, adminMiddleware)
+	e.GET("/admin/streams", h.ListStreams, adminMiddleware)
+	e.POST("/admin/cache/warm", h.WarmCache, adminMiddleware)
+
+	// A user's history is only exported or listed to that user once callers
+	// are authenticated; until then X-User-Id is unverified, so it takes the
+	// admin token like DELETE /user
+	if cfg.AuthEnabled || cfg.JWTEnabled() {
+		e.GET("/user/export", h.ExportRequests, defaultLimited...)
+		e.GET("/user/history", h.RequestHistory, defaultLimited...)
+	} else {
+		e.GET("/user/export", h.ExportRequests, adminMiddleware, userid.Middleware())
+		e.GET("/user/history", h.RequestHistory, adminMiddleware, userid.Middleware())
+	}
+
+	// Start server. Every server timeout is set here; read/write follow the
+	// stream timeout so a longer STREAM_TIMEOUT can't outlive the connection
+	e.Server.ReadTimeout = cfg.HTTPTimeout()
+	e.Server.WriteTimeout = cfg.HTTPTimeout()
+	e.Server.IdleTimeout = cfg.HTTPIdleTimeout
+	slog.Info("HTTP timeouts", "stream", cfg.StreamTimeout.String(), "read_write", cfg.HTTPTimeout().String(), "idle", cfg.HTTPIdleTimeout.String())
 	go func() {
-		if err := e.Start(":8080"); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+		addr := fmt.Sprintf(":%d", cfg.ServerPort)
+		var err error
+		if cfg.HTTP2Enabled {
+			// Cleartext HTTP/2 (h2c) so concurrent streams can share one
+			// connection; HTTP/1.1 clients are still served
+			err = e.StartH2CServer(addr, &http2.Server{
+				MaxConcurrentStreams: uint32(cfg.HTTP2MaxConcurrentStreams),
+				IdleTimeout:          cfg.HTTPIdleTimeout,
+			})
+		} else {
+			err = e.Start(addr)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Failed to start server", err)
 		}
 	}()
 
@@ -82,13 +319,56 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server...")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := e.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
+	}
+
+	// Let background DB writes and cache invalidations for finished streams
+	// complete before the deferred DB and Redis closes run
+	persistCtx, cancelPersist := context.WithTimeout(context.Background(), persistShutdownTimeout)
+	defer cancelPersist()
+	if err := h.WaitForPersistence(persistCtx); err != nil {
+		slog.Error("Gave up waiting for background persistence", "error", err)
+	}
+	if batchingService != nil {
+		batchingService.Close()
+	}
+
+	slog.Info("Server exited")
+}
+
+// gzipSkipper leaves the streaming routes uncompressed, since buffering
+// would defeat streaming; /metrics compresses itself.
+func gzipSkipper(c echo.Context) bool {
+	switch c.Path() {
+	case "/generate-data", "/generate-data/ws", "/user/export", "/metrics":
+		return true
 	}
+	return false
+}
+
+// newLogger builds the process logger, writing to w, from LOG_LEVEL and
+// LOG_FORMAT. Records logged with a request context carry its request_id.
+func newLogger(w io.Writer, cfg *config.Config) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.LogLevel)) // checked by Validate
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.LogFormat == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(requestid.NewLogHandler(handler))
+}
 
-	log.Println("Server exited")
+// fatal logs err and exits, like log.Fatal.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
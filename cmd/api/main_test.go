@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"manifold-test/internal/config"
+	"manifold-test/internal/middleware/requestid"
+)
+
+func TestGzipSkipsStreamingRoutes(t *testing.T) {
+	e := echo.New()
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{Skipper: gzipSkipper}))
+	json := func(c echo.Context) error { return c.JSON(http.StatusOK, map[string]int{"words_left": 1}) }
+	stream := func(c echo.Context) error { return c.String(http.StatusOK, "lorem ipsum ") }
+	e.GET("/user/stats", json)
+	e.GET("/stats/global", json)
+	e.POST("/generate-data", stream)
+	e.GET("/user/export", stream)
+	e.GET("/metrics", stream)
+
+	tests := []struct {
+		method, path string
+		gzipped      bool
+	}{
+		{http.MethodGet, "/user/stats", true},
+		{http.MethodGet, "/stats/global", true},
+		{http.MethodPost, "/generate-data", false},
+		{http.MethodGet, "/user/export", false},
+		{http.MethodGet, "/metrics", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if gzipped := rec.Header().Get(echo.HeaderContentEncoding) == "gzip"; gzipped != tt.gzipped {
+			t.Errorf("%s %s: gzipped = %v, want %v", tt.method, tt.path, gzipped, tt.gzipped)
+		}
+	}
+}
+
+func TestNewLoggerLevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, &config.Config{LogLevel: "warn", LogFormat: "json"})
+	ctx := requestid.WithID(context.Background(), "req-1")
+	logger.InfoContext(ctx, "below the level")
+	logger.WarnContext(ctx, "kept")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("want a single JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["msg"] != "kept" || line["request_id"] != "req-1" {
+		t.Fatalf("log line = %v, want the warning with request_id req-1", line)
+	}
+
+	buf.Reset()
+	newLogger(&buf, &config.Config{LogLevel: "debug", LogFormat: "text"}).Debug("plain")
+	if out := buf.String(); !strings.Contains(out, "level=DEBUG") || !strings.Contains(out, "msg=plain") {
+		t.Fatalf("text log line = %q, want level=DEBUG msg=plain", out)
+	}
+}
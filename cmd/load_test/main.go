@@ -2,59 +2,173 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// LoadTestResult summarises a run. Durations are serialised as nanoseconds.
 type LoadTestResult struct {
-	TotalRequests    int64
-	SuccessfulRequests int64
-	FailedRequests   int64
-	TotalDuration    time.Duration
-	AverageResponseTime time.Duration
-	MinResponseTime   time.Duration
-	MaxResponseTime   time.Duration
-	RequestsPerSecond float64
+	TotalRequests       int64         `json:"total_requests"`
+	SuccessfulRequests  int64         `json:"successful_requests"`
+	FailedRequests      int64         `json:"failed_requests"`
+	TotalDuration       time.Duration `json:"total_duration_ns"`
+	AverageResponseTime time.Duration `json:"average_response_time_ns"`
+	MinResponseTime     time.Duration `json:"min_response_time_ns"`
+	MaxResponseTime     time.Duration `json:"max_response_time_ns"`
+	P50ResponseTime     time.Duration `json:"p50_response_time_ns"`
+	P95ResponseTime     time.Duration `json:"p95_response_time_ns"`
+	P99ResponseTime     time.Duration `json:"p99_response_time_ns"`
+	RequestsPerSecond   float64       `json:"requests_per_second"`
+	RPSOverTime         []float64     `json:"rps_over_time"`
+
+	Endpoints map[string]EndpointResult `json:"endpoints"`
 }
 
+// EndpointResult is the per-endpoint breakdown of a mixed run.
+type EndpointResult struct {
+	Requests            int64         `json:"requests"`
+	SuccessfulRequests  int64         `json:"successful_requests"`
+	FailedRequests      int64         `json:"failed_requests"`
+	AverageResponseTime time.Duration `json:"average_response_time_ns"`
+	P50ResponseTime     time.Duration `json:"p50_response_time_ns"`
+	P95ResponseTime     time.Duration `json:"p95_response_time_ns"`
+	P99ResponseTime     time.Duration `json:"p99_response_time_ns"`
+}
+
+// Number of intervals the achieved RPS is reported over
+const rpsBuckets = 10
+
 type RequestResult struct {
 	UserID     string
+	Endpoint   string
 	Success    bool
 	Duration   time.Duration
 	Error      error
 	StatusCode int
 }
 
-func main() {
-	log.Println("Starting Load Test")
-	log.Println("Testing 5000 concurrent requests from 10 users")
+type options struct {
+	baseURL       string
+	totalRequests int
+	numUsers      int
+	workers       int
+	timeout       time.Duration
+	ramp          time.Duration
+	mix           []weightedEndpoint
+	noDelay       bool
+	seed          int64
+	quick         bool
+	output        string
+	outputFile    string
+}
 
-	baseURL := "http://3.138.235.69:8080"
-	totalRequests := 5000
-	numUsers := 10
-	concurrentWorkers := 100 
+// parseOptions reads the command-line flags. A trailing "quick" argument
+// switches to 50 requests on 10 workers unless those flags are set explicitly.
+func parseOptions(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("load_test", flag.ContinueOnError)
+	fs.StringVar(&opts.baseURL, "url", "http://3.138.235.69:8080", "base URL of the API")
+	fs.IntVar(&opts.totalRequests, "requests", 5000, "total number of requests")
+	fs.IntVar(&opts.numUsers, "users", 10, "number of distinct user IDs")
+	fs.IntVar(&opts.workers, "workers", 100, "number of concurrent workers")
+	fs.DurationVar(&opts.timeout, "timeout", 2*time.Minute, "per-request timeout")
+	fs.DurationVar(&opts.ramp, "ramp", 0, "spread request dispatch linearly over this duration (0 dispatches at once)")
+	mix := fs.String("mix", "generate=100", "relative weights of endpoints to call, e.g. generate=70,stats=30")
+	fs.BoolVar(&opts.noDelay, "no-delay", false, "send X-No-Delay so streams skip the per-word pause (server needs FAST_MODE)")
+	fs.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "seed for endpoint selection")
+	fs.StringVar(&opts.output, "output", formatText, "result format: text, json or csv")
+	fs.StringVar(&opts.outputFile, "output-file", "", "write results to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
 
-	// For quick test 
-	if len(os.Args) > 1 && os.Args[1] == "quick" {
-		totalRequests = 50
-		concurrentWorkers = 10
-		log.Println("🔧 QUICK TEST MODE: 50 requests, 10 concurrent workers")
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "quick":
+		opts.quick = true
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["requests"] {
+			opts.totalRequests = 50
+		}
+		if !set["workers"] {
+			opts.workers = 10
+		}
+	case fs.NArg() > 0:
+		return options{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
 	}
 
+	if opts.totalRequests < 1 {
+		return options{}, fmt.Errorf("-requests must be positive, got %d", opts.totalRequests)
+	}
+	if opts.workers < 1 {
+		return options{}, fmt.Errorf("-workers must be positive, got %d", opts.workers)
+	}
+	if opts.numUsers < 1 {
+		return options{}, fmt.Errorf("-users must be positive, got %d", opts.numUsers)
+	}
+	if opts.timeout <= 0 {
+		return options{}, fmt.Errorf("-timeout must be positive, got %s", opts.timeout)
+	}
+	if opts.ramp < 0 {
+		return options{}, fmt.Errorf("-ramp must not be negative, got %s", opts.ramp)
+	}
+	var err error
+	if opts.mix, err = parseMix(*mix); err != nil {
+		return options{}, fmt.Errorf("-mix: %w", err)
+	}
+	switch opts.output {
+	case formatText, formatJSON, formatCSV:
+	default:
+		return options{}, fmt.Errorf("-output must be text, json or csv, got %q", opts.output)
+	}
+	return opts, nil
+}
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("Invalid options: %v", err)
+	}
+
+	log.Println("Starting Load Test")
+	if opts.quick {
+		log.Printf("🔧 QUICK TEST MODE: %d requests, %d concurrent workers", opts.totalRequests, opts.workers)
+	}
+	log.Printf("Testing %d requests from %d users against %s", opts.totalRequests, opts.numUsers, opts.baseURL)
+
 	// Generate user IDs
-	userIDs := generateUserIDs(numUsers)
-	log.Printf("Generated %d user IDs: %v", len(userIDs), len(userIDs))
+	userIDs := generateUserIDs(opts.numUsers)
+	log.Printf("Generated %d user IDs", len(userIDs))
 
-	result := runLoadTest(baseURL, totalRequests, userIDs, concurrentWorkers)
+	result := runLoadTest(opts, userIDs)
 
-	printResults(result)
+	out := io.Writer(os.Stdout)
+	if opts.outputFile != "" {
+		f, err := os.Create(opts.outputFile)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeResults(out, opts.output, result); err != nil {
+		log.Fatalf("Failed to write results: %v", err)
+	}
 }
 
 func generateUserIDs(count int) []string {
@@ -65,14 +179,21 @@ func generateUserIDs(count int) []string {
 	return userIDs
 }
 
-func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrentWorkers int) LoadTestResult {
+func runLoadTest(opts options, userIDs []string) LoadTestResult {
+	totalRequests, concurrentWorkers := opts.totalRequests, opts.workers
 	var (
 		successfulRequests int64
 		failedRequests     int64
 		totalDuration      int64
 		minResponseTime    int64 = 1<<63 - 1
 		maxResponseTime    int64
-		mu                 sync.Mutex
+		// Every result is kept for the percentiles, RPS buckets and
+		// per-endpoint breakdown: ~150 bytes per request, so ~150MB per
+		// million requests
+		durations   = make([]time.Duration, 0, totalRequests)
+		completions = make([]time.Time, 0, totalRequests)
+		byEndpoint  = map[string][]RequestResult{}
+		mu          sync.Mutex
 	)
 
 	// Create channels for coordination
@@ -85,15 +206,18 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
+			rng := rand.New(rand.NewSource(opts.seed + int64(workerID)))
 			for userID := range requestChan {
-				result := makeRequest(baseURL, userID)
+				result := makeRequest(opts.baseURL, pickEndpoint(rng, opts.mix), userID, opts.timeout, opts.noDelay)
 				resultChan <- result
 			}
 		}(i)
 	}
 
 	// Start result collector
+	collected := make(chan struct{})
 	go func() {
+		defer close(collected)
 		for result := range resultChan {
 			if result.Success {
 				atomic.AddInt64(&successfulRequests, 1)
@@ -111,6 +235,9 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 			if duration > maxResponseTime {
 				maxResponseTime = duration
 			}
+			durations = append(durations, result.Duration)
+			completions = append(completions, time.Now())
+			byEndpoint[result.Endpoint] = append(byEndpoint[result.Endpoint], result)
 			mu.Unlock()
 		}
 	}()
@@ -118,9 +245,15 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 	// Start the test
 	startTime := time.Now()
 	log.Printf("Starting %d requests with %d concurrent workers...", totalRequests, concurrentWorkers)
+	if opts.ramp > 0 {
+		log.Printf("Ramping up dispatch over %s", opts.ramp)
+	}
 
-	// Send requests
+	// Send requests, spread linearly over the ramp when one is set
 	for i := 0; i < totalRequests; i++ {
+		if wait := time.Until(startTime.Add(dispatchOffset(i, totalRequests, opts.ramp))); wait > 0 {
+			time.Sleep(wait)
+		}
 		userID := userIDs[i%len(userIDs)]
 		requestChan <- userID
 	}
@@ -129,6 +262,7 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 	close(requestChan)
 	wg.Wait()
 	close(resultChan)
+	<-collected
 
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
@@ -141,6 +275,12 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 	mu.Lock()
 	minTime := minResponseTime
 	maxTime := maxResponseTime
+	p50, p95, p99 := percentiles(durations)
+	rpsOverTime := throughput(completions, startTime, duration, rpsBuckets)
+	endpointResults := make(map[string]EndpointResult, len(byEndpoint))
+	for name, results := range byEndpoint {
+		endpointResults[name] = summarizeEndpoint(results)
+	}
 	mu.Unlock()
 
 	avgTime := time.Duration(0)
@@ -149,42 +289,132 @@ func runLoadTest(baseURL string, totalRequests int, userIDs []string, concurrent
 	}
 
 	return LoadTestResult{
-		TotalRequests:      int64(totalRequests),
-		SuccessfulRequests: successful,
-		FailedRequests:     failed,
-		TotalDuration:      duration,
+		TotalRequests:       int64(totalRequests),
+		SuccessfulRequests:  successful,
+		FailedRequests:      failed,
+		TotalDuration:       duration,
 		AverageResponseTime: avgTime,
-		MinResponseTime:    time.Duration(minTime),
-		MaxResponseTime:    time.Duration(maxTime),
-		RequestsPerSecond:  float64(totalRequests) / duration.Seconds(),
+		MinResponseTime:     time.Duration(minTime),
+		MaxResponseTime:     time.Duration(maxTime),
+		P50ResponseTime:     p50,
+		P95ResponseTime:     p95,
+		P99ResponseTime:     p99,
+		RequestsPerSecond:   float64(totalRequests) / duration.Seconds(),
+		RPSOverTime:         rpsOverTime,
+		Endpoints:           endpointResults,
+	}
+}
+
+// summarizeEndpoint aggregates the results recorded for one endpoint.
+func summarizeEndpoint(results []RequestResult) EndpointResult {
+	var er EndpointResult
+	var total time.Duration
+	durations := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		er.Requests++
+		if r.Success {
+			er.SuccessfulRequests++
+			total += r.Duration
+		} else {
+			er.FailedRequests++
+		}
+		durations = append(durations, r.Duration)
+	}
+	if er.SuccessfulRequests > 0 {
+		er.AverageResponseTime = total / time.Duration(er.SuccessfulRequests)
+	}
+	er.P50ResponseTime, er.P95ResponseTime, er.P99ResponseTime = percentiles(durations)
+	return er
+}
+
+// dispatchOffset is when request i of total is sent, relative to the start
+// of the run. Without a ramp every request is sent immediately.
+func dispatchOffset(i, total int, ramp time.Duration) time.Duration {
+	if ramp <= 0 || total <= 1 {
+		return 0
+	}
+	return time.Duration(int64(ramp) * int64(i) / int64(total))
+}
+
+// throughput splits the run into equal buckets and returns the completed
+// requests per second in each.
+func throughput(completions []time.Time, start time.Time, total time.Duration, buckets int) []float64 {
+	if total <= 0 || buckets < 1 {
+		return nil
+	}
+	width := total / time.Duration(buckets)
+	if width <= 0 {
+		width, buckets = total, 1
+	}
+
+	counts := make([]int, buckets)
+	for _, t := range completions {
+		b := int(t.Sub(start) / width)
+		if b >= buckets {
+			b = buckets - 1
+		}
+		if b < 0 {
+			b = 0
+		}
+		counts[b]++
+	}
+
+	rps := make([]float64, buckets)
+	for i, n := range counts {
+		rps[i] = float64(n) / width.Seconds()
 	}
+	return rps
 }
 
-func makeRequest(baseURL, userID string) RequestResult {
+// percentiles returns the nearest-rank p50, p95 and p99 of durations, or
+// zeros when there are none. durations is sorted in place.
+func percentiles(durations []time.Duration) (p50, p95, p99 time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return percentile(durations, 50), percentile(durations, 95), percentile(durations, 99)
+}
+
+// percentile returns the smallest value with at least p% of sorted at or
+// below it.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func makeRequest(baseURL string, ep endpoint, userID string, timeout time.Duration, noDelay bool) RequestResult {
 	startTime := time.Now()
 
 	// Create request
-	req, err := http.NewRequest("POST", baseURL+"/generate-data", nil)
+	req, err := http.NewRequest(ep.method, baseURL+ep.path, nil)
 	if err != nil {
 		return RequestResult{
-			UserID:  userID,
-			Success: false,
-			Error:   err,
+			UserID:   userID,
+			Endpoint: ep.name,
+			Success:  false,
+			Error:    err,
 		}
 	}
 
 	// Add headers
 	req.Header.Set("X-User-Id", userID)
 	req.Header.Set("Connection", "close")
+	if noDelay {
+		req.Header.Set("X-No-Delay", "true")
+	}
 
 	// Set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	req = req.WithContext(ctx)
 
 	// Make request
 	client := &http.Client{
-		Timeout: 2 * time.Minute,
+		Timeout: timeout,
 	}
 	resp, err := client.Do(req)
 	duration := time.Since(startTime)
@@ -192,6 +422,7 @@ func makeRequest(baseURL, userID string) RequestResult {
 	if err != nil {
 		return RequestResult{
 			UserID:   userID,
+			Endpoint: ep.name,
 			Success:  false,
 			Duration: duration,
 			Error:    err,
@@ -204,6 +435,7 @@ func makeRequest(baseURL, userID string) RequestResult {
 	if err != nil {
 		return RequestResult{
 			UserID:     userID,
+			Endpoint:   ep.name,
 			Success:    false,
 			Duration:   duration,
 			Error:      err,
@@ -214,24 +446,52 @@ func makeRequest(baseURL, userID string) RequestResult {
 	success := resp.StatusCode >= 200 && resp.StatusCode < 300
 	return RequestResult{
 		UserID:     userID,
+		Endpoint:   ep.name,
 		Success:    success,
 		Duration:   duration,
 		StatusCode: resp.StatusCode,
 	}
 }
 
-func printResults(result LoadTestResult) {
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println("LOAD TEST RESULTS")
-	fmt.Println(strings.Repeat("=", 60))
-	fmt.Printf("Total Requests:        %d\n", result.TotalRequests)
-	fmt.Printf("Successful Requests:   %d (%.2f%%)\n", result.SuccessfulRequests, 
+func printResults(w io.Writer, result LoadTestResult) {
+	fmt.Fprintln(w, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(w, "LOAD TEST RESULTS")
+	fmt.Fprintln(w, strings.Repeat("=", 60))
+	fmt.Fprintf(w, "Total Requests:        %d\n", result.TotalRequests)
+	fmt.Fprintf(w, "Successful Requests:   %d (%.2f%%)\n", result.SuccessfulRequests,
 		float64(result.SuccessfulRequests)/float64(result.TotalRequests)*100)
-	fmt.Printf("Failed Requests:       %d (%.2f%%)\n", result.FailedRequests,
+	fmt.Fprintf(w, "Failed Requests:       %d (%.2f%%)\n", result.FailedRequests,
 		float64(result.FailedRequests)/float64(result.TotalRequests)*100)
-	fmt.Printf("Total Duration:        %v\n", result.TotalDuration)
-	fmt.Printf("Requests Per Second:   %.2f\n", result.RequestsPerSecond)
-	fmt.Printf("Average Response Time: %v\n", result.AverageResponseTime)
-	fmt.Printf("Min Response Time:     %v\n", result.MinResponseTime)
-	fmt.Printf("Max Response Time:     %v\n", result.MaxResponseTime)
-} 
\ No newline at end of file
+	fmt.Fprintf(w, "Total Duration:        %v\n", result.TotalDuration)
+	fmt.Fprintf(w, "Requests Per Second:   %.2f\n", result.RequestsPerSecond)
+	fmt.Fprintf(w, "Average Response Time: %v\n", result.AverageResponseTime)
+	fmt.Fprintf(w, "Min Response Time:     %v\n", result.MinResponseTime)
+	fmt.Fprintf(w, "Max Response Time:     %v\n", result.MaxResponseTime)
+	fmt.Fprintf(w, "P50 Response Time:     %v\n", result.P50ResponseTime)
+	fmt.Fprintf(w, "P95 Response Time:     %v\n", result.P95ResponseTime)
+	fmt.Fprintf(w, "P99 Response Time:     %v\n", result.P99ResponseTime)
+	if len(result.RPSOverTime) > 0 {
+		fmt.Fprintln(w, "RPS Over Time:")
+		width := result.TotalDuration / time.Duration(len(result.RPSOverTime))
+		for i, rps := range result.RPSOverTime {
+			fmt.Fprintf(w, "  %8v - %8v:  %.2f\n",
+				(width * time.Duration(i)).Round(time.Millisecond),
+				(width * time.Duration(i+1)).Round(time.Millisecond), rps)
+		}
+	}
+	if len(result.Endpoints) > 1 {
+		names := make([]string, 0, len(result.Endpoints))
+		for name := range result.Endpoints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintln(w, "Per Endpoint:")
+		for _, name := range names {
+			er := result.Endpoints[name]
+			fmt.Fprintf(w, "  %-10s %d requests, %d ok, %d failed, avg %v, p50 %v, p95 %v, p99 %v\n",
+				name, er.Requests, er.SuccessfulRequests, er.FailedRequests,
+				er.AverageResponseTime, er.P50ResponseTime, er.P95ResponseTime, er.P99ResponseTime)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	// 1ms..100ms, shuffled: nearest rank puts p50 at 50ms
+	durations := make([]time.Duration, 100)
+	for i := range durations {
+		durations[i] = time.Duration((i*37)%100+1) * time.Millisecond
+	}
+	p50, p95, p99 := percentiles(durations)
+	if p50 != 50*time.Millisecond || p95 != 95*time.Millisecond || p99 != 99*time.Millisecond {
+		t.Fatalf("percentiles = %s, %s, %s; want 50ms, 95ms, 99ms", p50, p95, p99)
+	}
+}
+
+func TestPercentilesSmallSamples(t *testing.T) {
+	tests := []struct {
+		name          string
+		durations     []time.Duration
+		p50, p95, p99 time.Duration
+	}{
+		{"empty", nil, 0, 0, 0},
+		{"one", []time.Duration{7}, 7, 7, 7},
+		{"two", []time.Duration{9, 3}, 3, 9, 9},
+		{"outlier", []time.Duration{1, 1, 1, 1, 1, 1, 1, 1, 1, 100}, 1, 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p50, p95, p99 := percentiles(tt.durations)
+			if p50 != tt.p50 || p95 != tt.p95 || p99 != tt.p99 {
+				t.Fatalf("percentiles = %d, %d, %d; want %d, %d, %d", p50, p95, p99, tt.p50, tt.p95, tt.p99)
+			}
+		})
+	}
+}
+
+func TestSummarizeEndpoint(t *testing.T) {
+	results := []RequestResult{
+		{Success: true, Duration: 10 * time.Millisecond},
+		{Success: true, Duration: 30 * time.Millisecond},
+		{Success: false, Duration: 20 * time.Millisecond},
+	}
+	got := summarizeEndpoint(results)
+	if got.Requests != 3 || got.SuccessfulRequests != 2 || got.FailedRequests != 1 {
+		t.Fatalf("counts = %+v", got)
+	}
+	if got.AverageResponseTime != 20*time.Millisecond {
+		t.Fatalf("average = %s, want 20ms over the successful requests", got.AverageResponseTime)
+	}
+	if got.P50ResponseTime != 20*time.Millisecond || got.P99ResponseTime != 30*time.Millisecond {
+		t.Fatalf("p50 = %s, p99 = %s; want 20ms, 30ms", got.P50ResponseTime, got.P99ResponseTime)
+	}
+}
+
+func TestParseOptionsDefaults(t *testing.T) {
+	opts, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.totalRequests != 5000 || opts.workers != 100 || opts.numUsers != 10 || opts.quick {
+		t.Fatalf("defaults = %+v", opts)
+	}
+}
+
+func TestParseOptionsQuick(t *testing.T) {
+	opts, err := parseOptions([]string{"quick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.quick || opts.totalRequests != 50 || opts.workers != 10 {
+		t.Fatalf("quick = %+v, want 50 requests on 10 workers", opts)
+	}
+
+	// Explicit flags win over quick
+	opts, err = parseOptions([]string{"-requests", "7", "quick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.totalRequests != 7 || opts.workers != 10 {
+		t.Fatalf("quick with -requests = %+v, want 7 requests on 10 workers", opts)
+	}
+}
+
+func TestParseOptionsRejectsInvalid(t *testing.T) {
+	tests := [][]string{
+		{"-requests", "0"},
+		{"-workers", "-1"},
+		{"-users", "0"},
+		{"-timeout", "0s"},
+		{"-ramp", "-1s"},
+		{"-mix", "bogus=1"},
+		{"-output", "xml"},
+		{"-requests", "ten"},
+		{"slow"},
+	}
+	for _, args := range tests {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("parseOptions(%q) accepted invalid input", args)
+		}
+	}
+}
+
+func TestDispatchOffset(t *testing.T) {
+	if got := dispatchOffset(3, 10, 0); got != 0 {
+		t.Fatalf("no ramp: offset = %s, want 0", got)
+	}
+	for i, want := range []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond} {
+		if got := dispatchOffset(i, 4, time.Second); got != want {
+			t.Errorf("dispatchOffset(%d, 4, 1s) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestRampSpreadsDispatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		arrivals []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	mix, _ := parseMix("generate=100")
+	opts := options{baseURL: srv.URL, totalRequests: 5, workers: 5, timeout: time.Second, ramp: 200 * time.Millisecond, mix: mix}
+	result := runLoadTest(opts, generateUserIDs(1))
+	if result.SuccessfulRequests != 5 {
+		t.Fatalf("successful = %d, want 5", result.SuccessfulRequests)
+	}
+
+	// Five idle workers would send everything at once without the ramp
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Before(arrivals[j]) })
+	if spread := arrivals[len(arrivals)-1].Sub(arrivals[0]); spread < 150*time.Millisecond {
+		t.Fatalf("requests arrived within %s, want them spread over the 200ms ramp", spread)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// endpoint is an API route the load tester can call.
+type endpoint struct {
+	name   string
+	method string
+	path   string
+}
+
+// Endpoints selectable in -mix. /user/history isn't one: without auth it
+// takes the admin token, which the load tester doesn't send.
+var endpoints = map[string]endpoint{
+	"generate": {name: "generate", method: http.MethodPost, path: "/generate-data"},
+	"stats":    {name: "stats", method: http.MethodGet, path: "/user/stats"},
+}
+
+type weightedEndpoint struct {
+	endpoint
+	weight int
+}
+
+// parseMix parses a mix like "generate=70,stats=30" into weighted endpoints.
+// Weights are relative and need not sum to 100.
+func parseMix(s string) ([]weightedEndpoint, error) {
+	var mix []weightedEndpoint
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		name, weightStr, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("mix entry %q must be name=weight", part)
+		}
+		ep, ok := endpoints[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown endpoint %q in mix", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("endpoint %q appears more than once in mix", name)
+		}
+		seen[name] = true
+
+		weight, err := strconv.Atoi(weightStr)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("weight for %q must be a non-negative integer", name)
+		}
+		if weight > 0 {
+			mix = append(mix, weightedEndpoint{endpoint: ep, weight: weight})
+		}
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("mix must give at least one endpoint a positive weight")
+	}
+	return mix, nil
+}
+
+// pickEndpoint chooses an endpoint from mix with probability proportional
+// to its weight.
+func pickEndpoint(rng *rand.Rand, mix []weightedEndpoint) endpoint {
+	total := 0
+	for _, w := range mix {
+		total += w.weight
+	}
+	n := rng.Intn(total)
+	for _, w := range mix {
+		if n < w.weight {
+			return w.endpoint
+		}
+		n -= w.weight
+	}
+	return mix[len(mix)-1].endpoint
+}
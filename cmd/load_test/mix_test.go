@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPickEndpointFollowsWeights(t *testing.T) {
+	mix, err := parseMix("generate=70, stats=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const picks = 10000
+	rng := rand.New(rand.NewSource(1))
+	counts := map[string]int{}
+	for i := 0; i < picks; i++ {
+		counts[pickEndpoint(rng, mix).name]++
+	}
+
+	for name, want := range map[string]float64{"generate": 0.7, "stats": 0.3} {
+		if got := float64(counts[name]) / picks; math.Abs(got-want) > 0.02 {
+			t.Errorf("%s picked %.3f of the time, want %.2f", name, got, want)
+		}
+	}
+}
+
+func TestPickEndpointSkipsZeroWeight(t *testing.T) {
+	mix, err := parseMix("generate=0,stats=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if ep := pickEndpoint(rng, mix); ep.name != "stats" {
+			t.Fatalf("picked %q with zero weight", ep.name)
+		}
+	}
+}
+
+func TestParseMixRejectsMalformed(t *testing.T) {
+	for _, s := range []string{"", "generate", "generate=x", "generate=-1", "search=1", "generate=1,generate=2", "generate=0,stats=0"} {
+		if _, err := parseMix(s); err == nil {
+			t.Errorf("parseMix(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Result formats for -output
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// writeResults writes result to w in the given format.
+func writeResults(w io.Writer, format string, result LoadTestResult) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	case formatCSV:
+		return writeCSV(w, result)
+	case formatText:
+		printResults(w, result)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// writeCSV writes a header row and a single row of values, with durations
+// in nanoseconds to match the JSON output.
+func writeCSV(w io.Writer, result LoadTestResult) error {
+	cw := csv.NewWriter(w)
+	records := [][]string{
+		{
+			"total_requests", "successful_requests", "failed_requests",
+			"total_duration_ns", "average_response_time_ns",
+			"min_response_time_ns", "max_response_time_ns",
+			"p50_response_time_ns", "p95_response_time_ns", "p99_response_time_ns",
+			"requests_per_second",
+		},
+		{
+			strconv.FormatInt(result.TotalRequests, 10),
+			strconv.FormatInt(result.SuccessfulRequests, 10),
+			strconv.FormatInt(result.FailedRequests, 10),
+			strconv.FormatInt(int64(result.TotalDuration), 10),
+			strconv.FormatInt(int64(result.AverageResponseTime), 10),
+			strconv.FormatInt(int64(result.MinResponseTime), 10),
+			strconv.FormatInt(int64(result.MaxResponseTime), 10),
+			strconv.FormatInt(int64(result.P50ResponseTime), 10),
+			strconv.FormatInt(int64(result.P95ResponseTime), 10),
+			strconv.FormatInt(int64(result.P99ResponseTime), 10),
+			strconv.FormatFloat(result.RequestsPerSecond, 'f', 2, 64),
+		},
+	}
+	if err := cw.WriteAll(records); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sampleResult = LoadTestResult{
+	TotalRequests:       10,
+	SuccessfulRequests:  9,
+	FailedRequests:      1,
+	TotalDuration:       2 * time.Second,
+	AverageResponseTime: 150 * time.Millisecond,
+	MinResponseTime:     100 * time.Millisecond,
+	MaxResponseTime:     400 * time.Millisecond,
+	P50ResponseTime:     120 * time.Millisecond,
+	P95ResponseTime:     350 * time.Millisecond,
+	P99ResponseTime:     400 * time.Millisecond,
+	RequestsPerSecond:   5,
+}
+
+func TestWriteResultsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeResults(&buf, formatJSON, sampleResult); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	want := map[string]float64{
+		"total_requests":       10,
+		"failed_requests":      1,
+		"p50_response_time_ns": 120e6,
+		"p99_response_time_ns": 400e6,
+		"requests_per_second":  5,
+	}
+	for key, value := range want {
+		if decoded[key] != value {
+			t.Errorf("%s = %v, want %v", key, decoded[key], value)
+		}
+	}
+}
+
+func TestWriteResultsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeResults(&buf, formatCSV, sampleResult); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(records[0]) != len(records[1]) {
+		t.Fatalf("want a header and one row of the same width, got %q", records)
+	}
+	row := map[string]string{}
+	for i, name := range records[0] {
+		row[name] = records[1][i]
+	}
+	want := map[string]string{
+		"total_requests":       "10",
+		"successful_requests":  "9",
+		"p95_response_time_ns": "350000000",
+		"requests_per_second":  "5.00",
+	}
+	for name, value := range want {
+		if row[name] != value {
+			t.Errorf("%s = %q, want %q", name, row[name], value)
+		}
+	}
+}
+
+func TestWriteResultsText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeResults(&buf, formatText, sampleResult); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Total Requests:        10", "P95 Response Time:     350ms", "P99 Response Time:     400ms"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("text output lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestWriteResultsUnknownFormat(t *testing.T) {
+	if err := writeResults(&bytes.Buffer{}, "xml", sampleResult); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
@@ -1,27 +1,54 @@
 USE manifold;
 
+-- Mirrors the schema internal/database/migrations builds; keep the two in
+-- sync. The server still runs the migrations against this database and
+-- skips the columns and indexes that already exist.
+
 
 CREATE TABLE IF NOT EXISTS users (
     user_id VARCHAR(255) PRIMARY KEY,
     words_left INT NOT NULL DEFAULT 1000000,
     total_words INT NOT NULL DEFAULT 1000000,
+    profile VARCHAR(64) NOT NULL DEFAULT 'default',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    INDEX idx_words_left (words_left)
+    INDEX idx_words_left (words_left),
+    INDEX idx_users_updated_at (updated_at)
 ) ENGINE=InnoDB;
 
 
 CREATE TABLE IF NOT EXISTS requests (
     id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
     user_id VARCHAR(255) NOT NULL,
     data TEXT,
-    duration INT NOT NULL,
+    duration INT NOT NULL, -- whole seconds, kept for older readers
+    duration_ms INT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     INDEX idx_user_id (user_id),
     INDEX idx_created_at (created_at),
+    INDEX idx_requests_request_id (request_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- API keys are stored as SHA-256 hex digests
+CREATE TABLE IF NOT EXISTS user_keys (
+    key_hash CHAR(64) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    INDEX idx_user_id (user_id),
     FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 ) ENGINE=InnoDB;
 
+-- Refunds by request ID, so a replayed refund isn't applied twice
+CREATE TABLE IF NOT EXISTS refunds (
+    request_id VARCHAR(128) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    words INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
+
 INSERT IGNORE INTO users (user_id, words_left, total_words) VALUES 
 ('user1', 1000000, 1000000),
 ('user2', 1000000, 1000000),
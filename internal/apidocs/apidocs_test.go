@@ -0,0 +1,139 @@
+package apidocs
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Joins key paths; path keys like /user/stats contain "/"
+const sep = "\x1f"
+
+var (
+	keyLine = regexp.MustCompile(`^( *)(- )?([^\s:#"'-][^:]*|"[^"]*"):(\s|$)`)
+	refLine = regexp.MustCompile(`\$ref: "#/([^"]+)"`)
+)
+
+// specKeys returns every mapping key in the spec as its path of keys joined
+// by sep, and the $ref targets it uses, joined the same way. It parses only
+// as much YAML as the hand-written spec needs: block mappings, sequences
+// and "|" block scalars, indented with spaces.
+func specKeys(t *testing.T) (map[string]bool, []string) {
+	t.Helper()
+	keys := map[string]bool{}
+	var refs []string
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	blockIndent := -1 // indent of the key that opened a "|" scalar
+
+	scanner := bufio.NewScanner(bytes.NewReader(spec))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.Contains(line, "\t") {
+			t.Fatalf("line %d is indented with a tab", n)
+		}
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if blockIndent >= 0 {
+			if trimmed == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if m := refLine.FindStringSubmatch(line); m != nil {
+			refs = append(refs, strings.ReplaceAll(m[1], "/", sep))
+			continue
+		}
+
+		m := keyLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		keyIndent := indent
+		if m[2] != "" {
+			keyIndent += 2 // "- key:" starts a mapping inside the item
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= keyIndent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, level{keyIndent, strings.Trim(m[3], `"`)})
+		parts := make([]string, len(stack))
+		for i, l := range stack {
+			parts[i] = l.key
+		}
+		keys[strings.Join(parts, sep)] = true
+		if strings.HasSuffix(trimmed, "|") {
+			blockIndent = keyIndent
+		}
+	}
+	return keys, refs
+}
+
+func TestSpecIsWellFormed(t *testing.T) {
+	if !bytes.HasPrefix(spec, []byte("openapi: 3.")) {
+		t.Fatal("spec doesn't start with an OpenAPI 3 version")
+	}
+	keys, refs := specKeys(t)
+	for _, section := range []string{"info" + sep + "title", "info" + sep + "version", "paths", "components" + sep + "schemas"} {
+		if !keys[section] {
+			t.Errorf("spec has no %s", strings.ReplaceAll(section, sep, "."))
+		}
+	}
+
+	// Every $ref points at a defined component
+	for _, ref := range refs {
+		if !keys[ref] {
+			t.Errorf("$ref #/%s is not defined", strings.ReplaceAll(ref, sep, "/"))
+		}
+	}
+
+	// Every path documents at least one operation
+	paths := 0
+	for key := range keys {
+		parts := strings.Split(key, sep)
+		if len(parts) != 2 || parts[0] != "paths" {
+			continue
+		}
+		paths++
+		found := false
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			found = found || keys[key+sep+method]
+		}
+		if !found {
+			t.Errorf("path %s has no operations", parts[1])
+		}
+	}
+	if paths == 0 {
+		t.Fatal("spec documents no paths")
+	}
+}
+
+func TestSpecAndUIAreServed(t *testing.T) {
+	e := echo.New()
+	e.GET("/openapi.yaml", Spec)
+	e.GET("/docs", UI)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.yaml", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "application/yaml" || !bytes.Equal(rec.Body.Bytes(), spec) {
+		t.Fatalf("spec: status = %d, content type %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `url: "/openapi.yaml"`) {
+		t.Fatalf("UI: status = %d, page doesn't load /openapi.yaml", rec.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Stable codes clients can switch on
+const (
+	CodeBadRequest        = "BAD_REQUEST"
+	CodeUnauthorized      = "UNAUTHORIZED"
+	CodeForbidden         = "FORBIDDEN"
+	CodeNotFound          = "NOT_FOUND"
+	CodeConflict          = "CONFLICT"
+	CodeTooLarge          = "TOO_LARGE"
+	CodeRateLimited       = "RATE_LIMITED"
+	CodeNoWordsLeft       = "NO_WORDS_LEFT"
+	CodeInsufficientWords = "INSUFFICIENT_WORDS"
+	CodeMissingUserID     = "MISSING_USER_ID"
+	CodeInvalidUserID     = "INVALID_USER_ID"
+	CodeUserNotFound      = "USER_NOT_FOUND"
+	CodeUnavailable       = "UNAVAILABLE"
+	CodeInternal          = "INTERNAL"
+)
+
+// Error is the body of every error response.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type envelope struct {
+	Error Error `json:"error"`
+}
+
+// New returns an HTTP error carrying an explicit code.
+func New(status int, code, message string) *echo.HTTPError {
+	return echo.NewHTTPError(status, Error{Code: code, Message: message})
+}
+
+// Handler is an echo.HTTPErrorHandler that renders every error as
+// {"error":{"code":...,"message":...}}. Errors without an explicit code get
+// one from their status; anything that isn't an HTTP error is INTERNAL.
+func Handler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	body := Error{Code: CodeInternal, Message: http.StatusText(status)}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		status = httpErr.Code
+		switch msg := httpErr.Message.(type) {
+		case Error:
+			body = msg
+		case string:
+			body = Error{Code: codeFor(status), Message: msg}
+		default:
+			body = Error{Code: codeFor(status), Message: http.StatusText(status)}
+		}
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, envelope{Error: body})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+func codeFor(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
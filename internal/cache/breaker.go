@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	appmetrics "manifold-test/internal/metrics"
+)
+
+// Breaker states, as reported by the redis_breaker_state gauge
+const (
+	StateClosed   = 0
+	StateOpen     = 1
+	StateHalfOpen = 2
+)
+
+// ErrBreakerOpen is returned instead of calling Redis while the breaker is open.
+var ErrBreakerOpen = errors.New("redis circuit breaker open")
+
+// Getter is the subset of Cache used for cached reads.
+type Getter interface {
+	Get(ctx context.Context, key string) (string, error)
+}
+
+// BreakerReader wraps cache reads in a circuit breaker. After threshold
+// consecutive failures it stops calling Redis for cooldown, then lets a
+// single probe through to decide whether to close again.
+type BreakerReader struct {
+	client    Getter
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	state     int
+	openUntil time.Time
+}
+
+func NewBreakerReader(client Getter, threshold int, cooldown time.Duration) *BreakerReader {
+	appmetrics.RedisBreakerState.Set(StateClosed)
+	return &BreakerReader{
+		client:    client,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Get reads key from the cache. A miss (ErrMiss) counts as success.
+func (b *BreakerReader) Get(ctx context.Context, key string) (string, error) {
+	if !b.allow() {
+		return "", ErrBreakerOpen
+	}
+
+	val, err := b.client.Get(ctx, key)
+	if err != nil && err != ErrMiss {
+		b.recordFailure()
+		return "", err
+	}
+
+	b.recordSuccess()
+	return val, err
+}
+
+// State reports the current breaker state.
+func (b *BreakerReader) State() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *BreakerReader) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.setState(StateHalfOpen)
+		return true
+	case StateHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *BreakerReader) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.setState(StateClosed)
+}
+
+func (b *BreakerReader) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.setState(StateOpen)
+	}
+}
+
+func (b *BreakerReader) setState(state int) {
+	b.state = state
+	appmetrics.RedisBreakerState.Set(float64(state))
+}
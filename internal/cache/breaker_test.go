@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubGetter answers every Get with err.
+type stubGetter struct {
+	err   error
+	calls int
+}
+
+func (g *stubGetter) Get(ctx context.Context, key string) (string, error) {
+	g.calls++
+	if g.err != nil {
+		return "", g.err
+	}
+	return "value", nil
+}
+
+func TestBreakerReaderOpensAndRecovers(t *testing.T) {
+	redis := &stubGetter{err: errors.New("connection refused")}
+	b := NewBreakerReader(redis, 2, 20*time.Millisecond)
+	ctx := context.Background()
+
+	b.Get(ctx, "k")
+	if b.State() != StateClosed {
+		t.Fatalf("state = %d after one failure, want closed", b.State())
+	}
+	b.Get(ctx, "k")
+	if b.State() != StateOpen {
+		t.Fatalf("state = %d after threshold failures, want open", b.State())
+	}
+
+	// Open: Redis isn't called
+	if _, err := b.Get(ctx, "k"); !errors.Is(err, ErrBreakerOpen) || redis.calls != 2 {
+		t.Fatalf("open breaker: err = %v, %d calls", err, redis.calls)
+	}
+
+	// After the cooldown a failing probe opens it again
+	time.Sleep(30 * time.Millisecond)
+	b.Get(ctx, "k")
+	if redis.calls != 3 || b.State() != StateOpen {
+		t.Fatalf("failed probe: %d calls, state %d; want 3, open", redis.calls, b.State())
+	}
+
+	// A successful probe closes it
+	time.Sleep(30 * time.Millisecond)
+	redis.err = nil
+	if val, err := b.Get(ctx, "k"); err != nil || val != "value" {
+		t.Fatalf("probe Get = %q, %v", val, err)
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("state = %d after a successful probe, want closed", b.State())
+	}
+}
+
+func TestBreakerReaderHalfOpenAllowsOneProbe(t *testing.T) {
+	b := NewBreakerReader(&stubGetter{}, 1, 0)
+	b.recordFailure()
+
+	if !b.allow() {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	if b.State() != StateHalfOpen {
+		t.Fatalf("state = %d, want half-open", b.State())
+	}
+	if b.allow() {
+		t.Fatal("second request allowed while the probe is in flight")
+	}
+}
+
+func TestBreakerReaderMissIsSuccess(t *testing.T) {
+	b := NewBreakerReader(&stubGetter{err: ErrMiss}, 1, time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := b.Get(context.Background(), "k"); err != ErrMiss {
+			t.Fatalf("Get error = %v, want ErrMiss", err)
+		}
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("misses opened the breaker")
+	}
+}
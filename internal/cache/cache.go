@@ -0,0 +1,30 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrMiss is returned by Get when the key isn't cached.
+var ErrMiss = errors.New("cache miss")
+
+// Cache is the key-value store behind the user stats cache and idempotency
+// keys. RedisCache is used in production; MemoryCache keeps everything in
+// process for local development.
+type Cache interface {
+	Ping(ctx context.Context) error
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// SetNX sets key only if it doesn't exist and reports whether it did.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Del(ctx context.Context, key string) error
+	// DelIfValue deletes key only while it still holds value.
+	DelIfValue(ctx context.Context, key, value string) error
+	// DelKeys deletes keys and reports how many existed.
+	DelKeys(ctx context.Context, keys ...string) (int64, error)
+	// DelPrefix deletes every key starting with prefix (a literal, not a
+	// pattern) and reports how many there were.
+	DelPrefix(ctx context.Context, prefix string) (int64, error)
+}
@@ -0,0 +1,23 @@
+package cache
+
+import "strings"
+
+// keyPrefix namespaces every key, so environments or apps can share one
+// Redis. It is set once at startup, before any key is built.
+var keyPrefix string
+
+// SetKeyPrefix sets the namespace that Key prepends; "" means none.
+func SetKeyPrefix(prefix string) {
+	keyPrefix = prefix
+}
+
+// Key joins parts with ":" under the configured prefix, so
+// Key("user_stats", "alice") is "user_stats:alice", or
+// "staging:user_stats:alice" with the prefix "staging".
+func Key(parts ...string) string {
+	key := strings.Join(parts, ":")
+	if keyPrefix == "" {
+		return key
+	}
+	return keyPrefix + ":" + key
+}
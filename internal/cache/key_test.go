@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	defer SetKeyPrefix("")
+
+	if got := Key("user_stats", "alice"); got != "user_stats:alice" {
+		t.Fatalf("no prefix: Key = %q, want user_stats:alice", got)
+	}
+	SetKeyPrefix("staging")
+	if got := Key("user_stats", "alice"); got != "staging:user_stats:alice" {
+		t.Fatalf("prefix staging: Key = %q, want staging:user_stats:alice", got)
+	}
+}
+
+func TestKeyPrefixIsolatesPrefixDeletes(t *testing.T) {
+	defer SetKeyPrefix("")
+	c := NewMemoryCache()
+	ctx := context.Background()
+
+	// Another environment sharing the store
+	SetKeyPrefix("prod")
+	c.Set(ctx, Key("user_stats", "alice"), "{}", time.Minute)
+
+	SetKeyPrefix("staging")
+	c.Set(ctx, Key("user_stats", "alice"), "{}", time.Minute)
+	if n, err := c.DelPrefix(ctx, Key("user_stats", "")); err != nil || n != 1 {
+		t.Fatalf("DelPrefix = %d, %v; want only staging's key", n, err)
+	}
+	if ok, _ := c.Exists(ctx, "prod:user_stats:alice"); !ok {
+		t.Fatal("staging's invalidation removed prod's key")
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time // zero means no expiry
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryCache is an in-process Cache for running without Redis. Expired
+// keys are dropped lazily when they are next touched.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *MemoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.lookup(key)
+	if !ok {
+		return "", ErrMiss
+	}
+	return e.value, nil
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = newMemoryEntry(value, ttl)
+	return nil
+}
+
+func (c *MemoryCache) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(key); ok {
+		return false, nil
+	}
+	c.entries[key] = newMemoryEntry(value, ttl)
+	return true, nil
+}
+
+func (c *MemoryCache) Exists(ctx context.Context, key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.lookup(key)
+	return ok, nil
+}
+
+func (c *MemoryCache) Del(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+	return nil
+}
+
+func (c *MemoryCache) DelIfValue(ctx context.Context, key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.lookup(key); ok && e.value == value {
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+func (c *MemoryCache) DelKeys(ctx context.Context, keys ...string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.lookup(key); ok {
+			delete(c.entries, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (c *MemoryCache) DelPrefix(ctx context.Context, prefix string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deleted int64
+	for key := range c.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, ok := c.lookup(key); ok {
+			deleted++
+		}
+		delete(c.entries, key)
+	}
+	return deleted, nil
+}
+
+// lookup returns the live entry for key, dropping it if it has expired.
+// The caller must hold c.mu.
+func (c *MemoryCache) lookup(key string) (memoryEntry, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if e.expired(time.Now()) {
+		delete(c.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, true
+}
+
+func newMemoryEntry(value string, ttl time.Duration) memoryEntry {
+	e := memoryEntry{value: value}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+	return e
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Only delete the key if it still holds the expected value
+var delIfValueScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Keys fetched per SCAN call, and so deleted per DEL, by DelPrefix
+const scanBatchSize = 500
+
+// Escapes the characters SCAN MATCH treats as glob syntax
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// RedisCache is a Cache backed by Redis.
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+func (c *RedisCache) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) (string, error) {
+	val, err := c.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrMiss
+	}
+	return val, err
+}
+
+func (c *RedisCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *RedisCache) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (c *RedisCache) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := c.client.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+func (c *RedisCache) Del(ctx context.Context, key string) error {
+	return c.client.Del(ctx, key).Err()
+}
+
+func (c *RedisCache) DelKeys(ctx context.Context, keys ...string) (int64, error) {
+	return c.client.Del(ctx, keys...).Result()
+}
+
+// DelPrefix walks the keyspace with SCAN rather than KEYS so Redis isn't
+// blocked on a large instance.
+func (c *RedisCache) DelPrefix(ctx context.Context, prefix string) (int64, error) {
+	var deleted int64
+	var cursor uint64
+	for {
+		keys, next, err := c.client.Scan(ctx, cursor, globEscaper.Replace(prefix)+"*", scanBatchSize).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			n, err := c.client.Del(ctx, keys...).Result()
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+func (c *RedisCache) DelIfValue(ctx context.Context, key, value string) error {
+	return delIfValueScript.Run(ctx, c.client, []string{key}, value).Err()
+}
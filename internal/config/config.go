@@ -1,27 +1,648 @@
 package config
 
 import (
+	"database/sql"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/redis/go-redis/v9"
+
+	"manifold-test/internal/database/dialect"
+)
+
+// Storage backends selectable with STORAGE
+const (
+	StorageMySQL  = "mysql"
+	StorageMemory = "memory"
 )
 
+// minRequestMaxDataBytes leaves room for some data beside the truncation
+// marker.
+const minRequestMaxDataBytes = 64
+
 type Config struct {
-	DSN      string
-	RedisURL string
+	// Storage is mysql (MySQL + Redis) or memory (in-process, for local
+	// development; nothing survives a restart)
+	Storage string
+
+	// DBDriver picks the SQL database behind STORAGE=mysql: mysql, or
+	// postgres with DSN as a postgres:// URL
+	DBDriver string
+
+	DSN        string
+	RedisURL   string
+	ServerPort int
+
+	// RedisPrefix namespaces every cache key so environments or apps can
+	// share one Redis; empty means no prefix
+	RedisPrefix string
+
+	// HTTP/2 (h2c) and keep-alive tuning
+	HTTP2Enabled              bool
+	HTTP2MaxConcurrentStreams int
+	HTTPIdleTimeout           time.Duration
+
+	// Starting word quota for newly created users
+	DefaultQuota int
+
+	// Connection pool tuning for the MySQL handle
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+
+	// Per-minute request budgets, tracked per (user, endpoint). The
+	// generate budget is one counter shared by every route that generates
+	// words
+	RateLimitDefault      int
+	RateLimitGenerateData int
+	RateLimitUserStats    int
+
+	// Per-minute budget per (client IP, endpoint), checked before the
+	// per-user limit; 0 disables it. The client IP comes from
+	// X-Forwarded-For only when the connecting peer is in TrustedProxies
+	// (IPs or CIDRs); otherwise it is the peer address
+	RateLimitIP    int
+	TrustedProxies []string
+
+	// Most (user or IP, endpoint) counters each limiter holds before
+	// evicting the least recently used; 0 means unbounded
+	RateLimitMaxTracked int
+
+	// How long a request over its per-user limit may queue for its window
+	// to reset before getting 429; clients can ask for less with
+	// X-Max-Wait. 0 rejects at once
+	RateLimitMaxWait time.Duration
+
+	// X-Quota-Warning is sent once words_left is below this percentage of
+	// total_words; 0 disables it
+	QuotaWarningPercent int
+
+	// Minimum level logged (debug, info, warn or error) and the log line
+	// format (json or text)
+	LogLevel  string
+	LogFormat string
+
+	// Largest request body accepted, in bytes
+	MaxBodyBytes int
+
+	// Honor X-No-Delay, which skips the per-word pause. For load testing
+	// only: any client could then stream as fast as the server generates
+	FastMode bool
+
+	// Pause between words at all. false streams every word back to back
+	// for every request, for dedicated benchmarking environments only
+	GenerationDelayEnabled bool
+
+	// Create a user with the default quota on their first request. Turn it
+	// off once callers are authenticated, so unknown IDs get 404 instead
+	AutoCreateUsers bool
+
+	// Internal callers such as monitoring probes; these user IDs are never
+	// rate limited and stream without spending quota
+	UnlimitedUsers []string
+
+	// How long a single stream may run. The HTTP server's read/write
+	// timeouts are derived from it plus HTTPTimeoutGrace (see HTTPTimeout),
+	// so raising it never gets streams cut off by the server
+	StreamTimeout    time.Duration
+	HTTPTimeoutGrace time.Duration
+
+	// Hard cap on words per stream regardless of quota; -1 means unlimited
+	StreamMaxWords int
+
+	// Default stream length when the client sends no max tokens: none,
+	// fixed (LengthMax), uniform or normal over [LengthMin, LengthMax]
+	LengthMode string
+	LengthMin  int
+	LengthMax  int
+
+	// Deadline for each streamed write; a client that can't keep up is cut
+	// off as a slow consumer. 0 disables the deadline
+	StreamWriteTimeout time.Duration
+
+	// A plain-text stream pausing longer than this between words writes a
+	// single space every interval, so idle-sensitive proxies keep the
+	// connection open. 0 disables it
+	StreamHeartbeatInterval time.Duration
+
+	// Buffer request records and write them with multi-row INSERTs of up
+	// to RequestBatchSize rows, at least every RequestBatchFlushInterval.
+	// 0 writes each request immediately
+	RequestBatchSize          int
+	RequestBatchFlushInterval time.Duration
+
+	// Longest request data stored, in bytes; longer data is truncated with
+	// a marker so the insert fits the TEXT column (64KiB, the default).
+	// 0 stores everything
+	RequestMaxDataBytes int
+
+	// Upper bound on background goroutines persisting finished streams
+	PersistMaxGoroutines int
+
+	// Bound on a single DB call made without a deadline of its own, so a
+	// hung database can't block the caller forever
+	DBQueryTimeout time.Duration
+
+	// Deadline for persisting a finished stream (request row, refund and
+	// their retries); it starts when the stream ends and ignores the
+	// client disconnecting
+	DBWriteTimeout time.Duration
+
+	// User stats stay cached for CacheTTL; lookups for users that don't
+	// exist are remembered for CacheNegativeTTL
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+
+	// How many of the most recently active users POST /admin/cache/warm
+	// loads into the stats cache, and whether to do so at startup
+	CacheWarmUsers   int
+	CacheWarmOnStart bool
+
+	// Redis read circuit breaker
+	RedisBreakerThreshold int
+	RedisBreakerCooldown  time.Duration
+
+	// DB write circuit breaker; while open, writes go to the dead letter file
+	DBBreakerThreshold int
+	DBBreakerCooldown  time.Duration
+
+	// Per-user Redis lock around quota updates; a mutation waits up to
+	// QuotaLockTimeout for it before relying on the DB row lock alone.
+	// 0, the default, disables the lock
+	QuotaLockTimeout time.Duration
+	QuotaLockTTL     time.Duration
+
+	// Require Authorization: Bearer <key> and derive the user from the key
+	AuthEnabled bool
+
+	// Alternatively require a bearer JWT and take the user from its sub
+	// claim, verified with an HMAC secret or the keys at a JWKS URL
+	JWTSecret  string
+	JWTJWKSURL string
+
+	// Quota metrics: the per-user gauge is opt-in because it creates one
+	// series per user; the aggregate histogram is always sampled
+	MetricsPerUserWords     bool
+	WordsLeftSampleInterval time.Duration
+
+	// Histogram bucket overrides (comma-separated seconds, or words per
+	// second for the throughput histogram); nil keeps the built-in buckets
+	MetricsRequestDurationBuckets []float64
+	MetricsDBWriteBuckets         []float64
+	MetricsWordsPerSecondBuckets  []float64
+
+	// Idempotency-Key results are kept for IdempotencyTTL. A second request
+	// for a key that is still generating either waits for the first one's
+	// result or is rejected with 409, per IdempotencyConflictMode
+	IdempotencyTTL          time.Duration
+	IdempotencyConflictMode string
+
+	// Newline-delimited dictionary; the built-in word bank is used when empty
+	WordListPath string
+
+	// Persistence retries before an operation is dead-lettered to a file
+	// that is replayed every DeadLetterRetryInterval. Only failures that
+	// certainly didn't write are retried; others are dead-lettered at once
+	PersistRetries          int
+	DeadLetterPath          string
+	DeadLetterRetryInterval time.Duration
+
+	// Users not updated for RetentionDays are deleted, with their requests,
+	// every RetentionInterval; 0 keeps users forever
+	RetentionDays     int
+	RetentionInterval time.Duration
+
+	// Shared token for admin routes; the admin API is disabled when empty
+	AdminToken string
+
+	// HMAC key for stream resume tokens; a random key is used when empty
+	ResumeTokenSecret string
 }
 
-func Load() *Config {
-	dsn := getEnv("DSN", "manifold:manifoldpassword@tcp(localhost:3306)/manifold?parseTime=true")
-	redisURL := getEnv("REDIS_URL", "redis://localhost:6379")
-	
-	// Debug logging
-	fmt.Printf("DSN: %s\n", dsn)
-	fmt.Printf("REDIS_URL: %s\n", redisURL)
-	
-	return &Config{
-		DSN:      dsn,
-		RedisURL: redisURL,
+// Load reads configuration from the environment and validates it so that a
+// bad value fails at startup instead of surfacing later as a driver error.
+func Load() (*Config, error) {
+	cfg := &Config{
+		Storage:  getEnv("STORAGE", StorageMySQL),
+		DBDriver: getEnv("DB_DRIVER", string(dialect.MySQL)),
+		DSN:      getEnv("DSN", "manifold:manifoldpassword@tcp(localhost:3306)/manifold?parseTime=true"),
+		RedisURL: getEnv("REDIS_URL", "redis://localhost:6379"),
+
+		RedisPrefix: os.Getenv("REDIS_PREFIX"),
+
+		IdempotencyConflictMode: getEnv("IDEMPOTENCY_CONFLICT_MODE", "wait"),
+		LengthMode:              getEnv("LENGTH_MODE", "none"),
+		WordListPath:            os.Getenv("WORD_LIST_PATH"),
+		DeadLetterPath:          getEnv("DEAD_LETTER_PATH", "dead_letter.jsonl"),
+		AdminToken:              os.Getenv("ADMIN_TOKEN"),
+		LogLevel:                getEnv("LOG_LEVEL", "info"),
+		LogFormat:               getEnv("LOG_FORMAT", "json"),
+		JWTSecret:               os.Getenv("JWT_SECRET"),
+		JWTJWKSURL:              os.Getenv("JWT_JWKS_URL"),
+		ResumeTokenSecret:       os.Getenv("RESUME_TOKEN_SECRET"),
+		UnlimitedUsers:          getEnvList("UNLIMITED_USERS"),
+		TrustedProxies:          getEnvList("TRUSTED_PROXIES"),
+	}
+
+	var err error
+	if cfg.ServerPort, err = getEnvInt("SERVER_PORT", 8080); err != nil {
+		return nil, err
+	}
+	if cfg.HTTP2Enabled, err = getEnvBool("HTTP2_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.HTTP2MaxConcurrentStreams, err = getEnvInt("HTTP2_MAX_CONCURRENT_STREAMS", 250); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPIdleTimeout, err = getEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.DefaultQuota, err = getEnvInt("DEFAULT_QUOTA", 1000000); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxOpenConns, err = getEnvInt("DB_MAX_OPEN_CONNS", 25); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxIdleConns, err = getEnvInt("DB_MAX_IDLE_CONNS", 25); err != nil {
+		return nil, err
+	}
+	if cfg.DBConnMaxLifetime, err = getEnvDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.DBConnMaxIdleTime, err = getEnvDuration("DB_CONN_MAX_IDLE_TIME", 0); err != nil {
+		return nil, err
+	}
+	if cfg.StreamTimeout, err = getEnvDuration("STREAM_TIMEOUT", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPTimeoutGrace, err = getEnvDuration("HTTP_TIMEOUT_GRACE", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StreamMaxWords, err = getEnvInt("STREAM_MAX_WORDS", -1); err != nil {
+		return nil, err
+	}
+	if cfg.LengthMin, err = getEnvInt("LENGTH_MIN", 100); err != nil {
+		return nil, err
+	}
+	if cfg.LengthMax, err = getEnvInt("LENGTH_MAX", 500); err != nil {
+		return nil, err
+	}
+	if cfg.StreamWriteTimeout, err = getEnvDuration("STREAM_WRITE_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StreamHeartbeatInterval, err = getEnvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.RequestBatchSize, err = getEnvInt("REQUEST_BATCH_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RequestBatchFlushInterval, err = getEnvDuration("REQUEST_BATCH_FLUSH_INTERVAL", 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.RequestMaxDataBytes, err = getEnvInt("REQUEST_MAX_DATA_BYTES", 65535); err != nil {
+		return nil, err
+	}
+	if cfg.PersistMaxGoroutines, err = getEnvInt("PERSIST_MAX_GOROUTINES", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.DBWriteTimeout, err = getEnvDuration("DB_WRITE_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DBQueryTimeout, err = getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.RedisBreakerThreshold, err = getEnvInt("REDIS_BREAKER_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if cfg.RedisBreakerCooldown, err = getEnvDuration("REDIS_BREAKER_COOLDOWN", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DBBreakerThreshold, err = getEnvInt("DB_BREAKER_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if cfg.DBBreakerCooldown, err = getEnvDuration("DB_BREAKER_COOLDOWN", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.QuotaLockTimeout, err = getEnvDuration("QUOTA_LOCK_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.QuotaLockTTL, err = getEnvDuration("QUOTA_LOCK_TTL", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.AuthEnabled, err = getEnvBool("AUTH_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsPerUserWords, err = getEnvBool("METRICS_PER_USER_WORDS", false); err != nil {
+		return nil, err
+	}
+	if cfg.WordsLeftSampleInterval, err = getEnvDuration("WORDS_LEFT_SAMPLE_INTERVAL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.QuotaWarningPercent, err = getEnvInt("QUOTA_WARNING_PERCENT", 5); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBodyBytes, err = getEnvInt("MAX_BODY_BYTES", 64*1024); err != nil {
+		return nil, err
+	}
+	if cfg.FastMode, err = getEnvBool("FAST_MODE", false); err != nil {
+		return nil, err
+	}
+	if cfg.GenerationDelayEnabled, err = getEnvBool("GENERATION_DELAY_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.AutoCreateUsers, err = getEnvBool("AUTO_CREATE_USERS", true); err != nil {
+		return nil, err
+	}
+	if cfg.CacheTTL, err = getEnvDuration("CACHE_TTL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.CacheNegativeTTL, err = getEnvDuration("CACHE_NEGATIVE_TTL", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.CacheWarmUsers, err = getEnvInt("CACHE_WARM_USERS", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.CacheWarmOnStart, err = getEnvBool("CACHE_WARM_ON_START", false); err != nil {
+		return nil, err
+	}
+	if cfg.IdempotencyTTL, err = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.PersistRetries, err = getEnvInt("PERSIST_RETRIES", 3); err != nil {
+		return nil, err
+	}
+	if cfg.DeadLetterRetryInterval, err = getEnvDuration("DEAD_LETTER_RETRY_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.RetentionDays, err = getEnvInt("RETENTION_DAYS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RetentionInterval, err = getEnvDuration("RETENTION_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsRequestDurationBuckets, err = getEnvFloatList("METRICS_REQUEST_DURATION_BUCKETS"); err != nil {
+		return nil, err
 	}
+	if cfg.MetricsDBWriteBuckets, err = getEnvFloatList("METRICS_DB_WRITE_BUCKETS"); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsWordsPerSecondBuckets, err = getEnvFloatList("METRICS_WORDS_PER_SECOND_BUCKETS"); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitDefault, err = getEnvInt("RATE_LIMIT_DEFAULT", 100); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitGenerateData, err = getEnvInt("RATE_LIMIT_GENERATE_DATA", 100); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitUserStats, err = getEnvInt("RATE_LIMIT_USER_STATS", 600); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitIP, err = getEnvInt("RATE_LIMIT_IP", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitMaxTracked, err = getEnvInt("RATE_LIMIT_MAX_TRACKED", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitMaxWait, err = getEnvDuration("RATE_LIMIT_MAX_WAIT", 0); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the connection strings parse and numeric settings are in range.
+func (c *Config) Validate() error {
+	d, err := dialect.Parse(c.DBDriver)
+	if err != nil {
+		return fmt.Errorf("invalid DB_DRIVER: %w", err)
+	}
+	if d == dialect.Postgres {
+		if u, err := url.Parse(c.DSN); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			return fmt.Errorf("invalid DSN: DB_DRIVER=postgres needs a postgres:// URL")
+		}
+	} else if _, err := mysql.ParseDSN(c.DSN); err != nil {
+		return fmt.Errorf("invalid DSN: %w", err)
+	}
+	if _, err := redis.ParseURL(c.RedisURL); err != nil {
+		return fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	if c.Storage != StorageMySQL && c.Storage != StorageMemory {
+		return fmt.Errorf("invalid STORAGE %q: must be mysql or memory", c.Storage)
+	}
+	// Only the MySQL driver is linked in by default; fail here rather than
+	// at the first connection
+	if c.Storage == StorageMySQL && !slices.Contains(sql.Drivers(), c.DBDriver) {
+		return fmt.Errorf("invalid DB_DRIVER %q: no driver registered under that name in this build", c.DBDriver)
+	}
+	if c.Storage == StorageMemory && c.AuthEnabled {
+		return fmt.Errorf("invalid AUTH_ENABLED: API keys require STORAGE=mysql")
+	}
+	if c.JWTSecret != "" && c.JWTJWKSURL != "" {
+		return fmt.Errorf("invalid JWT_JWKS_URL: set either JWT_SECRET or JWT_JWKS_URL, not both")
+	}
+	if c.JWTEnabled() && c.AuthEnabled {
+		return fmt.Errorf("invalid AUTH_ENABLED: API keys and JWT auth both use the bearer token; enable one")
+	}
+	if c.ServerPort < 1 || c.ServerPort > 65535 {
+		return fmt.Errorf("invalid SERVER_PORT %d: must be between 1 and 65535", c.ServerPort)
+	}
+	if c.HTTP2MaxConcurrentStreams < 1 {
+		return fmt.Errorf("invalid HTTP2_MAX_CONCURRENT_STREAMS %d: must be at least 1", c.HTTP2MaxConcurrentStreams)
+	}
+	if c.DefaultQuota < 1 {
+		return fmt.Errorf("invalid DEFAULT_QUOTA %d: must be at least 1", c.DefaultQuota)
+	}
+	if c.DBMaxOpenConns < 1 {
+		return fmt.Errorf("invalid DB_MAX_OPEN_CONNS %d: must be at least 1", c.DBMaxOpenConns)
+	}
+	if c.DBMaxIdleConns < 0 || c.DBMaxIdleConns > c.DBMaxOpenConns {
+		return fmt.Errorf("invalid DB_MAX_IDLE_CONNS %d: must be between 0 and DB_MAX_OPEN_CONNS (%d)", c.DBMaxIdleConns, c.DBMaxOpenConns)
+	}
+	if c.StreamTimeout <= 0 {
+		return fmt.Errorf("invalid STREAM_TIMEOUT %s: must be positive", c.StreamTimeout)
+	}
+	// Keeps HTTPTimeout strictly above StreamTimeout
+	if c.HTTPTimeoutGrace <= 0 {
+		return fmt.Errorf("invalid HTTP_TIMEOUT_GRACE %s: must be positive", c.HTTPTimeoutGrace)
+	}
+	if c.StreamHeartbeatInterval < 0 {
+		return fmt.Errorf("invalid STREAM_HEARTBEAT_INTERVAL %s: must not be negative", c.StreamHeartbeatInterval)
+	}
+	if c.StreamMaxWords < -1 || c.StreamMaxWords == 0 {
+		return fmt.Errorf("invalid STREAM_MAX_WORDS %d: must be -1 (unlimited) or positive", c.StreamMaxWords)
+	}
+	switch c.LengthMode {
+	case "none":
+	case "fixed", "uniform", "normal":
+		if c.LengthMin < 1 || c.LengthMax < c.LengthMin {
+			return fmt.Errorf("invalid LENGTH_MIN %d / LENGTH_MAX %d: need 1 <= LENGTH_MIN <= LENGTH_MAX", c.LengthMin, c.LengthMax)
+		}
+	default:
+		return fmt.Errorf("invalid LENGTH_MODE %q: must be none, fixed, uniform or normal", c.LengthMode)
+	}
+	if c.RequestBatchSize < 0 {
+		return fmt.Errorf("invalid REQUEST_BATCH_SIZE %d: must not be negative", c.RequestBatchSize)
+	}
+	if c.RequestBatchSize > 0 && c.RequestBatchFlushInterval <= 0 {
+		return fmt.Errorf("invalid REQUEST_BATCH_FLUSH_INTERVAL %s: must be positive", c.RequestBatchFlushInterval)
+	}
+	if c.RequestMaxDataBytes != 0 && c.RequestMaxDataBytes < minRequestMaxDataBytes {
+		return fmt.Errorf("invalid REQUEST_MAX_DATA_BYTES %d: must be 0 or at least %d", c.RequestMaxDataBytes, minRequestMaxDataBytes)
+	}
+	if c.PersistMaxGoroutines < 1 {
+		return fmt.Errorf("invalid PERSIST_MAX_GOROUTINES %d: must be at least 1", c.PersistMaxGoroutines)
+	}
+	if c.DBWriteTimeout <= 0 {
+		return fmt.Errorf("invalid DB_WRITE_TIMEOUT %s: must be positive", c.DBWriteTimeout)
+	}
+	if c.DBQueryTimeout <= 0 {
+		return fmt.Errorf("invalid DB_QUERY_TIMEOUT %s: must be positive", c.DBQueryTimeout)
+	}
+	if c.RedisBreakerThreshold < 1 {
+		return fmt.Errorf("invalid REDIS_BREAKER_THRESHOLD %d: must be at least 1", c.RedisBreakerThreshold)
+	}
+	if c.DBBreakerThreshold < 1 {
+		return fmt.Errorf("invalid DB_BREAKER_THRESHOLD %d: must be at least 1", c.DBBreakerThreshold)
+	}
+	if c.QuotaLockTimeout < 0 {
+		return fmt.Errorf("invalid QUOTA_LOCK_TIMEOUT %s: must not be negative", c.QuotaLockTimeout)
+	}
+	if c.QuotaLockTimeout > 0 && c.QuotaLockTTL <= 0 {
+		return fmt.Errorf("invalid QUOTA_LOCK_TTL %s: must be positive", c.QuotaLockTTL)
+	}
+	if c.WordsLeftSampleInterval <= 0 {
+		return fmt.Errorf("invalid WORDS_LEFT_SAMPLE_INTERVAL %s: must be positive", c.WordsLeftSampleInterval)
+	}
+	if c.PersistRetries < 0 {
+		return fmt.Errorf("invalid PERSIST_RETRIES %d: must not be negative", c.PersistRetries)
+	}
+	if c.DeadLetterRetryInterval <= 0 {
+		return fmt.Errorf("invalid DEAD_LETTER_RETRY_INTERVAL %s: must be positive", c.DeadLetterRetryInterval)
+	}
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("invalid RETENTION_DAYS %d: must not be negative", c.RetentionDays)
+	}
+	if c.RetentionDays > 0 && c.RetentionInterval <= 0 {
+		return fmt.Errorf("invalid RETENTION_INTERVAL %s: must be positive", c.RetentionInterval)
+	}
+	if c.RateLimitIP < 0 {
+		return fmt.Errorf("invalid RATE_LIMIT_IP %d: must not be negative", c.RateLimitIP)
+	}
+	if c.RateLimitMaxTracked < 0 {
+		return fmt.Errorf("invalid RATE_LIMIT_MAX_TRACKED %d: must not be negative", c.RateLimitMaxTracked)
+	}
+	if c.RateLimitMaxWait < 0 {
+		return fmt.Errorf("invalid RATE_LIMIT_MAX_WAIT %s: must not be negative", c.RateLimitMaxWait)
+	}
+	if _, err := c.TrustedProxyNets(); err != nil {
+		return err
+	}
+	if c.QuotaWarningPercent < 0 || c.QuotaWarningPercent > 100 {
+		return fmt.Errorf("invalid QUOTA_WARNING_PERCENT %d: must be between 0 and 100", c.QuotaWarningPercent)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q: must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("invalid LOG_FORMAT %q: must be json or text", c.LogFormat)
+	}
+	if c.MaxBodyBytes < 1 {
+		return fmt.Errorf("invalid MAX_BODY_BYTES %d: must be positive", c.MaxBodyBytes)
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("invalid CACHE_TTL %s: must be positive", c.CacheTTL)
+	}
+	if c.CacheNegativeTTL <= 0 {
+		return fmt.Errorf("invalid CACHE_NEGATIVE_TTL %s: must be positive", c.CacheNegativeTTL)
+	}
+	if c.CacheWarmUsers < 1 {
+		return fmt.Errorf("invalid CACHE_WARM_USERS %d: must be at least 1", c.CacheWarmUsers)
+	}
+	if c.IdempotencyConflictMode != "wait" && c.IdempotencyConflictMode != "reject" {
+		return fmt.Errorf("invalid IDEMPOTENCY_CONFLICT_MODE %q: must be wait or reject", c.IdempotencyConflictMode)
+	}
+	return nil
+}
+
+// Dialect returns the SQL dialect for DBDriver, which Validate checked.
+func (c *Config) Dialect() dialect.Dialect {
+	return dialect.Dialect(c.DBDriver)
+}
+
+// RedactedDSN returns the DSN with the password masked, safe for logging.
+func (c *Config) RedactedDSN() string {
+	if c.Dialect() == dialect.Postgres {
+		u, err := url.Parse(c.DSN)
+		if err != nil {
+			return "<invalid>"
+		}
+		return u.Redacted()
+	}
+	parsed, err := mysql.ParseDSN(c.DSN)
+	if err != nil {
+		return "<invalid>"
+	}
+	if parsed.Passwd != "" {
+		parsed.Passwd = "xxxxx"
+	}
+	return parsed.FormatDSN()
+}
+
+// RedactedRedisURL returns the Redis URL with any password masked.
+func (c *Config) RedactedRedisURL() string {
+	u, err := url.Parse(c.RedisURL)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
+
+// JWTEnabled reports whether per-user routes require a JWT.
+func (c *Config) JWTEnabled() bool {
+	return c.JWTSecret != "" || c.JWTJWKSURL != ""
+}
+
+// HTTPTimeout is the server read/write timeout: the stream timeout plus
+// grace for request setup and the final flush.
+func (c *Config) HTTPTimeout() time.Duration {
+	return c.StreamTimeout + c.HTTPTimeoutGrace
+}
+
+// TrustedProxyNets parses TrustedProxies; a bare IP is a single-address
+// range.
+func (c *Config) TrustedProxyNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: must be an IP or CIDR", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -29,4 +650,72 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-} 
\ No newline at end of file
+}
+
+// getEnvList splits a comma-separated variable, dropping empty entries.
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvFloatList parses a comma-separated list of numbers in strictly
+// increasing order, as Prometheus requires for buckets. Unset means nil.
+func getEnvFloatList(key string) ([]float64, error) {
+	items := getEnvList(key)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	list := make([]float64, len(items))
+	for i, item := range items {
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: must be comma-separated numbers", key, os.Getenv(key))
+		}
+		if i > 0 && f <= list[i-1] {
+			return nil, fmt.Errorf("invalid %s %q: must be strictly increasing", key, os.Getenv(key))
+		}
+		list[i] = f
+	}
+	return list, nil
+}
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be an integer", key, value)
+	}
+	return n, nil
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", key, value)
+	}
+	return b, nil
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be a duration such as 5m", key, value)
+	}
+	return d, nil
+}
@@ -4,30 +4,35 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"time"
+	"log/slog"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/redis/go-redis/v9"
+
+	"manifold-test/internal/config"
 )
 
-func NewConnection(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn)
+// NewConnection opens the DB_DRIVER database. The MySQL driver is built in;
+// for Postgres a driver registered as "postgres" (e.g. github.com/lib/pq)
+// must be linked into the binary.
+func NewConnection(cfg *config.Config) (*sql.DB, error) {
+	db, err := sql.Open(cfg.DBDriver, cfg.DSN)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Configure connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
 
 	// Test connection
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	log.Println("Database connected successfully")
+	slog.Info("Database connected successfully")
 	return db, nil
 }
 
@@ -45,6 +50,6 @@ func NewRedisConnection(redisURL string) (*redis.Client, error) {
 		return nil, fmt.Errorf("failed to ping Redis: %w", err)
 	}
 
-	log.Println("Redis connected successfully")
+	slog.Info("Redis connected successfully")
 	return client, nil
 } 
\ No newline at end of file
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"manifold-test/internal/config"
+)
+
+// poolDriver opens connections that do nothing, so pool settings can be
+// checked without a database server.
+type poolDriver struct{}
+
+func (poolDriver) Open(string) (driver.Conn, error) { return poolConn{}, nil }
+
+type poolConn struct{}
+
+func (poolConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (poolConn) Close() error                        { return nil }
+func (poolConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func init() {
+	sql.Register("pooltest", poolDriver{})
+}
+
+func TestNewConnectionAppliesPoolSettings(t *testing.T) {
+	cfg := &config.Config{
+		DBDriver:       "pooltest",
+		DBMaxOpenConns: 7,
+		DBMaxIdleConns: 0,
+	}
+	db, err := NewConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stats := db.Stats()
+	if stats.MaxOpenConnections != 7 {
+		t.Fatalf("MaxOpenConnections = %d, want 7", stats.MaxOpenConnections)
+	}
+	// With no idle connections allowed, the ping's connection is closed
+	if stats.Idle != 0 || stats.MaxIdleClosed != 1 {
+		t.Fatalf("idle = %d, closed for max idle = %d; want 0 and 1", stats.Idle, stats.MaxIdleClosed)
+	}
+}
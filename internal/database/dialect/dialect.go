@@ -0,0 +1,68 @@
+// Package dialect covers the differences between the SQL databases the
+// services run on. Queries are written once with MySQL's ? placeholders
+// and rebound for the database in use.
+package dialect
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Dialect string
+
+// Databases selectable with DB_DRIVER
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// Parse returns the dialect named by a DB_DRIVER value.
+func Parse(name string) (Dialect, error) {
+	switch d := Dialect(name); d {
+	case MySQL, Postgres:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown database driver %q: must be mysql or postgres", name)
+}
+
+// Rebind rewrites the ? placeholders in query to the dialect's style:
+// unchanged for MySQL, $1, $2, ... for Postgres. A ? inside a quoted string
+// or identifier, or in a -- comment, is left alone.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote byte // the open quote, or 0 outside quotes
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			// A doubled quote is an escaped one and keeps the quote open
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
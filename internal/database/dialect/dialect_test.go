@@ -0,0 +1,47 @@
+package dialect
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"no placeholders", `SELECT COUNT(*) FROM users`, `SELECT COUNT(*) FROM users`},
+		{"numbered in order",
+			`UPDATE users SET words_left = GREATEST(0, words_left - ?), updated_at = NOW() WHERE user_id = ?`,
+			`UPDATE users SET words_left = GREATEST(0, words_left - $1), updated_at = NOW() WHERE user_id = $2`},
+		{"multi-row insert",
+			`INSERT INTO requests (user_id, data) VALUES (?, ?), (?, ?)`,
+			`INSERT INTO requests (user_id, data) VALUES ($1, $2), ($3, $4)`},
+		{"string literal", `SELECT '?' FROM users WHERE user_id = ?`, `SELECT '?' FROM users WHERE user_id = $1`},
+		{"escaped quote", `SELECT 'it''s ?' WHERE a = ?`, `SELECT 'it''s ?' WHERE a = $1`},
+		{"quoted identifier", `SELECT "odd?name" FROM t WHERE a = ?`, `SELECT "odd?name" FROM t WHERE a = $1`},
+		{"comment", "SELECT 1 -- why?\nWHERE a = ?", "SELECT 1 -- why?\nWHERE a = $1"},
+		{"trailing comment", `SELECT ? -- done?`, `SELECT $1 -- done?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Postgres.Rebind(tt.query); got != tt.want {
+				t.Fatalf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+			if got := MySQL.Rebind(tt.query); got != tt.query {
+				t.Fatalf("MySQL Rebind changed %q to %q", tt.query, got)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{"mysql", "postgres"} {
+		if d, err := Parse(name); err != nil || string(d) != name {
+			t.Errorf("Parse(%q) = %q, %v", name, d, err)
+		}
+	}
+	for _, name := range []string{"", "sqlite", "Postgres"} {
+		if _, err := Parse(name); err == nil {
+			t.Errorf("Parse(%q) accepted", name)
+		}
+	}
+}
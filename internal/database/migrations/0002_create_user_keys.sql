@@ -0,0 +1,9 @@
+-- API keys are stored as SHA-256 hex digests
+CREATE TABLE IF NOT EXISTS user_keys (
+    key_hash CHAR(64) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    INDEX idx_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN profile VARCHAR(64) NOT NULL DEFAULT 'default';
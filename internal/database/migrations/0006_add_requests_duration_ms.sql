@@ -0,0 +1,13 @@
+-- requests.duration was defined in whole seconds, then written in
+-- milliseconds without converting the rows already stored, so one column
+-- mixed both units. duration_ms holds milliseconds for every row and is
+-- what stats read; duration goes back to whole seconds.
+--
+-- Cutover: rows present when this runs are taken to be in seconds, as the
+-- schema defined them. A database that served a release writing
+-- milliseconds to duration before this migration has to correct those
+-- rows by hand (SET duration_ms = duration, duration = duration DIV 1000
+-- for the affected created_at range).
+ALTER TABLE requests ADD COLUMN duration_ms INT NULL;
+UPDATE requests SET duration_ms = duration * 1000 WHERE duration_ms IS NULL;
+ALTER TABLE requests MODIFY duration_ms INT NOT NULL;
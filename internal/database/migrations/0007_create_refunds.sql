@@ -0,0 +1,10 @@
+-- Ledger of refunds by request ID. A refund dead-lettered after a timeout
+-- may have committed; its replay finds the row here and is skipped. No
+-- foreign key: a refund for a user deleted mid-stream must not fail and
+-- be replayed forever.
+CREATE TABLE IF NOT EXISTS refunds (
+    request_id VARCHAR(128) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    words INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB;
@@ -0,0 +1,222 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+
+	"manifold-test/internal/database/dialect"
+)
+
+// MySQL migrations live here, their Postgres ports under postgres/ with the
+// same versions and names
+//
+//go:embed *.sql
+var files embed.FS
+
+//go:embed postgres/*.sql
+var postgresFiles embed.FS
+
+// MySQL errors returned when ADD COLUMN targets an existing column or
+// CREATE INDEX an existing index, e.g. in a database created from init.sql
+// before migrations were tracked
+const (
+	errDupFieldName = 1060
+	errDupKeyName   = 1061
+)
+
+// Serialises instances that boot at the same time
+const (
+	lockName    = "schema_migrations"
+	lockTimeout = 60 // seconds
+
+	// Postgres advisory locks take a number; any constant unique to the app
+	pgLockKey = 7243195602
+)
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Apply runs every embedded migration for d not yet recorded in
+// schema_migrations, in version order. It is safe to run on every boot.
+func Apply(ctx context.Context, db *sql.DB, d dialect.Dialect) error {
+	migrations, err := load(d)
+	if err != nil {
+		return err
+	}
+
+	// Both databases' locks are per connection, so pin one for the whole run
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get migration connection: %w", err)
+	}
+	defer conn.Close()
+
+	unlock, err := acquireLock(ctx, conn, d)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	createTable := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	) ENGINE=InnoDB`
+	if d == dialect.Postgres {
+		createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`
+	}
+	if _, err = conn.ExecContext(ctx, createTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	applied := map[int]bool{}
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := run(ctx, conn, d, m); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+
+	slog.Info("Database schema is up to date")
+	return nil
+}
+
+// acquireLock takes the migration lock on conn: GET_LOCK on MySQL, which
+// gives up after lockTimeout, or an advisory lock on Postgres, which waits
+// as long as ctx allows. The returned func releases it.
+func acquireLock(ctx context.Context, conn *sql.Conn, d dialect.Dialect) (func(), error) {
+	if d == dialect.Postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, pgLockKey); err != nil {
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		return func() { conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, pgLockKey) }, nil
+	}
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, lockTimeout).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return nil, fmt.Errorf("timed out waiting for migration lock")
+	}
+	return func() { conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName) }, nil
+}
+
+// run executes each statement of m and records it. MySQL commits DDL
+// implicitly, so a failed migration is not rolled back; statements are
+// written to be re-runnable instead (the Postgres ports with IF NOT EXISTS).
+func run(ctx context.Context, conn *sql.Conn, d dialect.Dialect, m migration) error {
+	for i, stmt := range statements(m.sql) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			if alreadyApplied(err) {
+				continue
+			}
+			return fmt.Errorf("migration %04d_%s statement %d failed: %w", m.version, m.name, i+1, err)
+		}
+	}
+
+	insert := d.Rebind(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`)
+	if _, err := conn.ExecContext(ctx, insert, m.version, m.name); err != nil {
+		return fmt.Errorf("failed to record migration %04d_%s: %w", m.version, m.name, err)
+	}
+	return nil
+}
+
+// alreadyApplied reports whether err only says the statement's column or
+// index already exists, so the schema is as the statement would leave it.
+func alreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == errDupFieldName || mysqlErr.Number == errDupKeyName)
+}
+
+// load reads d's embedded NNNN_name.sql files sorted by version.
+func load(d dialect.Dialect) ([]migration, error) {
+	var fsys fs.FS = files
+	if d == dialect.Postgres {
+		fsys, _ = fs.Sub(postgresFiles, "postgres") // a valid static path
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	var migrations []migration
+	seen := map[int]string{}
+	for _, e := range entries {
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %q must be named NNNN_name.sql", e.Name())
+		}
+		if other, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migrations %q and %q share version %d", other, e.Name(), version)
+		}
+		seen[version] = e.Name()
+
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", e.Name(), err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// statements splits a migration on semicolons after dropping "--" line
+// comments. Migrations must not use ";" or "--" inside string literals.
+func statements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
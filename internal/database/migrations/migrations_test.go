@@ -0,0 +1,178 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+
+	"manifold-test/internal/database/dialect"
+)
+
+// Both databases must end up with the same schema_migrations history, so
+// every migration needs a port with the same version and name.
+func TestDialectsHaveTheSameMigrations(t *testing.T) {
+	mysql, err := load(dialect.MySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := load(dialect.Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mysql) != len(postgres) {
+		t.Fatalf("%d MySQL migrations, %d Postgres", len(mysql), len(postgres))
+	}
+	for i := range mysql {
+		if mysql[i].version != postgres[i].version || mysql[i].name != postgres[i].name {
+			t.Errorf("MySQL %04d_%s, Postgres %04d_%s", mysql[i].version, mysql[i].name, postgres[i].version, postgres[i].name)
+		}
+		if len(statements(postgres[i].sql)) == 0 {
+			t.Errorf("Postgres %04d_%s has no statements", postgres[i].version, postgres[i].name)
+		}
+	}
+}
+
+func TestAlreadyApplied(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1060, Message: "Duplicate column name 'profile'"}, true},
+		{fmt.Errorf("exec: %w", &mysql.MySQLError{Number: 1061, Message: "Duplicate key name 'idx_users_updated_at'"}), true},
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'manifold.users' doesn't exist"}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := alreadyApplied(tt.err); got != tt.want {
+			t.Errorf("alreadyApplied(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// schemaDB is a database/sql driver that records executed statements and
+// keeps schema_migrations in memory, so Apply runs without a MySQL server.
+type schemaDB struct {
+	mu       sync.Mutex
+	execs    []string
+	versions []int64
+}
+
+func (d *schemaDB) Open(string) (driver.Conn, error) { return schemaConn{d}, nil }
+
+type schemaConn struct{ db *schemaDB }
+
+func (c schemaConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c schemaConn) Close() error                        { return nil }
+func (c schemaConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c schemaConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs = append(c.db.execs, query)
+	if strings.HasPrefix(query, "INSERT INTO schema_migrations") {
+		c.db.versions = append(c.db.versions, args[0].Value.(int64))
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c schemaConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if strings.HasPrefix(query, "SELECT GET_LOCK") {
+		return &schemaRows{values: []int64{1}}, nil
+	}
+	return &schemaRows{values: append([]int64(nil), c.db.versions...)}, nil
+}
+
+type schemaRows struct{ values []int64 }
+
+func (r *schemaRows) Columns() []string { return []string{"c0"} }
+func (r *schemaRows) Close() error      { return nil }
+
+func (r *schemaRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func TestApplyRunsPendingMigrationsOnce(t *testing.T) {
+	fake := &schemaDB{}
+	sql.Register("schematest", fake)
+	db, err := sql.Open("schematest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	all, err := load(dialect.MySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(context.Background(), db, dialect.MySQL); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.versions) != len(all) {
+		t.Fatalf("recorded %d migrations, want all %d", len(fake.versions), len(all))
+	}
+	for i, m := range all {
+		if fake.versions[i] != int64(m.version) {
+			t.Fatalf("migration %d recorded as version %d, want %d", i, fake.versions[i], m.version)
+		}
+	}
+
+	// A second run, as every boot does, finds nothing left to apply
+	ran := len(fake.execs)
+	if err := Apply(context.Background(), db, dialect.MySQL); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range fake.execs[ran:] {
+		if !strings.HasPrefix(stmt, "CREATE TABLE IF NOT EXISTS schema_migrations") && !strings.HasPrefix(stmt, "SELECT RELEASE_LOCK") {
+			t.Fatalf("second run executed %q", stmt)
+		}
+	}
+}
+
+func TestApplyCreatesSchemaOnFreshDatabase(t *testing.T) {
+	for i, d := range []dialect.Dialect{dialect.MySQL, dialect.Postgres} {
+		fake := &schemaDB{}
+		name := fmt.Sprintf("schematest-fresh-%d", i)
+		sql.Register(name, fake)
+		db, err := sql.Open(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := Apply(context.Background(), db, d); err != nil {
+			t.Fatalf("%v: %v", d, err)
+		}
+		schema := strings.Join(fake.execs, "\n")
+		for _, table := range []string{"users", "requests", "user_keys", "refunds"} {
+			if !strings.Contains(schema, "CREATE TABLE IF NOT EXISTS "+table+" ") {
+				t.Errorf("%v: table %s is never created", d, table)
+			}
+		}
+		// Columns the services rely on that were added after 0001
+		for _, column := range []string{"profile", "request_id", "duration_ms"} {
+			added := false
+			for _, stmt := range fake.execs {
+				if strings.Contains(stmt, "ADD COLUMN") && strings.Contains(stmt, column) {
+					added = true
+				}
+			}
+			if !added {
+				t.Errorf("%v: column %s is never added", d, column)
+			}
+		}
+	}
+}
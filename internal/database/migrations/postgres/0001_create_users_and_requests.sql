@@ -0,0 +1,21 @@
+-- Postgres has no ON UPDATE CURRENT_TIMESTAMP; every UPDATE of users sets
+-- updated_at = NOW() itself. Index names are per schema on Postgres, so
+-- they carry the table name.
+CREATE TABLE IF NOT EXISTS users (
+    user_id VARCHAR(255) PRIMARY KEY,
+    words_left INT NOT NULL DEFAULT 1000000,
+    total_words INT NOT NULL DEFAULT 1000000,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_users_words_left ON users (words_left);
+
+CREATE TABLE IF NOT EXISTS requests (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    data TEXT,
+    duration INT NOT NULL, -- whole seconds
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_requests_user_id ON requests (user_id);
+CREATE INDEX IF NOT EXISTS idx_requests_created_at ON requests (created_at);
@@ -0,0 +1,8 @@
+-- API keys are stored as SHA-256 hex digests
+CREATE TABLE IF NOT EXISTS user_keys (
+    key_hash CHAR(64) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMPTZ NULL DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_user_keys_user_id ON user_keys (user_id);
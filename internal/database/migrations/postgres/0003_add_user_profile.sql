@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS profile VARCHAR(64) NOT NULL DEFAULT 'default';
@@ -0,0 +1,4 @@
+-- Correlation ID of the HTTP request that produced each row, so a client
+-- can find its row from the X-Request-Id it was given
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS request_id VARCHAR(128) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_requests_request_id ON requests (request_id);
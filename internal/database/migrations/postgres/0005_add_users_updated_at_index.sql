@@ -0,0 +1,2 @@
+-- Recently active users first, for cache warming, and the stale-user purge
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
@@ -0,0 +1,6 @@
+-- duration_ms holds milliseconds and is what stats read; duration is whole
+-- seconds. Postgres databases never stored milliseconds in duration, so
+-- the backfill needs no cutover.
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS duration_ms INT NULL;
+UPDATE requests SET duration_ms = duration * 1000 WHERE duration_ms IS NULL;
+ALTER TABLE requests ALTER COLUMN duration_ms SET NOT NULL;
@@ -0,0 +1,205 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	appmetrics "manifold-test/internal/metrics"
+)
+
+// Operations that can be dead-lettered
+const (
+	OpSaveRequest     = "save_request"
+	OpUpdateWordsLeft = "update_words_left"
+	OpRefundWords     = "refund_words"
+)
+
+// Entry is a persistence operation that failed after all retries, with
+// everything needed to replay it.
+type Entry struct {
+	Op         string    `json:"op"`
+	RequestID  string    `json:"request_id,omitempty"`
+	UserID     string    `json:"user_id"`
+	Data       string    `json:"data,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Words      int       `json:"words,omitempty"`
+	Error      string    `json:"error"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// Store is an append-only JSON-lines file of failed operations. It lives
+// outside the database so usage isn't lost while MySQL is unavailable.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	entries, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	appmetrics.DeadLetterDepth.Set(float64(len(entries)))
+
+	return s, nil
+}
+
+// Add appends an entry to the store.
+func (s *Store) Add(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dead letter file: %w", err)
+	}
+
+	appmetrics.DeadLetterDepth.Inc()
+	return nil
+}
+
+// Record stamps e with its cause and adds it, logging either way. If the
+// store can't be written the operation is lost, and that is logged as an
+// error.
+func (s *Store) Record(ctx context.Context, e Entry, cause error) {
+	e.Error = cause.Error()
+	e.FailedAt = time.Now()
+	if err := s.Add(e); err != nil {
+		slog.ErrorContext(ctx, "Lost persistence operation", "op", e.Op, "user_id", e.UserID, "error", cause, "dead_letter_error", err)
+		return
+	}
+	slog.WarnContext(ctx, "Dead-lettered persistence operation", "op", e.Op, "user_id", e.UserID, "error", cause)
+}
+
+// Reprocess replays every entry with replay and keeps only those that fail
+// again. Entries added while replaying are preserved.
+func (s *Store) Reprocess(ctx context.Context, replay func(context.Context, Entry) error) (int, error) {
+	s.mu.Lock()
+	entries, err := s.readAll()
+	s.mu.Unlock()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var failed []Entry
+	for _, e := range entries {
+		if err := replay(ctx, e); err != nil {
+			e.Error = err.Error()
+			failed = append(failed, e)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readAll()
+	if err != nil {
+		return 0, err
+	}
+	remaining := append(failed, current[len(entries):]...)
+	if err := s.writeAll(remaining); err != nil {
+		return 0, err
+	}
+	appmetrics.DeadLetterDepth.Set(float64(len(remaining)))
+
+	return len(entries) - len(failed), nil
+}
+
+// Start reprocesses the store every interval until ctx is done.
+func (s *Store) Start(ctx context.Context, interval time.Duration, replay func(context.Context, Entry) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				replayed, err := s.Reprocess(ctx, replay)
+				if err != nil {
+					slog.Error("Dead letter reprocessing failed", "error", err)
+				} else if replayed > 0 {
+					slog.Info("Replayed dead-lettered operations", "count", replayed)
+				}
+			}
+		}
+	}()
+}
+
+func (s *Store) readAll() ([]Entry, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("failed to decode dead letter: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letter file: %w", err)
+	}
+	return entries, nil
+}
+
+// writeAll atomically replaces the file contents with entries.
+func (s *Store) writeAll(entries []Entry) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create dead letter file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to encode dead letter: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write dead letter file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync dead letter file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close dead letter file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
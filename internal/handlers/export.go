@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/middleware/userid"
+	"manifold-test/internal/services"
+)
+
+// exportBatchSize is how many request rows ExportRequests reads per query
+// and writes between flushes.
+const exportBatchSize = 500
+
+// Page size of GET /user/history without ?limit, and the most it returns
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 500
+)
+
+// ExportRequests streams every request the caller has made as NDJSON, one
+// models.Request per line, oldest first. Rows are read a batch at a time
+// with a keyset cursor on id, so memory use doesn't grow with the history.
+func (h *Handler) ExportRequests(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := userid.FromContext(ctx)
+
+	// Read the first batch before committing the response, so a failing
+	// database still gets a proper error status
+	batch, err := h.requestService.ListRequests(ctx, userID, 0, exportBatchSize)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to export requests")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(c.Response())
+	enc := json.NewEncoder(c.Response())
+	exported := 0
+	for {
+		// Each batch gets its own write deadline, so a long history isn't
+		// cut off by the server's write timeout
+		if h.writeTimeout > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		}
+		for _, req := range batch {
+			if err := enc.Encode(req); err != nil {
+				return nil // client went away
+			}
+		}
+		c.Response().Flush()
+		exported += len(batch)
+
+		if len(batch) < exportBatchSize {
+			break
+		}
+		batch, err = h.requestService.ListRequests(ctx, userID, batch[len(batch)-1].ID, exportBatchSize)
+		if err != nil {
+			// Too late for an error status: the client sees a short export
+			slog.ErrorContext(ctx, "Export failed mid-stream", "user_id", userID, "exported", exported, "error", err)
+			return nil
+		}
+	}
+
+	slog.InfoContext(ctx, "Exported requests", "user_id", userID, "count", exported)
+	return nil
+}
+
+// RequestHistory returns a page of the caller's requests, oldest first,
+// created between ?from and ?to (RFC3339, inclusive; either may be left
+// out). ?limit and ?offset select the page; total and has_more tell the
+// client how many match and whether to ask for another.
+func (h *Handler) RequestHistory(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := userid.FromContext(ctx)
+
+	from, err := timeParam(c, "from")
+	if err != nil {
+		return err
+	}
+	to, err := timeParam(c, "to")
+	if err != nil {
+		return err
+	}
+	limit, err := intParam(c, "limit", historyDefaultLimit)
+	if err != nil {
+		return err
+	}
+	if limit < 1 || limit > historyMaxLimit {
+		return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(historyMaxLimit))
+	}
+	offset, err := intParam(c, "offset", 0)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "offset must not be negative")
+	}
+
+	page, err := h.requestService.ListRequestsFiltered(ctx, userID, from, to, limit, offset)
+	if errors.Is(err, services.ErrInvalidRange) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must not be after to")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list requests")
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// timeParam parses the RFC3339 query parameter name; it is zero when absent.
+func timeParam(c echo.Context, name string) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, name+" must be an RFC3339 timestamp")
+	}
+	return t, nil
+}
+
+// intParam parses the integer query parameter name, or returns def when it
+// is absent.
+func intParam(c echo.Context, name string, def int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" must be an integer")
+	}
+	return n, nil
+}
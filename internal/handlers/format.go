@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// streamFormatHeader picks how /generate-data frames words.
+const streamFormatHeader = "X-Stream-Format"
+
+// streamFormat frames the words of a plain HTTP stream. Generation is the
+// same for every format; only what goes on the wire differs.
+type streamFormat struct {
+	contentType string
+	frame       func(word string) string
+	// Written during long pauses; whitespace every format's readers skip
+	heartbeat string
+}
+
+var streamFormats = map[string]streamFormat{
+	// Space-separated words, as the stream has always been sent
+	"plain": {
+		contentType: "text/plain",
+		frame:       func(word string) string { return word + " " },
+		heartbeat:   " ",
+	},
+	// One word per line
+	"lines": {
+		contentType: "text/plain",
+		frame:       func(word string) string { return word + "\n" },
+		heartbeat:   "\n",
+	},
+	// One {"word":"..."} object per line
+	"jsonl": {
+		contentType: "application/x-ndjson",
+		frame: func(word string) string {
+			line, _ := json.Marshal(struct {
+				Word string `json:"word"`
+			}{word})
+			return string(line) + "\n"
+		},
+		heartbeat: "\n",
+	},
+}
+
+// parseStreamFormat reads X-Stream-Format, defaulting to plain.
+func parseStreamFormat(c echo.Context) (streamFormat, error) {
+	name := c.Request().Header.Get(streamFormatHeader)
+	if name == "" {
+		name = "plain"
+	}
+	format, ok := streamFormats[name]
+	if !ok {
+		return streamFormat{}, echo.NewHTTPError(http.StatusBadRequest, streamFormatHeader+" must be plain, lines or jsonl")
+	}
+	return format, nil
+}
+
+// text frames a whole space-separated result at once, for idempotent
+// replays and writers that can't flush.
+func (f streamFormat) text(data string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(data) {
+		b.WriteString(f.frame(word))
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/middleware/accesslog"
+	"manifold-test/internal/middleware/userid"
+	"manifold-test/internal/models"
+)
+
+// GenerateText runs a generation to the end and returns it as one JSON
+// body, for clients that can't read a chunked stream. It takes the same
+// headers and body as /generate-data and charges quota the same way.
+func (h *Handler) GenerateText(c echo.Context) (err error) {
+	ctx := c.Request().Context()
+
+	appmetrics.RequestsTotal.Inc()
+	appmetrics.ActiveRequests.Inc()
+	defer appmetrics.ActiveRequests.Dec()
+
+	startWall := time.Now()
+	var stream *wordStream
+	defer func() {
+		appmetrics.RequestDurationSeconds.WithLabelValues(outcomeFor(err)).Observe(time.Since(startWall).Seconds())
+		wordsGenerated := 0
+		if stream != nil {
+			wordsGenerated = stream.generated
+		}
+		appmetrics.WordsGeneratedTotal.Add(float64(wordsGenerated))
+		c.Set(accesslog.WordsGeneratedKey, wordsGenerated)
+	}()
+
+	userID := userid.FromContext(c.Request().Context())
+	params, err := h.parseGenerateParams(c)
+	if err != nil {
+		return err
+	}
+	stream, err = h.startStream(ctx, userID, c.Request().Header.Get("X-Profile"), params, 0)
+	if err != nil {
+		return err
+	}
+
+	// Send the headers now, so the caller has the X-Stream-Id to stop the
+	// generation with while it runs
+	if stream.quotaLow {
+		c.Response().Header().Set(quotaWarningHeader, "low")
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().Header().Set(streamIDHeader, strconv.FormatUint(stream.active.id, 10))
+	c.Response().WriteHeader(http.StatusOK)
+	if flusher, ok := c.Response().Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	stopReason := h.collect(ctx, stream)
+	appmetrics.StreamEndedTotal.WithLabelValues(stopReason).Inc()
+	stream.finish(ctx, startWall)
+
+	return json.NewEncoder(c.Response()).Encode(models.GenerateResponse{
+		Text:       strings.TrimSpace(stream.data.String()),
+		Words:      stream.generated,
+		RequestID:  stream.requestID,
+		StopReason: stopReason,
+		Partial:    stopReason == "timeout",
+	})
+}
+
+// collect generates words at the stream's pace until a limit is hit, the
+// client goes away or a DELETE for its stream ID stops it, and returns the
+// stream-end reason.
+func (h *Handler) collect(ctx context.Context, stream *wordStream) string {
+	streamCtx, cancel := context.WithTimeout(ctx, h.streamTimeout)
+	defer cancel()
+	defer context.AfterFunc(stream.active.stopped, cancel)()
+
+	for {
+		word, stopTokenFound, limitReason := stream.next(streamCtx)
+		if limitReason != "" {
+			if reason := endReason(ctx, streamCtx, stream); reason != "" {
+				return reason
+			}
+			return limitReason
+		}
+		stream.delivered(word)
+
+		if stopTokenFound {
+			return "completed"
+		}
+
+		select {
+		case <-streamCtx.Done():
+			return endReason(ctx, streamCtx, stream)
+		case <-time.After(stream.delay()):
+		}
+	}
+}
+
+// endReason is why streamCtx, derived from ctx, has ended, or "" while it
+// hasn't. It is checked before trusting a limit reason from next: a
+// reservation cut off by the deadline fails like an exhausted quota.
+func endReason(ctx, streamCtx context.Context, stream *wordStream) string {
+	switch {
+	case streamCtx.Err() == nil:
+		return ""
+	case ctx.Err() != nil:
+		return "client_cancel"
+	case stream.active.stopped.Err() != nil:
+		return "client_stop"
+	}
+	return "timeout"
+}
@@ -3,39 +3,222 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/redis/go-redis/v9"
 
+	"manifold-test/internal/apierror"
+	"manifold-test/internal/cache"
+	"manifold-test/internal/config"
+	"manifold-test/internal/deadletter"
+	"manifold-test/internal/idempotency"
 	appmetrics "manifold-test/internal/metrics"
-	"manifold-test/internal/middleware/ratelimit"
+	"manifold-test/internal/middleware/accesslog"
+	"manifold-test/internal/middleware/requestid"
+	"manifold-test/internal/middleware/userid"
 	"manifold-test/internal/models"
+	"manifold-test/internal/resume"
 	"manifold-test/internal/services"
 )
 
+const (
+	// Upper bound on each dependency check in Readyz
+	readinessTimeout = 2 * time.Second
+
+	// Lock held beyond the stream timeout to cover persisting the result
+	idempotencyLockGrace = time.Minute
+
+	// Trailer marking why a stream was cut short by the server
+	streamEndHeader = "X-Stream-End"
+
+	// ID for DELETE /generate-data/:id, sent as a header when a stream starts
+	streamIDHeader = "X-Stream-Id"
+
+	// Trailer with the number of words the client received
+	wordCountHeader = "X-Word-Count"
+
+	// Trailer repeating the request's correlation ID, which the requests
+	// row is stored under once it is persisted in the background
+	correlationIDTrailer = "X-Correlation-Id"
+
+	// Informational header for users nearly out of quota
+	quotaWarningHeader = "X-Quota-Warning"
+
+	// Words reserved from the user's quota at a time while streaming
+	reservationChunk = 100
+
+	// First delay between persistence retries; doubles each attempt
+	persistRetryBackoff = 100 * time.Millisecond
+
+	// How often a duplicate request checks for the first one's result
+	idempotencyPollInterval = 250 * time.Millisecond
+
+	// Words a preview simulates when nothing else bounds the stream
+	previewMaxWords = 100000
+
+	// Aggregate stats are cached this long, as the queries scan every row
+	globalStatsTTL = time.Minute
+
+	// Upper bound on the aggregate queries behind GlobalStats
+	globalStatsTimeout = 10 * time.Second
+
+	// Most user IDs accepted by GetUserStatsBatch
+	maxStatsBatch = 500
+)
+
+// errPersistenceShed is the dead-letter cause for request logs shed at the
+// persistence cap.
+var errPersistenceShed = errors.New("persistence cap reached")
+
+// goLimiter caps the number of concurrently running background goroutines.
+type goLimiter struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newGoLimiter(max int) *goLimiter {
+	return &goLimiter{slots: make(chan struct{}, max)}
+}
+
+// Go runs fn in a new goroutine, or returns false without running it when
+// the cap is already reached.
+func (l *goLimiter) Go(fn func()) bool {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	l.wg.Add(1)
+	appmetrics.PersistenceGoroutines.Inc()
+	go func() {
+		defer func() {
+			appmetrics.PersistenceGoroutines.Dec()
+			<-l.slots
+			l.wg.Done()
+		}()
+		fn()
+	}()
+	return true
+}
+
+// Wait blocks until every goroutine started by Go has returned, or until
+// ctx is done.
+func (l *goLimiter) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type Handler struct {
-	userService    *services.UserService
-	requestService *services.RequestService
-	rateLimiter    *ratelimit.RateLimiter
-	redisClient    *redis.Client
+	userService     services.UserRepository
+	requestService  services.RequestRepository
+	cache           cache.Cache
+	resumeSigner    *resume.Signer
+	persistLimiter  *goLimiter
+	persistRetries  int
+	dbWriteTimeout  time.Duration
+	deadLetters     *deadletter.Store
+	cacheReader     *cache.BreakerReader
+	writeBreaker    *services.WriteBreaker
+	queuedRequests  bool // SaveRequest only enqueues; the flush is guarded itself
+	wordBanks       services.WordBanks
+	perUserMetrics  bool
+	streamMaxWords  int
+	lengthConfig    services.LengthConfig
+	streamTimeout   time.Duration
+	writeTimeout    time.Duration
+	heartbeat       time.Duration
+	tickEvery       func(time.Duration) (<-chan time.Time, func())
+	statsTTL        time.Duration
+	missingTTL      time.Duration
+	warmUsers       int
+	unlimitedUsers  map[string]bool
+	fastMode        bool
+	delayEnabled    bool
+	autoCreateUsers bool
+	quotaWarnPct    int
+
+	idempotency     *idempotency.Store
+	idempotencyMode string
+
+	streams *streamRegistry
+
+	// Pool wait count at the previous health check
+	lastPoolWaits atomic.Int64
 }
 
 func NewHandler(
-	userService *services.UserService,
-	requestService *services.RequestService,
-	rateLimiter *ratelimit.RateLimiter,
-	redisClient *redis.Client,
+	userService services.UserRepository,
+	requestService services.RequestRepository,
+	c cache.Cache,
+	resumeSigner *resume.Signer,
+	wordBanks services.WordBanks,
+	deadLetters *deadletter.Store,
+	writeBreaker *services.WriteBreaker,
+	cfg *config.Config,
 ) *Handler {
+	unlimitedUsers := make(map[string]bool, len(cfg.UnlimitedUsers))
+	for _, id := range cfg.UnlimitedUsers {
+		unlimitedUsers[id] = true
+	}
+
+	_, queuedRequests := requestService.(*services.BatchingRequestService)
+
 	return &Handler{
-		userService:    userService,
-		requestService: requestService,
-		rateLimiter:    rateLimiter,
-		redisClient:    redisClient,
+		userService:     userService,
+		requestService:  requestService,
+		cache:           c,
+		resumeSigner:    resumeSigner,
+		persistLimiter:  newGoLimiter(cfg.PersistMaxGoroutines),
+		persistRetries:  cfg.PersistRetries,
+		dbWriteTimeout:  cfg.DBWriteTimeout,
+		deadLetters:     deadLetters,
+		cacheReader:     cache.NewBreakerReader(c, cfg.RedisBreakerThreshold, cfg.RedisBreakerCooldown),
+		writeBreaker:    writeBreaker,
+		queuedRequests:  queuedRequests,
+		wordBanks:       wordBanks,
+		perUserMetrics:  cfg.MetricsPerUserWords,
+		streamMaxWords:  cfg.StreamMaxWords,
+		lengthConfig:    services.LengthConfig{Mode: cfg.LengthMode, Min: cfg.LengthMin, Max: cfg.LengthMax},
+		streamTimeout:   cfg.StreamTimeout,
+		writeTimeout:    cfg.StreamWriteTimeout,
+		heartbeat:       cfg.StreamHeartbeatInterval,
+		tickEvery:       newTicker,
+		statsTTL:        cfg.CacheTTL,
+		missingTTL:      cfg.CacheNegativeTTL,
+		warmUsers:       cfg.CacheWarmUsers,
+		unlimitedUsers:  unlimitedUsers,
+		fastMode:        cfg.FastMode,
+		delayEnabled:    cfg.GenerationDelayEnabled,
+		autoCreateUsers: cfg.AutoCreateUsers,
+		quotaWarnPct:    cfg.QuotaWarningPercent,
+
+		idempotency:     idempotency.NewStore(c, cfg.IdempotencyTTL, cfg.StreamTimeout+idempotencyLockGrace),
+		idempotencyMode: cfg.IdempotencyConflictMode,
+
+		streams: newStreamRegistry(),
 	}
 }
 
@@ -44,13 +227,13 @@ func (h *Handler) HealthCheck(c echo.Context) error {
 
 	// Database check
 	dbStatus := "healthy"
-	if _, err := h.userService.GetUserStats(ctx, "healthcheck-probe"); err != nil {
+	if err := h.userService.Ping(ctx); err != nil {
 		dbStatus = "unhealthy"
 	}
 
 	// Redis check
 	redisStatus := "healthy"
-	if err := h.redisClient.Ping(ctx).Err(); err != nil {
+	if err := h.cache.Ping(ctx); err != nil {
 		redisStatus = "unhealthy"
 	}
 
@@ -61,10 +244,60 @@ func (h *Handler) HealthCheck(c echo.Context) error {
 		Redis:     redisStatus,
 	}
 
+	// A full pool with callers still queueing for connections since the
+	// last check is exhaustion, even though queries succeed
+	if stats := h.userService.PoolStats(); stats != nil {
+		response.DBPool = &models.DBPoolStats{
+			MaxOpen:        stats.MaxOpenConnections,
+			Open:           stats.OpenConnections,
+			InUse:          stats.InUse,
+			Idle:           stats.Idle,
+			WaitCount:      stats.WaitCount,
+			WaitDurationMs: stats.WaitDuration.Milliseconds(),
+		}
+		lastWaits := h.lastPoolWaits.Swap(stats.WaitCount)
+		if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections && stats.WaitCount > lastWaits {
+			response.Status = "degraded"
+		}
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
-func (h *Handler) GenerateData(c echo.Context) error {
+// Livez reports that the process is up; it never checks dependencies so a
+// DB or Redis outage doesn't get the pod restarted.
+func (h *Handler) Livez(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// Readyz returns 503 when DB or Redis can't be reached so traffic is shed.
+func (h *Handler) Readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	response := models.HealthResponse{
+		Status:    "ready",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Database:  "healthy",
+		Redis:     "healthy",
+	}
+	code := http.StatusOK
+
+	if err := h.userService.Ping(ctx); err != nil {
+		response.Database = "unhealthy"
+		response.Status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+	if err := h.cache.Ping(ctx); err != nil {
+		response.Redis = "unhealthy"
+		response.Status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+
+	return c.JSON(code, response)
+}
+
+func (h *Handler) GenerateData(c echo.Context) (err error) {
 	ctx := c.Request().Context()
 
 	// Metrics: count + in-flight
@@ -73,143 +306,1043 @@ func (h *Handler) GenerateData(c echo.Context) error {
 	defer appmetrics.ActiveRequests.Dec()
 
 	startWall := time.Now()
-	wordsGenerated := 0
+	var stream *wordStream
 	defer func() {
-		appmetrics.RequestDurationSeconds.Observe(time.Since(startWall).Seconds())
+		appmetrics.RequestDurationSeconds.WithLabelValues(outcomeFor(err)).Observe(time.Since(startWall).Seconds())
+		wordsGenerated := 0
+		if stream != nil {
+			wordsGenerated = stream.generated
+		}
+		if elapsed := time.Since(startWall).Seconds(); wordsGenerated > 0 && elapsed > 0 {
+			appmetrics.WordsPerSecond.Observe(float64(wordsGenerated) / elapsed)
+		}
 		// Add once at the end to avoid hot counters on tight loops
 		appmetrics.WordsGeneratedTotal.Add(float64(wordsGenerated))
+		c.Set(accesslog.WordsGeneratedKey, wordsGenerated)
 	}()
 
 	// Get user ID
-	userID := c.Request().Header.Get("X-User-Id")
-	if userID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "X-User-Id header is required")
-	}
+	userID := userid.FromContext(c.Request().Context())
 
-	// Optional controls
-	stopToken := c.Request().Header.Get("X-Stop-Token")
-	seedStr := c.Request().Header.Get("X-Seed")
-	var streamRand *rand.Rand
-	if seedStr != "" {
-		var seed int64
-		fmt.Sscanf(seedStr, "%d", &seed)
-		streamRand = rand.New(rand.NewSource(seed))
-	} else {
-		streamRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	params, err := h.parseGenerateParams(c)
+	if err != nil {
+		return err
+	}
+	format, err := parseStreamFormat(c)
+	if err != nil {
+		return err
 	}
 
-	maxTokens := -1
-	if maxTokenStr := c.Request().Header.Get("X-Max-Tokens"); maxTokenStr != "" {
-		fmt.Sscanf(maxTokenStr, "%d", &maxTokens)
+	// Resume a previous stream: replay its seed and skip the words already
+	// delivered so only new words are charged. Everything that shapes the
+	// words comes from the token, so it continues the same generation
+	resumeOffset := 0
+	profile := c.Request().Header.Get("X-Profile")
+	maxTokensTotal := params.maxTokensTotal
+	if tokenStr := c.Request().Header.Get(resume.Header); tokenStr != "" {
+		token, err := h.resumeSigner.Decode(userID, tokenStr)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid resume token")
+		}
+		params.seed = token.Seed
+		params.stopToken = token.Stop
+		params.temperature = token.Temperature
+		params.minWordLen = token.MinWordLen
+		params.maxWordLen = token.MaxWordLen
+		profile = token.Profile
+		resumeOffset = token.Offset
+
+		// Max tokens caps the whole generation, so the words already
+		// delivered count against it; a new value replaces the total
+		if !params.maxTokensSet {
+			maxTokensTotal = token.MaxTokens
+		}
+		params.maxTokens = -1
+		if maxTokensTotal != -1 {
+			if maxTokensTotal <= resumeOffset {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("Max tokens must exceed the %d words already delivered", resumeOffset))
+			}
+			params.maxTokens = maxTokensTotal - resumeOffset
+		}
+		params.maxTokens = h.clampMaxTokens(params.maxTokens)
 	}
 
-	// Rate limit
-	if !h.rateLimiter.IsAllowed(userID) {
-		appmetrics.RateLimitDroppedTotal.Inc()
-		return echo.NewHTTPError(http.StatusTooManyRequests, "Rate limit exceeded")
+	// Idempotency: replay a finished result, and let only one request per
+	// key generate (and bill) at a time
+	idemKey := c.Request().Header.Get(idempotency.Header)
+	if idemKey != "" {
+		if result, found, err := h.idempotency.Get(ctx, userID, idemKey); err == nil && found {
+			return c.Blob(http.StatusOK, format.contentType, []byte(format.text(result)))
+		}
+
+		lock, err := h.idempotency.TryLock(ctx, userID, idemKey)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Idempotency store unavailable")
+		}
+		if lock == nil {
+			if h.idempotencyMode == idempotency.ModeReject {
+				return echo.NewHTTPError(http.StatusConflict, "A request with this Idempotency-Key is in progress")
+			}
+			result, found, err := h.idempotency.Wait(ctx, userID, idemKey, idempotencyPollInterval)
+			if err != nil || !found {
+				return echo.NewHTTPError(http.StatusConflict, "The request with this Idempotency-Key did not complete")
+			}
+			return c.Blob(http.StatusOK, format.contentType, []byte(format.text(result)))
+		}
+		defer h.idempotency.Unlock(context.Background(), lock)
 	}
 
-	// Get or create user + quota
-	user, err := h.userService.GetOrCreateUser(ctx, userID)
+	// Look up the user and reserve quota; X-Profile overrides the user's
+	// stored word bank
+	stream, err = h.startStream(ctx, userID, profile, params, resumeOffset)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user")
-	}
-	if user.WordsLeft <= 0 {
-		return echo.NewHTTPError(http.StatusForbidden, "No words left")
+		return err
 	}
 
 	// Streaming response headers
-	c.Response().Header().Set("Content-Type", "text/plain")
+	if stream.quotaLow {
+		c.Response().Header().Set(quotaWarningHeader, "low")
+	}
+	c.Response().Header().Set("Content-Type", format.contentType)
 	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().Header().Set(streamIDHeader, strconv.FormatUint(stream.active.id, 10))
+	c.Response().Header().Set("Trailer", strings.Join([]string{resume.Header, streamEndHeader, wordCountHeader, correlationIDTrailer}, ", "))
 
-	// Stream for up to 1 minute
-	streamCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	// Stream for up to the configured timeout, or until a DELETE for its
+	// stream ID stops it
+	streamCtx, cancel := context.WithTimeout(ctx, h.streamTimeout)
 	defer cancel()
+	defer context.AfterFunc(stream.active.stopped, cancel)()
 
-	var generatedData strings.Builder
+	rc := http.NewResponseController(c.Response())
+	var stopReason string
+
+	// A writer that can't flush (behind a buffering middleware, say) would
+	// hold every word until the end anyway, so generate without pacing and
+	// send the text in one write rather than sleeping for nothing
+	flusher, canFlush := c.Response().Writer.(http.Flusher)
+	if !canFlush {
+		slog.WarnContext(ctx, "Response writer can't flush; sending the stream in one write")
+	}
 
 	for {
 		select {
 		case <-streamCtx.Done():
-			// timeout or client cancel — we still persist what we have
+			// timeout, client cancel or DELETE — we still persist what we have
+			switch {
+			case ctx.Err() != nil:
+				stopReason = "client_cancel"
+			case stream.active.stopped.Err() != nil:
+				stopReason = "client_stop"
+				c.Response().Header().Set(streamEndHeader, "client_stop")
+			default:
+				stopReason = "timeout"
+			}
 			goto end
 		default:
-			// Early stops
-			if (maxTokens != -1 && wordsGenerated >= maxTokens) || wordsGenerated >= user.WordsLeft {
+			word, stopTokenFound, limitReason := stream.next(ctx)
+			if limitReason != "" {
+				stopReason = limitReason
+				if limitReason == "max_words" {
+					c.Response().Header().Set(streamEndHeader, "max_words")
+				}
 				goto end
 			}
 
-			word, stopTokenFound := services.GenerateRandomWords(streamRand, 1, stopToken)
-
-			if _, err := fmt.Fprintf(c.Response().Writer, "%s ", word); err != nil {
-				return err
-			}
-			if flusher, ok := c.Response().Writer.(http.Flusher); ok {
+			if canFlush {
+				// A write that misses its deadline means the client isn't
+				// reading fast enough; any other write error means it went away
+				if h.writeTimeout > 0 {
+					_ = rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+				}
+				if _, err := io.WriteString(c.Response(), format.frame(word)); err != nil {
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						stopReason = "slow_consumer"
+						appmetrics.SlowConsumerStreamsTotal.Inc()
+					} else {
+						stopReason = "client_cancel"
+					}
+					goto end
+				}
+				if stream.generated == 0 {
+					arrived, ok := c.Get(accesslog.StartTimeKey).(time.Time)
+					if !ok {
+						arrived = startWall
+					}
+					appmetrics.TimeToFirstWordSeconds.Observe(time.Since(arrived).Seconds())
+				}
 				flusher.Flush()
 			}
 
-			generatedData.WriteString(word + " ")
-			wordsGenerated++
+			stream.delivered(word)
 
 			if stopTokenFound {
+				stopReason = "completed"
 				goto end
 			}
 
-			// 500–1000ms delay
-			time.Sleep(time.Duration(rand.Intn(500)+500) * time.Millisecond)
+			if canFlush {
+				h.pause(streamCtx, c.Response(), rc, stream.delay(), format.heartbeat)
+			}
 		}
 	}
 
 end:
-	// Persist request with measured duration
-	duration := time.Since(startWall).Seconds()
-	dbCtx, dbCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if !canFlush {
+		_, _ = io.WriteString(c.Response(), format.text(stream.data.String()))
+	}
+	appmetrics.StreamEndedTotal.WithLabelValues(stopReason).Inc()
+
+	// The X-Request-Id header is repeated as a trailer for clients that only
+	// read trailers. It is not a row ID: the row isn't written yet
+	c.Response().Header().Set(wordCountHeader, strconv.Itoa(stream.generated))
+	c.Response().Header().Set(correlationIDTrailer, stream.requestID)
+
+	// Any stream that didn't reach its stop token can be continued: after a
+	// timeout or disconnect, or once max tokens, the server cap or the quota
+	// (after a reset) allow more
+	if stopReason != "completed" {
+		c.Response().Header().Set(resume.Header, h.resumeSigner.Encode(resume.Token{
+			UserID:      userID,
+			Seed:        params.seed,
+			Offset:      resumeOffset + stream.generated,
+			Profile:     stream.profile,
+			Temperature: params.temperature,
+			MinWordLen:  params.minWordLen,
+			MaxWordLen:  params.maxWordLen,
+			Stop:        params.stopToken,
+			MaxTokens:   maxTokensTotal,
+		}))
+	}
+
+	// Store the result before the lock is released so waiters see it. A
+	// stream cut short by a disconnect, slow reader or timeout is partial;
+	// a retry with the same key should generate it again, not replay it
+	if idemKey != "" && !cutShort(stopReason) {
+		if err := h.idempotency.Save(context.Background(), userID, idemKey, stream.data.String()); err != nil {
+			slog.ErrorContext(ctx, "Failed to save idempotent result", "user_id", userID, "error", err)
+		}
+	}
+
+	stream.finish(ctx, startWall)
+
+	return nil
+}
+
+// cutShort reports whether a stream ended before the client got everything
+// it asked for.
+func cutShort(stopReason string) bool {
+	switch stopReason {
+	case "client_cancel", "slow_consumer", "timeout":
+		return true
+	}
+	return false
+}
+
+// PreviewGeneration estimates how many words a request would stream and
+// for how long, without streaming, sleeping, saving or touching quota. The
+// word bank is X-Profile or the default, since the user isn't looked up.
+func (h *Handler) PreviewGeneration(c echo.Context) error {
+	params, err := h.parseGenerateParams(c)
+	if err != nil {
+		return err
+	}
+
+	profile := c.Request().Header.Get("X-Profile")
+	if profile == "" {
+		profile = services.DefaultProfile
+	}
+	bank, ok := h.wordBanks[profile]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown profile")
+	}
+	candidates := bank.Filter(params.minWordLen, params.maxWordLen)
+	if len(candidates) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "No words match the requested length bounds")
+	}
+
+	// Average per-word delay; the stream timeout caps how many words fit
+	delay := 750 * time.Millisecond
+	if !h.delayEnabled {
+		delay = 0
+	} else if params.delayMs >= 0 {
+		delay = time.Duration(params.delayMs) * time.Millisecond
+	}
+	limit := previewMaxWords
+	if params.maxTokens != -1 && params.maxTokens < limit {
+		limit = params.maxTokens
+	}
+	if h.streamMaxWords != -1 && h.streamMaxWords < limit {
+		limit = h.streamMaxWords
+	}
+	if delay > 0 && int(h.streamTimeout/delay)+1 < limit {
+		limit = int(h.streamTimeout/delay) + 1
+	}
+
+	// Replay the seeded sequence to find where the stop token would land
+	rng := rand.New(rand.NewSource(params.seed))
+	source := services.WithTemperature(candidates, params.temperature)
+	stop := services.NewStopMatcher(params.stopToken)
+	words := 0
+	for words < limit {
+		words++
+		if stop.Push(source.Next(rng)) {
+			break
+		}
+	}
+
+	seconds := (time.Duration(words) * delay).Seconds()
+	if seconds > h.streamTimeout.Seconds() {
+		seconds = h.streamTimeout.Seconds()
+	}
+
+	return c.JSON(http.StatusOK, models.PreviewResponse{
+		EstimatedWords:   words,
+		EstimatedSeconds: seconds,
+	})
+}
+
+// persistRequest saves the request log and refunds the unused part of the
+// user's reservation.
+// It runs in the background with a detached copy of the request context, so
+// the request ID and other values survive but client cancellation doesn't.
+func (h *Handler) persistRequest(ctx context.Context, userID, data string, unused int, durationMs int64) {
+	dbCtx, dbCancel := context.WithTimeout(ctx, h.dbWriteTimeout)
 	defer dbCancel()
 
 	dbStart := time.Now()
-	if err := h.requestService.SaveRequest(dbCtx, userID, generatedData.String(), duration); err != nil {
-		// Observe duration even on failure to reveal slow/failing path
-		appmetrics.DBWriteDurationSeconds.Observe(time.Since(dbStart).Seconds())
+	requestID := requestid.FromContext(ctx)
+	var err error
+	if h.queuedRequests {
+		// Only enqueues. The batch flush goes through the write breaker and
+		// dead-letters rows it can't write; counting the enqueue as a
+		// successful write would keep resetting the breaker
+		err = h.requestService.SaveRequest(dbCtx, requestID, userID, data, durationMs)
 	} else {
-		appmetrics.DBWriteDurationSeconds.Observe(time.Since(dbStart).Seconds())
+		err = h.retry(dbCtx, func() error {
+			return h.requestService.SaveRequest(dbCtx, requestID, userID, data, durationMs)
+		})
+	}
+	// Observe duration even on failure to reveal slow/failing path
+	appmetrics.DBWriteDurationSeconds.Observe(time.Since(dbStart).Seconds())
+	if err != nil {
+		h.addDeadLetter(dbCtx, deadletter.Entry{
+			Op:         deadletter.OpSaveRequest,
+			RequestID:  requestID,
+			UserID:     userID,
+			Data:       data,
+			DurationMs: durationMs,
+		}, err)
+	}
+
+	// Refund unused words; invalidate cache (best-effort)
+	if !h.refundUnused(dbCtx, userID, unused) {
+		return
 	}
+	_ = h.cache.Del(dbCtx, cache.Key("user_stats", userID))
+	slog.DebugContext(ctx, "Persisted request", "user_id", userID, "words_refunded", unused, "duration_ms", durationMs)
+}
+
+// shedRequest stands in for persistRequest when the persistence cap is
+// reached. The request log goes straight to the dead-letter store, but the
+// refund is written here on the caller's goroutine: it is the user's quota,
+// and dropping it would charge them for words they never got.
+func (h *Handler) shedRequest(ctx context.Context, userID, data string, unused int, durationMs int64) {
+	dbCtx, dbCancel := context.WithTimeout(ctx, h.dbWriteTimeout)
+	defer dbCancel()
 
-	// Update user's word count; invalidate cache (best-effort)
-	if err := h.userService.UpdateWordsLeft(dbCtx, userID, wordsGenerated); err == nil {
-		_ = h.redisClient.Del(dbCtx, "user_stats:"+userID).Err()
+	h.addDeadLetter(dbCtx, deadletter.Entry{
+		Op:         deadletter.OpSaveRequest,
+		RequestID:  requestid.FromContext(ctx),
+		UserID:     userID,
+		Data:       data,
+		DurationMs: durationMs,
+	}, errPersistenceShed)
+	if h.refundUnused(dbCtx, userID, unused) {
+		_ = h.cache.Del(dbCtx, cache.Key("user_stats", userID))
 	}
+}
 
-	return nil
+// refundUnused returns unused reserved words to userID, dead-lettering the
+// refund if it can't be written. It reports whether the refund was written.
+func (h *Handler) refundUnused(ctx context.Context, userID string, unused int) bool {
+	if unused <= 0 {
+		return true
+	}
+	requestID := requestid.FromContext(ctx)
+	err := h.retry(ctx, func() error {
+		return h.userService.RefundWords(ctx, requestID, userID, unused)
+	})
+	if err != nil {
+		h.addDeadLetter(ctx, deadletter.Entry{
+			Op:        deadletter.OpRefundWords,
+			RequestID: requestID,
+			UserID:    userID,
+			Words:     unused,
+		}, err)
+		return false
+	}
+	return true
 }
 
-func (h *Handler) GetUserStats(c echo.Context) error {
+// clampMaxTokens limits a stream's max tokens (-1 for no limit) to
+// STREAM_MAX_WORDS.
+func (h *Handler) clampMaxTokens(maxTokens int) int {
+	if h.streamMaxWords != -1 && (maxTokens == -1 || maxTokens > h.streamMaxWords) {
+		return h.streamMaxWords
+	}
+	return maxTokens
+}
+
+// reservationSize is how many words to reserve next: a fixed chunk, capped
+// by what X-Max-Tokens and STREAM_MAX_WORDS still allow.
+func (h *Handler) reservationSize(maxTokens, wordsGenerated int) int {
+	n := reservationChunk
+	if maxTokens != -1 && maxTokens-wordsGenerated < n {
+		n = maxTokens - wordsGenerated
+	}
+	if h.streamMaxWords != -1 && h.streamMaxWords-wordsGenerated < n {
+		n = h.streamMaxWords - wordsGenerated
+	}
+	return n
+}
+
+// retry runs the DB write op through the write breaker, up to
+// 1+persistRetries times with exponential backoff. It only retries errors
+// showing the write didn't happen (services.IsRetryableWrite): the writes
+// aren't idempotent, and a timeout or lost connection may have struck after
+// the commit. Those, and an open breaker, fail at once so the caller
+// dead-letters without waiting. The ops don't retry internally, so this is
+// the only retry loop.
+func (h *Handler) retry(ctx context.Context, op func() error) error {
+	backoff := persistRetryBackoff
+	err := h.writeBreaker.Do(op)
+	for attempt := 0; err != nil && attempt < h.persistRetries; attempt++ {
+		if !services.IsRetryableWrite(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = h.writeBreaker.Do(op)
+	}
+	return err
+}
+
+func (h *Handler) addDeadLetter(ctx context.Context, e deadletter.Entry, cause error) {
+	h.deadLetters.Record(ctx, e, cause)
+}
+
+// ReplayDeadLetter re-runs a dead-lettered persistence operation. Replays
+// go through the write breaker, so they are skipped while it is open.
+func (h *Handler) ReplayDeadLetter(ctx context.Context, e deadletter.Entry) error {
+	if e.Op == deadletter.OpSaveRequest && h.queuedRequests {
+		// As in persistRequest, the flush guards the write itself
+		if h.writeBreaker.IsOpen() {
+			return services.ErrWriteBreakerOpen
+		}
+		return h.replay(ctx, e)
+	}
+	return h.writeBreaker.Do(func() error { return h.replay(ctx, e) })
+}
+
+// replay re-runs e. Entries whose error was ambiguous (a timeout or lost
+// connection) may have been written already, so saves are skipped when the
+// request ID is already stored, and refunds rely on RefundWords ignoring
+// request IDs it has refunded before.
+func (h *Handler) replay(ctx context.Context, e deadletter.Entry) error {
+	switch e.Op {
+	case deadletter.OpSaveRequest:
+		if e.RequestID != "" {
+			exists, err := h.requestService.RequestExists(ctx, e.RequestID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return nil
+			}
+		}
+		return h.requestService.SaveRequest(ctx, e.RequestID, e.UserID, e.Data, e.DurationMs)
+	case deadletter.OpUpdateWordsLeft:
+		if err := h.userService.UpdateWordsLeft(ctx, e.UserID, e.Words); err != nil {
+			return err
+		}
+		_ = h.cache.Del(ctx, cache.Key("user_stats", e.UserID))
+		return nil
+	case deadletter.OpRefundWords:
+		if err := h.userService.RefundWords(ctx, e.RequestID, e.UserID, e.Words); err != nil {
+			return err
+		}
+		_ = h.cache.Del(ctx, cache.Key("user_stats", e.UserID))
+		return nil
+	default:
+		return fmt.Errorf("unknown dead letter op %q", e.Op)
+	}
+}
+
+// WaitForPersistence blocks until in-flight persistence goroutines finish,
+// including their cache invalidations, or until ctx is done. Call it before
+// closing the DB and cache connections.
+func (h *Handler) WaitForPersistence(ctx context.Context) error {
+	return h.persistLimiter.Wait(ctx)
+}
+
+// ResetUserQuota restores a user's words_left to total_words.
+func (h *Handler) ResetUserQuota(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := userid.FromContext(c.Request().Context())
+
+	if err := h.userService.ResetQuota(ctx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to reset quota")
+	}
+
+	_ = h.cache.Del(ctx, cache.Key("user_stats", userID))
+
+	return c.JSON(http.StatusOK, map[string]string{"user_id": userID, "status": "reset"})
+}
+
+type chargeRequest struct {
+	Words  int  `json:"words"`
+	Strict bool `json:"strict"`
+}
+
+// ChargeUser deducts words metered outside this service from a user's
+// balance. The balance is floored at 0, or with "strict" a charge larger
+// than the balance is rejected with 402 and nothing is deducted.
+func (h *Handler) ChargeUser(c echo.Context) error {
 	ctx := c.Request().Context()
 
+	userID := userid.FromContext(c.Request().Context())
+	var req chargeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.Words < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "words must be a positive integer")
+	}
+
+	charged, wordsLeft, err := h.userService.ChargeWords(ctx, userID, req.Words, req.Strict)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
+		case errors.Is(err, services.ErrInsufficientWords):
+			return apierror.New(http.StatusPaymentRequired, apierror.CodeInsufficientWords, fmt.Sprintf("Only %d words left", wordsLeft))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to charge words")
+	}
+
+	_ = h.cache.Del(ctx, cache.Key("user_stats", userID))
+
+	return c.JSON(http.StatusOK, map[string]any{"user_id": userID, "words_charged": charged, "words_left": wordsLeft})
+}
+
+// DeleteUser deletes a user with their requests and cached stats, for
+// data-deletion requests.
+func (h *Handler) DeleteUser(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := userid.FromContext(c.Request().Context())
+
+	if err := h.userService.DeleteUser(ctx, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete user")
+	}
+
+	_ = h.cache.Del(ctx, cache.Key("user_stats", userID))
+	_ = h.cache.Del(ctx, cache.Key("user_missing", userID))
+
+	return c.JSON(http.StatusOK, map[string]string{"user_id": userID, "status": "deleted"})
+}
+
+// InvalidateCache drops cached stats so the next read comes from the
+// database, e.g. after a manual DB edit: for the user in X-User-Id, or for
+// every user (and the global stats) with ?all=true. It returns how many
+// keys were deleted.
+func (h *Handler) InvalidateCache(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var deleted int64
+	if c.QueryParam("all") == "true" {
+		for _, prefix := range []string{cache.Key("user_stats", ""), cache.Key("user_missing", ""), cache.Key("global_stats")} {
+			n, err := h.cache.DelPrefix(ctx, prefix)
+			deleted += n
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to invalidate cache")
+			}
+		}
+		return c.JSON(http.StatusOK, map[string]int64{"deleted": deleted})
+	}
+
 	userID := c.Request().Header.Get("X-User-Id")
 	if userID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "X-User-Id header is required")
+		return apierror.New(http.StatusBadRequest, apierror.CodeMissingUserID, "X-User-Id header or all=true is required")
+	}
+	deleted, err := h.cache.DelKeys(ctx, cache.Key("user_stats", userID), cache.Key("user_missing", userID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to invalidate cache")
+	}
+	return c.JSON(http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+// WarmCache loads the most recently active users' stats into the cache,
+// e.g. after a deploy or a Redis flush, so their first reads don't all go
+// to MySQL. ?limit overrides CACHE_WARM_USERS. It returns how many users
+// were cached.
+func (h *Handler) WarmCache(c echo.Context) error {
+	limit := h.warmUsers
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+	}
+
+	warmed, err := h.WarmStatsCache(c.Request().Context(), limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to warm cache")
+	}
+	return c.JSON(http.StatusOK, map[string]int{"warmed": warmed})
+}
+
+// WarmStatsCache caches stats for up to limit users, most recently updated
+// first, and returns how many it cached. It backs WarmCache and the
+// CACHE_WARM_ON_START warm-up.
+func (h *Handler) WarmStatsCache(ctx context.Context, limit int) (int, error) {
+	stats, err := h.userService.RecentUsersStats(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+	for i := range stats {
+		h.cacheUserStats(ctx, &stats[i])
+	}
+	return len(stats), nil
+}
+
+type setProfileRequest struct {
+	Profile string `json:"profile"`
+}
+
+// SetUserProfile stores the default word-bank profile for a user.
+func (h *Handler) SetUserProfile(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := userid.FromContext(c.Request().Context())
+
+	var req setProfileRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if _, ok := h.wordBanks[req.Profile]; !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown profile")
 	}
 
-	// Try Redis cache first
-	cacheKey := "user_stats:" + userID
-	if cached, err := h.redisClient.Get(ctx, cacheKey).Result(); err == nil {
+	if _, err := h.getOrCreateUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := h.userService.SetProfile(ctx, userID, req.Profile); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to set profile")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"user_id": userID, "profile": req.Profile})
+}
+
+func (h *Handler) GetUserStats(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := userid.FromContext(c.Request().Context())
+
+	// Try Redis cache first; the breaker skips it while Redis is failing
+	if cached, err := h.cacheGet(ctx, "user_stats", userID); err == nil {
+		var stats models.UserStats
+		if json.Unmarshal([]byte(cached), &stats) == nil && h.quotaLow(stats.WordsLeft, stats.TotalWords) {
+			c.Response().Header().Set(quotaWarningHeader, "low")
+		}
 		return c.String(http.StatusOK, cached)
 	}
+	// A recent lookup found no such user: spare the DB
+	if _, err := h.cacheGet(ctx, "user_missing", userID); err == nil {
+		return apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
+	}
 
 	// Fallback to DB
 	stats, err := h.userService.GetUserStats(ctx, userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, "User not found")
+		if errors.Is(err, sql.ErrNoRows) {
+			h.cacheUserMissing(ctx, userID)
+			return apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user stats")
 	}
 
-	// Cache for 5 minutes (best-effort)
+	h.observeWordsLeft(userID, stats.WordsLeft)
+	h.cacheUserStats(ctx, stats)
+	if h.quotaLow(stats.WordsLeft, stats.TotalWords) {
+		c.Response().Header().Set(quotaWarningHeader, "low")
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// GlobalStats returns usage aggregated over all users and requests. The
+// queries scan whole tables, so the result is cached for a minute.
+func (h *Handler) GlobalStats(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if cached, err := h.cacheGet(ctx, "global_stats"); err == nil {
+		return c.JSONBlob(http.StatusOK, []byte(cached))
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, globalStatsTimeout)
+	defer cancel()
+
+	var stats models.GlobalStats
+	var err error
+	if stats.TotalUsers, stats.TotalWordsGenerated, err = h.userService.UsageTotals(queryCtx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get global stats")
+	}
+	if stats.TotalRequests, stats.AvgDurationMs, err = h.requestService.RequestTotals(queryCtx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get global stats")
+	}
+
+	if statsJSON, err := json.Marshal(stats); err == nil {
+		_ = h.cache.Set(ctx, cache.Key("global_stats"), string(statsJSON), globalStatsTTL)
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// GetUserStatsBatch returns stats for a JSON array of user IDs, in request
+// order. Cached users are served from the cache and the rest are fetched in
+// one query; users that don't exist are omitted.
+func (h *Handler) GetUserStatsBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var userIDs []string
+	if err := json.NewDecoder(c.Request().Body).Decode(&userIDs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Body must be a JSON array of user IDs")
+	}
+	if len(userIDs) > maxStatsBatch {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("At most %d user IDs per batch", maxStatsBatch))
+	}
+
+	found := make(map[string]models.UserStats, len(userIDs))
+	seen := make(map[string]bool, len(userIDs))
+	var misses []string
+	for _, userID := range userIDs {
+		if seen[userID] || userID == "" {
+			continue
+		}
+		seen[userID] = true
+		var stats models.UserStats
+		if cached, err := h.cacheGet(ctx, "user_stats", userID); err == nil && json.Unmarshal([]byte(cached), &stats) == nil {
+			found[userID] = stats
+			continue
+		}
+		if _, err := h.cacheGet(ctx, "user_missing", userID); err == nil {
+			continue
+		}
+		misses = append(misses, userID)
+	}
+
+	if len(misses) > 0 {
+		fetched, err := h.userService.GetUsersStats(ctx, misses)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user stats")
+		}
+		for i := range fetched {
+			found[fetched[i].UserID] = fetched[i]
+			h.cacheUserStats(ctx, &fetched[i])
+		}
+		for _, userID := range misses {
+			if _, ok := found[userID]; !ok {
+				h.cacheUserMissing(ctx, userID)
+			}
+		}
+	}
+
+	result := make([]models.UserStats, 0, len(found))
+	for _, userID := range userIDs {
+		if stats, ok := found[userID]; ok {
+			result = append(result, stats)
+			delete(found, userID)
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// cacheGet reads the key for name and parts through the breaker and counts
+// the hit or miss against name.
+func (h *Handler) cacheGet(ctx context.Context, name string, parts ...string) (string, error) {
+	value, err := h.cacheReader.Get(ctx, cache.Key(append([]string{name}, parts...)...))
+	if err != nil {
+		appmetrics.CacheMissesTotal.WithLabelValues(name).Inc()
+		return "", err
+	}
+	appmetrics.CacheHitsTotal.WithLabelValues(name).Inc()
+	return value, nil
+}
+
+// cacheUserStats caches stats in the shape GetUserStats serves (best-effort).
+func (h *Handler) cacheUserStats(ctx context.Context, stats *models.UserStats) {
 	statsJSON := fmt.Sprintf(`{"user_id":"%s","words_left":%d,"total_words":%d,"words_used":%d}`,
 		stats.UserID, stats.WordsLeft, stats.TotalWords, stats.TotalWords-stats.WordsLeft)
-	_ = h.redisClient.Set(ctx, cacheKey, statsJSON, 5*time.Minute).Err()
+	_ = h.cache.Set(ctx, cache.Key("user_stats", stats.UserID), statsJSON, h.statsTTL)
+}
 
-	return c.JSON(http.StatusOK, stats)
+// cacheUserMissing remembers briefly that userID doesn't exist, so repeated
+// stats lookups for it skip the DB (best-effort).
+func (h *Handler) cacheUserMissing(ctx context.Context, userID string) {
+	_ = h.cache.Set(ctx, cache.Key("user_missing", userID), "1", h.missingTTL)
+}
+
+// getOrCreateUser looks the user up and, with AUTO_CREATE_USERS, creates
+// them on first use; a created user stops being reported as missing by the
+// negative cache. Otherwise an unknown user is a 404.
+func (h *Handler) getOrCreateUser(ctx context.Context, userID string) (*models.User, error) {
+	user, err := h.userService.GetUser(ctx, userID)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user")
+	}
+	if !h.autoCreateUsers {
+		return nil, apierror.New(http.StatusNotFound, apierror.CodeUserNotFound, "User not found")
+	}
+
+	user, err = h.userService.CreateUser(ctx, userID)
+	if errors.Is(err, services.ErrUserExists) {
+		// A concurrent first request, possibly on another instance, won
+		// the INSERT; use the row it created
+		user, err = h.userService.GetUser(ctx, userID)
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user")
+	}
+	_ = h.cache.Del(ctx, cache.Key("user_missing", userID))
+	return user, nil
+}
+
+// generateRequest is the optional JSON body for GenerateData. Nil fields
+// were not supplied.
+type generateRequest struct {
+	Seed        *int64   `json:"seed"`
+	MaxTokens   *int     `json:"max_tokens"`
+	Stop        *string  `json:"stop"`
+	DelayMs     *int     `json:"delay_ms"`
+	Temperature *float64 `json:"temperature"`
+}
+
+// decodeGenerateRequest parses the request body into req. An empty body is
+// allowed; malformed JSON is a 400.
+func decodeGenerateRequest(c echo.Context, req *generateRequest) error {
+	if c.Request().Body == nil {
+		return nil
+	}
+	err := json.NewDecoder(c.Request().Body).Decode(req)
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON body")
+}
+
+// generateParams are the optional stream controls shared by GenerateData
+// and PreviewGeneration.
+type generateParams struct {
+	stopToken  string
+	seed       int64
+	delayMs    int // -1 keeps the default 500–1000ms jitter
+	minWordLen int
+	maxWordLen int
+	maxTokens  int // -1 for no limit; at most STREAM_MAX_WORDS
+
+	// The client sent max tokens, rather than the default length applying
+	maxTokensSet bool
+
+	// maxTokens before the STREAM_MAX_WORDS clamp. It is the whole
+	// generation's budget that resume tokens carry, so a stream the server
+	// cap cut short can still be continued
+	maxTokensTotal int
+
+	// 0–1; below 1 recent words repeat more often (see WithTemperature)
+	temperature float64
+}
+
+// pause waits out the delay before the next word, writing heartbeat (the
+// format's filler whitespace) every heartbeat interval so idle-sensitive
+// proxies don't close the stream. Heartbeats aren't words: they're neither
+// charged nor stored. It returns early once ctx is done; a failed heartbeat
+// is left for the next word's write to report.
+func (h *Handler) pause(ctx context.Context, w io.Writer, rc *http.ResponseController, delay time.Duration, heartbeat string) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var ticks <-chan time.Time
+	if h.heartbeat > 0 && delay > h.heartbeat {
+		var stop func()
+		ticks, stop = h.tickEvery(h.heartbeat)
+		defer stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case <-ticks:
+			if h.writeTimeout > 0 {
+				_ = rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			}
+			if _, err := io.WriteString(w, heartbeat); err == nil {
+				_ = rc.Flush()
+			}
+		}
+	}
+}
+
+// newTicker is the heartbeat clock; tests swap in one they drive by hand.
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// parseGenerateParams reads the stream controls from headers or a JSON body;
+// headers win when both are present.
+func (h *Handler) parseGenerateParams(c echo.Context) (generateParams, error) {
+	var body generateRequest
+	if err := decodeGenerateRequest(c, &body); err != nil {
+		return generateParams{}, err
+	}
+
+	p := generateParams{
+		stopToken: c.Request().Header.Get("X-Stop-Token"),
+		seed:      time.Now().UnixNano(),
+		delayMs:   -1,
+		maxTokens: -1,
+
+		temperature: 1,
+	}
+	if p.stopToken == "" && body.Stop != nil {
+		p.stopToken = *body.Stop
+	}
+	var err error
+	if seedStr := c.Request().Header.Get("X-Seed"); seedStr != "" {
+		if p.seed, err = strconv.ParseInt(seedStr, 10, 64); err != nil {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "X-Seed must be a 64-bit integer")
+		}
+	} else if body.Seed != nil {
+		p.seed = *body.Seed
+	}
+
+	if delayStr := c.Request().Header.Get("X-Delay-Ms"); delayStr != "" {
+		if p.delayMs, err = strconv.Atoi(delayStr); err != nil || p.delayMs < 0 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "X-Delay-Ms must be a non-negative integer")
+		}
+	} else if body.DelayMs != nil {
+		if p.delayMs = *body.DelayMs; p.delayMs < 0 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "delay_ms must be non-negative")
+		}
+	}
+
+	if tempStr := c.Request().Header.Get("X-Temperature"); tempStr != "" {
+		if p.temperature, err = strconv.ParseFloat(tempStr, 64); err != nil || p.temperature < 0 || p.temperature > 1 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "X-Temperature must be a number between 0 and 1")
+		}
+	} else if body.Temperature != nil {
+		if p.temperature = *body.Temperature; p.temperature < 0 || p.temperature > 1 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "temperature must be between 0 and 1")
+		}
+	}
+
+	// No pause at all between words, so load tests measure the server rather
+	// than sleeping goroutines; only honored with FAST_MODE
+	if c.Request().Header.Get("X-No-Delay") == "true" {
+		if !h.fastMode {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "X-No-Delay requires FAST_MODE")
+		}
+		p.delayMs = 0
+	}
+
+	// Optional word-length bounds, applied once to the candidate list
+	if p.minWordLen, err = parseNonNegativeHeader(c, "X-Min-Word-Len"); err != nil {
+		return generateParams{}, err
+	}
+	if p.maxWordLen, err = parseNonNegativeHeader(c, "X-Max-Word-Len"); err != nil {
+		return generateParams{}, err
+	}
+
+	if maxTokenStr := c.Request().Header.Get("X-Max-Tokens"); maxTokenStr != "" {
+		if p.maxTokens, err = strconv.Atoi(maxTokenStr); err != nil || p.maxTokens < 1 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "X-Max-Tokens must be a positive integer")
+		}
+		p.maxTokensSet = true
+	} else if body.MaxTokens != nil {
+		if p.maxTokens = *body.MaxTokens; p.maxTokens < 1 {
+			return generateParams{}, echo.NewHTTPError(http.StatusBadRequest, "max_tokens must be positive")
+		}
+		p.maxTokensSet = true
+	} else {
+		// Default length, drawn from the seed so seeded streams and their
+		// previews agree
+		p.maxTokens = services.GenerationLength(rand.New(rand.NewSource(p.seed)), h.lengthConfig)
+	}
+	p.maxTokensTotal = p.maxTokens
+	p.maxTokens = h.clampMaxTokens(p.maxTokens)
+	return p, nil
+}
+
+// parseNonNegativeHeader reads an optional integer header, returning 0 when
+// it is absent and a 400 when it is malformed or negative.
+func parseNonNegativeHeader(c echo.Context, name string) (int, error) {
+	value := c.Request().Header.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// quotaLow reports whether wordsLeft is below QUOTA_WARNING_PERCENT of
+// totalWords.
+func (h *Handler) quotaLow(wordsLeft, totalWords int) bool {
+	return wordsLeft*100 < totalWords*h.quotaWarnPct
+}
+
+// observeWordsLeft updates the per-user gauge when it is enabled.
+func (h *Handler) observeWordsLeft(userID string, wordsLeft int) {
+	if h.perUserMetrics {
+		appmetrics.UserWordsRemaining.WithLabelValues(userID).Set(float64(wordsLeft))
+	}
+}
+
+// outcomeFor maps a handler result to the request_duration_seconds label.
+func outcomeFor(err error) string {
+	if err == nil {
+		return "streamed"
+	}
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.Code {
+		case http.StatusBadRequest:
+			return "bad_request"
+		case http.StatusForbidden:
+			return "no_words"
+		}
+	}
+	return "error"
 }
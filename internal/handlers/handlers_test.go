@@ -0,0 +1,2581 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
+
+	"manifold-test/internal/apierror"
+	"manifold-test/internal/cache"
+	"manifold-test/internal/config"
+	"manifold-test/internal/deadletter"
+	"manifold-test/internal/idempotency"
+	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/middleware/accesslog"
+	"manifold-test/internal/middleware/ratelimit"
+	"manifold-test/internal/middleware/requestid"
+	"manifold-test/internal/middleware/userid"
+	"manifold-test/internal/models"
+	"manifold-test/internal/resume"
+	"manifold-test/internal/services"
+)
+
+// savedRequest is one SaveRequest call seen by recordingRequests.
+type savedRequest struct {
+	userID     string
+	data       string
+	durationMs int64
+}
+
+// recordingRequests is an in-memory RequestRepository that also reports
+// each save on a channel, since requests are persisted in the background.
+type recordingRequests struct {
+	*services.MemoryRequestRepository
+	saved chan savedRequest
+}
+
+func (r *recordingRequests) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	err := r.MemoryRequestRepository.SaveRequest(ctx, requestID, userID, data, durationMs)
+	r.saved <- savedRequest{userID: userID, data: data, durationMs: durationMs}
+	return err
+}
+
+// newTestHandler builds a Handler on in-memory storage with the default
+// configuration, adjusted by configure.
+func newTestHandler(t *testing.T, requests services.RequestRepository, configure func(*config.Config)) *Handler {
+	t.Helper()
+	t.Setenv("STORAGE", config.StorageMemory)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	words, err := services.LoadWordSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, err := deadletter.NewStore(filepath.Join(t.TempDir(), "dead_letter.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(
+		services.NewMemoryUserRepository(cfg.DefaultQuota),
+		requests,
+		cache.NewMemoryCache(),
+		resume.NewSigner([]byte("test secret")),
+		services.NewWordBanks(words),
+		deadLetters,
+		services.NewWriteBreaker(cfg.DBBreakerThreshold, cfg.DBBreakerCooldown),
+		cfg,
+	)
+}
+
+func TestGenerateDataSavesMeasuredDuration(t *testing.T) {
+	requests := &recordingRequests{
+		MemoryRequestRepository: services.NewMemoryRequestRepository(),
+		saved:                   make(chan savedRequest, 1),
+	}
+	h := newTestHandler(t, requests, nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	req := httptest.NewRequest(http.MethodPost, "/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "4")
+	req.Header.Set("X-Delay-Ms", "50")
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	e.ServeHTTP(rec, req)
+	elapsedMs := time.Since(start).Milliseconds()
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	select {
+	case saved := <-requests.saved:
+		// The handler's clock starts after the test's and stops before it,
+		// so the stored duration is at most what the test measured
+		if saved.durationMs > elapsedMs || saved.durationMs < elapsedMs-50 {
+			t.Fatalf("stored duration %dms, measured %dms", saved.durationMs, elapsedMs)
+		}
+		if saved.userID != "alice" || saved.data != rec.Body.String() {
+			t.Fatalf("saved %+v for body %q", saved, rec.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was never saved")
+	}
+}
+
+// generate runs POST /generate-data for alice, unless headers name another
+// user, returning the recorder once the stream has ended.
+func generate(t *testing.T, e *echo.Echo, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Delay-Ms", "0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGenerateDataResumeContinuesGeneration(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	original := map[string]string{
+		"X-Seed":         "42",
+		"X-Temperature":  "0.5",
+		"X-Min-Word-Len": "4",
+		"X-Stop-Token":   "never-generated",
+	}
+	withMax := func(n string) map[string]string {
+		headers := map[string]string{"X-Max-Tokens": n}
+		for name, value := range original {
+			headers[name] = value
+		}
+		return headers
+	}
+
+	full := generate(t, e, withMax("10"))
+	first := generate(t, e, withMax("4"))
+	if full.Code != http.StatusOK || first.Code != http.StatusOK {
+		t.Fatalf("status = %d, %d", full.Code, first.Code)
+	}
+	if words := strings.Fields(full.Body.String()); len(words) != 10 {
+		t.Fatalf("full stream has %d words, want 10", len(words))
+	}
+	token := first.Result().Trailer.Get(resume.Header)
+	if token == "" {
+		t.Fatal("stream cut by max tokens has no resume token")
+	}
+
+	// The token, not the resuming request, decides how words are generated;
+	// X-Max-Tokens raises the total to the full stream's length
+	rest := generate(t, e, map[string]string{
+		resume.Header:    token,
+		"X-Max-Tokens":   "10",
+		"X-Temperature":  "1",
+		"X-Min-Word-Len": "0",
+	})
+	if rest.Code != http.StatusOK {
+		t.Fatalf("resume status = %d, body %q", rest.Code, rest.Body.String())
+	}
+	if got := first.Body.String() + rest.Body.String(); got != full.Body.String() {
+		t.Fatalf("first + resumed = %q, want %q", got, full.Body.String())
+	}
+
+	// Without a new X-Max-Tokens the original total of 4 is already reached
+	again := generate(t, e, map[string]string{resume.Header: token})
+	if again.Code != http.StatusBadRequest {
+		t.Fatalf("resume past max tokens: status = %d, body %q", again.Code, again.Body.String())
+	}
+}
+
+func TestGenerateDataResumeTokenOnlyWhenCutShort(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 5
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	cut := generate(t, e, map[string]string{"X-Seed": "42", "X-Max-Tokens": "3"})
+	words := strings.Fields(cut.Body.String())
+	if cut.Code != http.StatusOK || len(words) != 3 {
+		t.Fatalf("status %d, body %q", cut.Code, cut.Body.String())
+	}
+	if cut.Result().Trailer.Get(resume.Header) == "" {
+		t.Fatal("stream cut by max tokens has no resume token")
+	}
+
+	// The same sequence, stopped by its own third word, is complete
+	done := generate(t, e, map[string]string{userid.Header: "bob", "X-Seed": "42", "X-Max-Tokens": "10", "X-Stop-Token": words[2]})
+	if done.Code != http.StatusOK || done.Body.String() != cut.Body.String() {
+		t.Fatalf("status %d, body %q; want %q", done.Code, done.Body.String(), cut.Body.String())
+	}
+	if token := done.Result().Trailer.Get(resume.Header); token != "" {
+		t.Fatal("stream that reached its stop token has a resume token")
+	}
+
+	// Alice has 2 of her 5 words left, so this is cut short by the quota
+	quota := generate(t, e, map[string]string{"X-Seed": "7", "X-Max-Tokens": "10"})
+	if quota.Code != http.StatusOK || len(strings.Fields(quota.Body.String())) != 2 {
+		t.Fatalf("status %d, body %q; want 2 words", quota.Code, quota.Body.String())
+	}
+	if quota.Result().Trailer.Get(resume.Header) == "" {
+		t.Fatal("stream cut by the quota has no resume token")
+	}
+}
+
+// stopAfterThree runs a 3-word stream with seed 42 for bob and returns its
+// body and last word. Alice's stream with that seed and the word as
+// X-Stop-Token stops after the same 3 words, leaving most of her
+// reservation to refund.
+func stopAfterThree(t *testing.T, h *Handler, e *echo.Echo) (string, string) {
+	t.Helper()
+	probe := generate(t, e, map[string]string{userid.Header: "bob", "X-Seed": "42", "X-Max-Tokens": "3"})
+	words := strings.Fields(probe.Body.String())
+	if probe.Code != http.StatusOK || len(words) != 3 {
+		t.Fatalf("status %d, body %q", probe.Code, probe.Body.String())
+	}
+	if err := h.WaitForPersistence(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return probe.Body.String(), words[2]
+}
+
+func TestGenerateDataRefundsWhenPersistenceShed(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.PersistMaxGoroutines = 1
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	probe, stop := stopAfterThree(t, h, e)
+	release := make(chan struct{})
+	defer close(release)
+	if !h.persistLimiter.Go(func() { <-release }) {
+		t.Fatal("persistence slot already taken")
+	}
+
+	shedBefore := testutil.ToFloat64(appmetrics.PersistenceShedTotal)
+	rec := generate(t, e, map[string]string{"X-Seed": "42", "X-Stop-Token": stop})
+	if rec.Code != http.StatusOK || rec.Body.String() != probe {
+		t.Fatalf("status %d, body %q; want %q", rec.Code, rec.Body.String(), probe)
+	}
+	if shed := testutil.ToFloat64(appmetrics.PersistenceShedTotal) - shedBefore; shed != 1 {
+		t.Fatalf("persistence_shed_total grew by %v, want 1", shed)
+	}
+
+	user, err := h.userService.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := user.TotalWords - 3; user.WordsLeft != want {
+		t.Fatalf("words_left = %d, want %d", user.WordsLeft, want)
+	}
+
+	var shed []deadletter.Entry
+	_, err = h.deadLetters.Reprocess(context.Background(), func(_ context.Context, e deadletter.Entry) error {
+		shed = append(shed, e)
+		return errors.New("kept for inspection")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shed) != 1 || shed[0].Op != deadletter.OpSaveRequest || shed[0].UserID != "alice" || shed[0].Data != rec.Body.String() {
+		t.Fatalf("dead letters = %+v, want alice's request log", shed)
+	}
+}
+
+// Failure modes for flakyRequests and flakyUsers
+const (
+	writeOK        int32 = iota
+	writeFails           // nothing is written
+	writeAmbiguous       // the write commits, then the connection drops
+)
+
+var errConnectionLost = errors.New("invalid connection")
+
+type flakyRequests struct {
+	*services.MemoryRequestRepository
+	mode atomic.Int32
+}
+
+func (r *flakyRequests) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	switch r.mode.Load() {
+	case writeFails:
+		return errConnectionLost
+	case writeAmbiguous:
+		_ = r.MemoryRequestRepository.SaveRequest(ctx, requestID, userID, data, durationMs)
+		return errConnectionLost
+	}
+	return r.MemoryRequestRepository.SaveRequest(ctx, requestID, userID, data, durationMs)
+}
+
+type flakyUsers struct {
+	services.UserRepository
+	mode atomic.Int32
+}
+
+func (r *flakyUsers) RefundWords(ctx context.Context, requestID, userID string, words int) error {
+	switch r.mode.Load() {
+	case writeFails:
+		return errConnectionLost
+	case writeAmbiguous:
+		_ = r.UserRepository.RefundWords(ctx, requestID, userID, words)
+		return errConnectionLost
+	}
+	return r.UserRepository.RefundWords(ctx, requestID, userID, words)
+}
+
+func TestDeadLetterReplayIsIdempotent(t *testing.T) {
+	requests := &flakyRequests{MemoryRequestRepository: services.NewMemoryRequestRepository()}
+	h := newTestHandler(t, requests, func(cfg *config.Config) {
+		cfg.DBBreakerThreshold = 100
+	})
+	users := &flakyUsers{UserRepository: h.userService}
+	h.userService = users
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, requestid.Middleware(), userid.Middleware())
+	_, stop := stopAfterThree(t, h, e)
+
+	// The save fails outright; the refund commits but reports a lost
+	// connection. Both are dead-lettered
+	requests.mode.Store(writeFails)
+	users.mode.Store(writeAmbiguous)
+	rec := generate(t, e, map[string]string{"X-Seed": "42", "X-Stop-Token": stop})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if err := h.WaitForPersistence(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// While the database stays down the entries are kept
+	users.mode.Store(writeFails)
+	replayed, err := h.deadLetters.Reprocess(context.Background(), h.ReplayDeadLetter)
+	if err != nil || replayed != 0 {
+		t.Fatalf("replayed %d, err %v while failing; want 0", replayed, err)
+	}
+
+	requests.mode.Store(writeOK)
+	users.mode.Store(writeOK)
+	replayed, err = h.deadLetters.Reprocess(context.Background(), h.ReplayDeadLetter)
+	if err != nil || replayed != 2 {
+		t.Fatalf("replayed %d, err %v; want the save and the refund", replayed, err)
+	}
+
+	// A save that had committed after all is skipped too
+	saved, err := requests.ListRequests(context.Background(), "alice", 0, 10)
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("alice has %d requests saved, err %v; want 1", len(saved), err)
+	}
+	err = h.deadLetters.Add(deadletter.Entry{
+		Op:        deadletter.OpSaveRequest,
+		RequestID: saved[0].RequestID,
+		UserID:    "alice",
+		Data:      saved[0].Data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err = h.deadLetters.Reprocess(context.Background(), h.ReplayDeadLetter)
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d, err %v; want the duplicate save", replayed, err)
+	}
+
+	// The replays found the writes already applied
+	user, err := h.userService.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := user.TotalWords - 3; user.WordsLeft != want {
+		t.Fatalf("words_left = %d, want %d", user.WordsLeft, want)
+	}
+	saved, err = requests.ListRequests(context.Background(), "alice", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("alice has %d requests saved, want 1", len(saved))
+	}
+}
+
+func TestGenerateRoutesShareRateLimit(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	generateLimited := ratelimit.NewRateLimiter(100, nil).RateLimitFor("generate", 2)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware(), generateLimited)
+	e.POST("/generate", h.GenerateText, userid.Middleware(), generateLimited)
+
+	status := func(path string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(userid.Header, "alice")
+		req.Header.Set("X-Max-Tokens", "1")
+		req.Header.Set("X-Delay-Ms", "0")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := status("/generate-data"); code != http.StatusOK {
+		t.Fatalf("/generate-data status = %d", code)
+	}
+	if code := status("/generate"); code != http.StatusOK {
+		t.Fatalf("/generate status = %d", code)
+	}
+	for _, path := range []string{"/generate-data", "/generate"} {
+		if code := status(path); code != http.StatusTooManyRequests {
+			t.Fatalf("%s after the shared budget of 2: status = %d, want 429", path, code)
+		}
+	}
+}
+
+func TestWebSocketSharesGenerateRateLimit(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	generateLimited := ratelimit.NewRateLimiter(100, nil).RateLimitFor("generate", 2)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware(), generateLimited)
+	e.POST("/generate-data/preview", h.PreviewGeneration, userid.Middleware(), generateLimited)
+	e.GET("/generate-data/ws", h.GenerateDataWS, userid.Middleware(), generateLimited)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	dial := func() (*websocket.Conn, error) {
+		cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/generate-data/ws", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Header.Set(userid.Header, "alice")
+		cfg.Header.Set("X-Max-Tokens", "2")
+		cfg.Header.Set("X-Delay-Ms", "0")
+		return websocket.DialConfig(cfg)
+	}
+
+	ws, err := dial()
+	if err != nil {
+		t.Fatalf("first WebSocket: %v", err)
+	}
+	var words []string
+	for {
+		var word string
+		if err := websocket.Message.Receive(ws, &word); err != nil {
+			break
+		}
+		words = append(words, word)
+	}
+	ws.Close()
+	if len(words) != 2 {
+		t.Fatalf("received %v, want 2 words", words)
+	}
+
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "1"}); rec.Code != http.StatusOK {
+		t.Fatalf("/generate-data status = %d", rec.Code)
+	}
+
+	// The WebSocket and the POST spent alice's budget of 2
+	var dialErr *websocket.DialError
+	if _, err := dial(); !errors.As(err, &dialErr) || dialErr.Err != websocket.ErrBadStatus {
+		t.Fatalf("WebSocket past the shared budget: %v, want a refused handshake", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/generate-data/preview", nil)
+	req.Header.Set(userid.Header, "alice")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("/generate-data/preview status = %d, want 429", rec.Code)
+	}
+}
+
+// cancelStream sends DELETE /generate-data/:id for alice.
+func cancelStream(t *testing.T, srv *httptest.Server, id string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/generate-data/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(userid.Header, "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("DELETE stream %s: status = %d, want 202", id, resp.StatusCode)
+	}
+}
+
+func TestCancelStreamStopsGenerateAndWebSocket(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate", h.GenerateText, userid.Middleware())
+	e.GET("/generate-data/ws", h.GenerateDataWS, userid.Middleware())
+	e.DELETE("/generate-data/:id", h.CancelStream, userid.Middleware())
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	t.Run("generate", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/generate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(userid.Header, "alice")
+		req.Header.Set("X-Max-Tokens", "100")
+		req.Header.Set("X-Delay-Ms", "20")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		id := resp.Header.Get(streamIDHeader)
+		if id == "" {
+			t.Fatal("no X-Stream-Id before the body")
+		}
+
+		cancelStream(t, srv, id)
+		var body models.GenerateResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.StopReason != "client_stop" || body.Words >= 100 || body.Partial {
+			t.Fatalf("response %+v, want client_stop before 100 words", body)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/generate-data/ws", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Header.Set(userid.Header, "alice")
+		cfg.Header.Set("X-Max-Tokens", "100")
+		cfg.Header.Set("X-Delay-Ms", "20")
+		before := testutil.ToFloat64(appmetrics.StreamEndedTotal.WithLabelValues("client_stop"))
+		ws, err := websocket.DialConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		// The client can't read handshake headers, so find the ID here
+		var word string
+		if err := websocket.Message.Receive(ws, &word); err != nil {
+			t.Fatal(err)
+		}
+		streams := h.streams.snapshot()
+		if len(streams) != 1 {
+			t.Fatalf("%d streams running, want 1", len(streams))
+		}
+		cancelStream(t, srv, strconv.FormatUint(streams[0].StreamID, 10))
+
+		words := 1
+		for websocket.Message.Receive(ws, &word) == nil {
+			words++
+		}
+		if words >= 100 {
+			t.Fatal("the WebSocket stream ran to X-Max-Tokens")
+		}
+		if got := testutil.ToFloat64(appmetrics.StreamEndedTotal.WithLabelValues("client_stop")) - before; got != 1 {
+			t.Fatalf("client_stop endings rose by %v, want 1", got)
+		}
+	})
+}
+
+// stalledUsers lets the first reservation through and holds later ones
+// until their context ends, like a database that stops answering.
+type stalledUsers struct {
+	services.UserRepository
+	reservations atomic.Int32
+}
+
+func (r *stalledUsers) ReserveWords(ctx context.Context, userID string, want int) (int, error) {
+	if r.reservations.Add(1) > 1 {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return r.UserRepository.ReserveWords(ctx, userID, want)
+}
+
+func TestGenerateTextTimeoutIsPartial(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.StreamTimeout = 200 * time.Millisecond
+	})
+	h.userService = &stalledUsers{UserRepository: h.userService}
+	e := echo.New()
+	e.POST("/generate", h.GenerateText, userid.Middleware())
+
+	// The first chunk streams at once; the timeout strikes while the
+	// second reservation waits
+	req := httptest.NewRequest(http.MethodPost, "/generate", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "500")
+	req.Header.Set("X-Delay-Ms", "0")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var body models.GenerateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status %d, body %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	if body.StopReason != "timeout" || !body.Partial {
+		t.Fatalf("stop_reason %q, partial %v; want a partial timeout", body.StopReason, body.Partial)
+	}
+	if body.Words != reservationChunk {
+		t.Fatalf("%d words, want the first reservation of %d", body.Words, reservationChunk)
+	}
+}
+
+func TestRequestHistory(t *testing.T) {
+	requests := services.NewMemoryRequestRepository()
+	h := newTestHandler(t, requests, nil)
+	e := echo.New()
+	e.GET("/user/history", h.RequestHistory, userid.Middleware())
+	for i := 0; i < 3; i++ {
+		if err := requests.SaveRequest(context.Background(), "req", "alice", "words ", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/user/history?"+query, nil)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("limit=2&from=2000-01-01T00:00:00Z")
+	var page models.RequestPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if len(page.Requests) != 2 || page.Total != 3 || !page.HasMore || page.Limit != 2 || page.Offset != 0 {
+		t.Fatalf("page %+v, want 2 of 3 with more", page)
+	}
+
+	for _, query := range []string{
+		"from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z",
+		"from=yesterday",
+		"limit=0",
+		"limit=501",
+		"offset=-1",
+		"offset=x",
+	} {
+		if rec := get(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestGenerateDataConcurrentIdempotencyKeyGeneratesOnce(t *testing.T) {
+	requests := &recordingRequests{
+		MemoryRequestRepository: services.NewMemoryRequestRepository(),
+		saved:                   make(chan savedRequest, 2),
+	}
+	var quota int
+	h := newTestHandler(t, requests, func(cfg *config.Config) { quota = cfg.DefaultQuota })
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	headers := map[string]string{idempotency.Header: "k1", "X-Max-Tokens": "5", "X-Delay-Ms": "20"}
+	recs := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = generate(t, e, headers)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+		}
+	}
+	if recs[0].Body.String() != recs[1].Body.String() {
+		t.Fatalf("bodies differ: %q vs %q", recs[0].Body.String(), recs[1].Body.String())
+	}
+
+	select {
+	case <-requests.saved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was never saved")
+	}
+	select {
+	case saved := <-requests.saved:
+		t.Fatalf("second generation saved %q", saved.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	user, err := h.userService.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := quota - user.WordsLeft; used != 5 {
+		t.Fatalf("charged %d words, want 5", used)
+	}
+}
+
+func TestGenerateDataDoesNotReplayCutShortStream(t *testing.T) {
+	requests := &recordingRequests{
+		MemoryRequestRepository: services.NewMemoryRequestRepository(),
+		saved:                   make(chan savedRequest, 2),
+	}
+	h := newTestHandler(t, requests, func(cfg *config.Config) {
+		cfg.StreamTimeout = 50 * time.Millisecond
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	headers := map[string]string{idempotency.Header: "k1", "X-Delay-Ms": "20"}
+	for i := 0; i < 2; i++ {
+		rec := generate(t, e, headers)
+		if rec.Result().Trailer.Get(resume.Header) == "" {
+			t.Fatalf("call %d: no resume token, want a timed-out stream", i)
+		}
+		select {
+		case <-requests.saved:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("call %d was replayed instead of generated", i)
+		}
+	}
+}
+
+func TestGenerateDataStopsAtServerWordCap(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.StreamMaxWords = 3
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	rec := generate(t, e, nil)
+	if words := strings.Fields(rec.Body.String()); len(words) != 3 {
+		t.Fatalf("streamed %d words %q, want 3", len(words), rec.Body.String())
+	}
+	trailer := rec.Result().Trailer
+	if trailer.Get(streamEndHeader) != "max_words" || trailer.Get(wordCountHeader) != "3" {
+		t.Fatalf("trailers %v, want max_words after 3 words", trailer)
+	}
+
+	// The cap applies however much quota is left
+	user, err := h.userService.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.WordsLeft < 1000 {
+		t.Fatalf("alice has %d words left; the cap should bind first", user.WordsLeft)
+	}
+}
+
+func TestGenerateDataTrailers(t *testing.T) {
+	requests := &recordingRequests{
+		MemoryRequestRepository: services.NewMemoryRequestRepository(),
+		saved:                   make(chan savedRequest, 1),
+	}
+	h := newTestHandler(t, requests, nil)
+	e := echo.New()
+	e.Use(requestid.Middleware())
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set(requestid.Header, "req-807")
+	req.Header.Set("X-Max-Tokens", "7")
+	req.Header.Set("X-Delay-Ms", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Trailers are only filled in once the body has been read to the end
+	words := strings.Fields(string(body))
+	if got := resp.Trailer.Get(wordCountHeader); got != strconv.Itoa(len(words)) {
+		t.Fatalf("%s = %q for %d words", wordCountHeader, got, len(words))
+	}
+	if got := resp.Trailer.Get(correlationIDTrailer); got != "req-807" {
+		t.Fatalf("%s = %q, want req-807", correlationIDTrailer, got)
+	}
+
+	// The requests row is stored under the same ID
+	select {
+	case <-requests.saved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was never saved")
+	}
+	if ok, err := requests.RequestExists(context.Background(), "req-807"); err != nil || !ok {
+		t.Fatalf("RequestExists(req-807) = %v, %v", ok, err)
+	}
+}
+
+func TestGenerateDataRejectsMalformedMaxTokens(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	for _, value := range []string{"abc", "1.5", "0", "-5", "99999999999999999999"} {
+		if rec := generate(t, e, map[string]string{"X-Max-Tokens": value}); rec.Code != http.StatusBadRequest {
+			t.Errorf("X-Max-Tokens %q: status = %d, want 400", value, rec.Code)
+		}
+	}
+}
+
+func TestGenerateDataClampsMaxTokensToServerCap(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.StreamMaxWords = 3
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	first := generate(t, e, map[string]string{"X-Seed": "42", "X-Max-Tokens": "999999999"})
+	if words := strings.Fields(first.Body.String()); len(words) != 3 {
+		t.Fatalf("streamed %d words, want the cap of 3", len(words))
+	}
+	if end := first.Result().Trailer.Get(streamEndHeader); end != "max_words" {
+		t.Fatalf("%s = %q, want max_words", streamEndHeader, end)
+	}
+
+	// The resume token keeps the requested total, so the next stream
+	// continues past the cap rather than being refused
+	token := first.Result().Trailer.Get(resume.Header)
+	rest := generate(t, e, map[string]string{resume.Header: token})
+	if rest.Code != http.StatusOK || len(strings.Fields(rest.Body.String())) != 3 {
+		t.Fatalf("resume status = %d, body %q", rest.Code, rest.Body.String())
+	}
+}
+
+// downUsers is a UserRepository whose database can't be reached.
+type downUsers struct{ services.UserRepository }
+
+func (downUsers) Ping(ctx context.Context) error { return errConnectionLost }
+
+// downCache is a cache whose Redis can't be reached.
+type downCache struct{ cache.Cache }
+
+func (downCache) Ping(ctx context.Context) error { return errConnectionLost }
+
+func TestLivezAndReadyz(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.GET("/livez", h.Livez)
+	e.GET("/readyz", h.Readyz)
+
+	get := func(path string) (int, models.HealthResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var body models.HealthResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK || body.Status != "ready" {
+		t.Fatalf("healthy /readyz = %d %+v", code, body)
+	}
+
+	users, redis := h.userService, h.cache
+	h.userService = downUsers{users}
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body.Database != "unhealthy" || body.Redis != "healthy" {
+		t.Fatalf("/readyz with the database down = %d %+v", code, body)
+	}
+	h.userService, h.cache = users, downCache{redis}
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body.Redis != "unhealthy" || body.Database != "healthy" {
+		t.Fatalf("/readyz with Redis down = %d %+v", code, body)
+	}
+
+	// Liveness ignores dependencies
+	h.userService = downUsers{users}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Fatalf("/livez with dependencies down = %d, want 200", code)
+	}
+}
+
+func TestGoLimiterShedsAtCap(t *testing.T) {
+	l := newGoLimiter(2)
+	running := testutil.ToFloat64(appmetrics.PersistenceGoroutines)
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		if !l.Go(func() { <-release }) {
+			t.Fatalf("job %d was shed below the cap", i)
+		}
+	}
+
+	ran := false
+	if l.Go(func() { ran = true }) {
+		t.Fatal("a third job started past the cap of 2")
+	}
+	if got := testutil.ToFloat64(appmetrics.PersistenceGoroutines) - running; got != 2 {
+		t.Fatalf("persistence_goroutines = %v above the baseline, want 2", got)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Fatal("the shed job ran")
+	}
+	if !l.Go(func() {}) {
+		t.Fatal("slots weren't freed once the jobs finished")
+	}
+}
+
+func TestGenerateDataWordLengthBounds(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	rec := generate(t, e, map[string]string{"X-Min-Word-Len": "5", "X-Max-Word-Len": "7", "X-Max-Tokens": "50"})
+	words := strings.Fields(rec.Body.String())
+	if rec.Code != http.StatusOK || len(words) != 50 {
+		t.Fatalf("status = %d, %d words", rec.Code, len(words))
+	}
+	for _, word := range words {
+		if len(word) < 5 || len(word) > 7 {
+			t.Fatalf("word %q is outside [5, 7]", word)
+		}
+	}
+
+	for _, headers := range []map[string]string{
+		{"X-Min-Word-Len": "100"},
+		{"X-Min-Word-Len": "8", "X-Max-Word-Len": "4"},
+		{"X-Min-Word-Len": "-1"},
+		{"X-Max-Word-Len": "long"},
+	} {
+		if rec := generate(t, e, headers); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want 400", headers, rec.Code)
+		}
+	}
+}
+
+func TestGenerateDataUsesStoredProfile(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.PUT("/user/profile", h.SetUserProfile, userid.Middleware())
+
+	setProfile := func(profile string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/user/profile", strings.NewReader(`{"profile":"`+profile+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	fromBank := func(body, profile string) bool {
+		bank := map[string]bool{}
+		for _, word := range h.wordBanks[profile] {
+			bank[word] = true
+		}
+		for _, word := range strings.Fields(body) {
+			if !bank[word] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if code := setProfile("klingon"); code != http.StatusBadRequest {
+		t.Fatalf("unknown profile: status = %d, want 400", code)
+	}
+	if code := setProfile("technical"); code != http.StatusOK {
+		t.Fatalf("set profile: status = %d", code)
+	}
+
+	// No X-Profile: the stored profile applies
+	rec := generate(t, e, map[string]string{"X-Max-Tokens": "20"})
+	if rec.Code != http.StatusOK || !fromBank(rec.Body.String(), "technical") {
+		t.Fatalf("status %d, body %q; want technical words", rec.Code, rec.Body.String())
+	}
+	// X-Profile overrides it for one request
+	rec = generate(t, e, map[string]string{"X-Max-Tokens": "20", "X-Profile": "es"})
+	if rec.Code != http.StatusOK || !fromBank(rec.Body.String(), "es") {
+		t.Fatalf("status %d, body %q; want Spanish words", rec.Code, rec.Body.String())
+	}
+}
+
+// failingWriter accepts ok writes, then fails every write with err. It
+// supports the flushing and write deadlines the stream loop relies on.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	ok  int
+	err error
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.ok == 0 {
+		return 0, w.err
+	}
+	w.ok--
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *failingWriter) SetWriteDeadline(time.Time) error { return nil }
+
+func TestGenerateDataWriteTimeoutVsDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		stopReason string
+		slow       float64
+	}{
+		{"write deadline", os.ErrDeadlineExceeded, "slow_consumer", 1},
+		{"disconnect", syscall.EPIPE, "client_cancel", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := &recordingRequests{
+				MemoryRequestRepository: services.NewMemoryRequestRepository(),
+				saved:                   make(chan savedRequest, 1),
+			}
+			h := newTestHandler(t, requests, nil)
+			e := echo.New()
+			e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+			slow := testutil.ToFloat64(appmetrics.SlowConsumerStreamsTotal)
+			ended := testutil.ToFloat64(appmetrics.StreamEndedTotal.WithLabelValues(tt.stopReason))
+
+			req := httptest.NewRequest(http.MethodPost, "/generate-data", nil)
+			req.Header.Set(userid.Header, "alice")
+			req.Header.Set("X-Delay-Ms", "0")
+			req.Header.Set("X-Max-Tokens", "10")
+			w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), ok: 3, err: tt.err}
+			e.ServeHTTP(w, req)
+
+			if got := testutil.ToFloat64(appmetrics.SlowConsumerStreamsTotal) - slow; got != tt.slow {
+				t.Fatalf("slow_consumer_streams_total grew by %v, want %v", got, tt.slow)
+			}
+			if got := testutil.ToFloat64(appmetrics.StreamEndedTotal.WithLabelValues(tt.stopReason)) - ended; got != 1 {
+				t.Fatalf("stream_ended_total{reason=%q} grew by %v, want 1", tt.stopReason, got)
+			}
+
+			// The words that did get through are still persisted
+			select {
+			case saved := <-requests.saved:
+				if saved.data != w.Body.String() || len(strings.Fields(saved.data)) != 3 {
+					t.Fatalf("saved %q, sent %q", saved.data, w.Body.String())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("partial stream was never saved")
+			}
+		})
+	}
+}
+
+func TestStreamEndedReasons(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.StreamTimeout = 100 * time.Millisecond
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	ended := func(reason string) float64 {
+		return testutil.ToFloat64(appmetrics.StreamEndedTotal.WithLabelValues(reason))
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		cancel  time.Duration // hang up after this long; 0 to stay
+		reason  string
+	}{
+		{"client hangs up", map[string]string{"X-Delay-Ms": "20", "X-Max-Tokens": "1000"}, 30 * time.Millisecond, "client_cancel"},
+		{"server timeout", map[string]string{"X-Delay-Ms": "20", "X-Max-Tokens": "1000"}, 0, "timeout"},
+		{"max tokens", map[string]string{"X-Max-Tokens": "2"}, 0, "max_tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := ended(tt.reason)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/generate-data", nil).WithContext(ctx)
+			req.Header.Set(userid.Header, "alice")
+			req.Header.Set("X-Delay-Ms", "0")
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			e.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := ended(tt.reason) - before; got != 1 {
+				t.Fatalf("stream_ended_total{reason=%q} grew by %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestGenerateDataStreamTimeoutPersistsPartial(t *testing.T) {
+	requests := &recordingRequests{
+		MemoryRequestRepository: services.NewMemoryRequestRepository(),
+		saved:                   make(chan savedRequest, 1),
+	}
+	h := newTestHandler(t, requests, func(cfg *config.Config) {
+		cfg.StreamTimeout = 200 * time.Millisecond
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	start := time.Now()
+	rec := generate(t, e, map[string]string{"X-Delay-Ms": "30", "X-Max-Tokens": "1000"})
+	elapsed := time.Since(start)
+
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("stream took %s, want about the 200ms timeout", elapsed)
+	}
+	select {
+	case saved := <-requests.saved:
+		if saved.data == "" || saved.data != rec.Body.String() {
+			t.Fatalf("saved %q, streamed %q", saved.data, rec.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed-out stream was never saved")
+	}
+}
+
+func TestGenerateDataBodyAndHeaderPrecedence(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	post := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/generate-data", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(userid.Header, "alice")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	headerOnly := generate(t, e, map[string]string{"X-Seed": "42", "X-Max-Tokens": "5"})
+	bodyOnly := post(`{"seed":42,"max_tokens":5,"delay_ms":0}`, nil)
+	if bodyOnly.Code != http.StatusOK || bodyOnly.Body.String() != headerOnly.Body.String() {
+		t.Fatalf("body-only = %d %q, header-only %q", bodyOnly.Code, bodyOnly.Body.String(), headerOnly.Body.String())
+	}
+
+	// Headers win over the body field by field
+	both := post(`{"seed":7,"max_tokens":50,"delay_ms":0}`, map[string]string{"X-Seed": "42", "X-Max-Tokens": "3"})
+	if want := strings.Join(strings.Fields(headerOnly.Body.String())[:3], " ") + " "; both.Body.String() != want {
+		t.Fatalf("both = %q, want the header seed and max tokens: %q", both.Body.String(), want)
+	}
+
+	if rec := post(`{"seed":`, map[string]string{"X-Delay-Ms": "0"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("malformed JSON: status = %d, want 400", rec.Code)
+	}
+	if rec := post(``, map[string]string{"X-Delay-Ms": "0", "X-Max-Tokens": "1"}); rec.Code != http.StatusOK {
+		t.Fatalf("empty body: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestGenerateDataCountsQuotaExhausted(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 2
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	exhausted := testutil.ToFloat64(appmetrics.QuotaExhaustedTotal)
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "2"}); rec.Code != http.StatusOK {
+		t.Fatalf("first stream: status = %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(appmetrics.QuotaExhaustedTotal) - exhausted; got != 0 {
+		t.Fatalf("quota_exhausted_total grew by %v with words left", got)
+	}
+
+	if rec := generate(t, e, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("out of words: status = %d, want 403", rec.Code)
+	}
+	if got := testutil.ToFloat64(appmetrics.QuotaExhaustedTotal) - exhausted; got != 1 {
+		t.Fatalf("quota_exhausted_total grew by %v, want 1", got)
+	}
+}
+
+func TestGenerateDataStreamsOverH2C(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	srv := httptest.NewServer(h2c.NewHandler(e, &http2.Server{}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "3")
+	req.Header.Set("X-Delay-Ms", "100")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("protocol %s, want HTTP/2", resp.Proto)
+	}
+
+	// The first word arrives well before the stream's 3 paced words are done
+	start := time.Now()
+	buf := make([]byte, 64)
+	if _, err := resp.Body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 150*time.Millisecond {
+		t.Fatalf("first word took %s; the response was buffered", waited)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Trailer.Get(wordCountHeader); got != "3" {
+		t.Fatalf("%s trailer = %q over HTTP/2, want 3", wordCountHeader, got)
+	}
+}
+
+func TestPreviewGenerationHasNoSideEffects(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.POST("/generate-data/preview", h.PreviewGeneration, userid.Middleware())
+
+	_, stop := stopAfterThree(t, h, e)
+	before, err := h.userService.GetUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _, _ := h.requestService.RequestTotals(context.Background())
+
+	preview := func() models.PreviewResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/generate-data/preview", nil)
+		req.Header.Set(userid.Header, "bob")
+		req.Header.Set("X-Seed", "42")
+		req.Header.Set("X-Stop-Token", stop)
+		req.Header.Set("X-Delay-Ms", "100")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var body models.PreviewResponse
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+			t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+		}
+		return body
+	}
+
+	first, second := preview(), preview()
+	if first != second || first.EstimatedWords != 3 || first.EstimatedSeconds != 0.3 {
+		t.Fatalf("previews %+v and %+v, want 3 words in 0.3s both times", first, second)
+	}
+
+	after, err := h.userService.GetUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.WordsLeft != before.WordsLeft {
+		t.Fatalf("words_left %d -> %d after a preview", before.WordsLeft, after.WordsLeft)
+	}
+	if total, _, _ := h.requestService.RequestTotals(context.Background()); total != stored {
+		t.Fatalf("%d requests stored after previews, want %d", total, stored)
+	}
+}
+
+// statsDownUsers fails every stats lookup.
+type statsDownUsers struct{ services.UserRepository }
+
+func (statsDownUsers) GetUserStats(ctx context.Context, userID string) (*models.UserStats, error) {
+	return nil, errConnectionLost
+}
+
+func TestErrorCodes(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 2
+	})
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.Handler
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.GET("/user/stats", h.GetUserStats, userid.Middleware())
+	e.POST("/user/charge", h.ChargeUser, userid.Middleware())
+	e.POST("/limited", h.GenerateData, ratelimit.NewRateLimiter(100, nil).RateLimitFor("limited", 0), userid.Middleware())
+
+	request := func(method, path, user, body string, headers map[string]string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.Header.Set(userid.Header, user)
+		}
+		req.Header.Set("X-Delay-Ms", "0")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var envelope struct {
+			Error apierror.Error `json:"error"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &envelope)
+		return rec.Code, envelope.Error.Code
+	}
+
+	// alice spends her 2 words; carol has never been seen
+	if code, _ := request(http.MethodPost, "/generate-data", "alice", "", map[string]string{"X-Max-Tokens": "2"}); code != http.StatusOK {
+		t.Fatalf("setup stream: status = %d", code)
+	}
+	if code, _ := request(http.MethodPost, "/generate-data", "bob", "", map[string]string{"X-Max-Tokens": "1"}); code != http.StatusOK {
+		t.Fatalf("setup stream: status = %d", code)
+	}
+
+	tests := []struct {
+		name, method, path, user, body string
+		headers                        map[string]string
+		status                         int
+		code                           string
+	}{
+		{"missing user", http.MethodPost, "/generate-data", "", "", nil, http.StatusBadRequest, apierror.CodeMissingUserID},
+		{"invalid user", http.MethodPost, "/generate-data", "a b", "", nil, http.StatusBadRequest, apierror.CodeInvalidUserID},
+		{"malformed header", http.MethodPost, "/generate-data", "bob", "", map[string]string{"X-Max-Tokens": "abc"}, http.StatusBadRequest, apierror.CodeBadRequest},
+		{"no words left", http.MethodPost, "/generate-data", "alice", "", nil, http.StatusForbidden, apierror.CodeNoWordsLeft},
+		{"rate limited", http.MethodPost, "/limited", "bob", "", nil, http.StatusTooManyRequests, apierror.CodeRateLimited},
+		{"unknown user", http.MethodGet, "/user/stats", "carol", "", nil, http.StatusNotFound, apierror.CodeUserNotFound},
+		{"insufficient words", http.MethodPost, "/user/charge", "bob", `{"words":5,"strict":true}`, nil, http.StatusPaymentRequired, apierror.CodeInsufficientWords},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code := request(tt.method, tt.path, tt.user, tt.body, tt.headers)
+			if status != tt.status || code != tt.code {
+				t.Fatalf("got %d %s, want %d %s", status, code, tt.status, tt.code)
+			}
+		})
+	}
+
+	t.Run("internal", func(t *testing.T) {
+		users := h.userService
+		h.userService = statsDownUsers{users}
+		defer func() { h.userService = users }()
+		if status, code := request(http.MethodGet, "/user/stats", "bob", "", nil); status != http.StatusInternalServerError || code != apierror.CodeInternal {
+			t.Fatalf("got %d %s, want 500 %s", status, code, apierror.CodeInternal)
+		}
+	})
+}
+
+// countingUsers counts batch stats lookups that reach the repository.
+type countingUsers struct {
+	services.UserRepository
+	batches atomic.Int32
+}
+
+func (u *countingUsers) GetUsersStats(ctx context.Context, userIDs []string) ([]models.UserStats, error) {
+	u.batches.Add(1)
+	return u.UserRepository.GetUsersStats(ctx, userIDs)
+}
+
+func TestGetUserStatsBatch(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	users := &countingUsers{UserRepository: h.userService}
+	h.userService = users
+	ctx := context.Background()
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := users.CreateUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := echo.New()
+	e.POST("/user/stats/batch", h.GetUserStatsBatch)
+
+	batch := func(body string) (int, []models.UserStats) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/user/stats/batch", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var stats []models.UserStats
+		json.Unmarshal(rec.Body.Bytes(), &stats)
+		return rec.Code, stats
+	}
+
+	// Request order, duplicates once, missing users left out
+	for i := 0; i < 2; i++ {
+		code, stats := batch(`["bob","ghost","alice","bob"]`)
+		if code != http.StatusOK || len(stats) != 2 || stats[0].UserID != "bob" || stats[1].UserID != "alice" {
+			t.Fatalf("run %d: %d %+v, want bob then alice", i, code, stats)
+		}
+	}
+	// The second run is served from the stats and missing-user caches
+	if got := users.batches.Load(); got != 1 {
+		t.Fatalf("repository queried %d times, want 1", got)
+	}
+
+	tooMany := make([]string, maxStatsBatch+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user-%d", i)
+	}
+	body, _ := json.Marshal(tooMany)
+	for _, bad := range []string{`{"user_id":"alice"}`, string(body)} {
+		if code, _ := batch(bad); code != http.StatusBadRequest {
+			t.Errorf("body %.40q: status = %d, want 400", bad, code)
+		}
+	}
+}
+
+func TestGetUserStatsCacheTTLs(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.CacheTTL = 50 * time.Millisecond
+		cfg.CacheNegativeTTL = 50 * time.Millisecond
+	})
+	e := echo.New()
+	e.GET("/user/stats", h.GetUserStats, userid.Middleware())
+	ctx := context.Background()
+
+	stats := func() (int, models.UserStats) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var s models.UserStats
+		json.Unmarshal(rec.Body.Bytes(), &s)
+		return rec.Code, s
+	}
+
+	// The miss is remembered until CACHE_NEGATIVE_TTL passes
+	if code, _ := stats(); code != http.StatusNotFound {
+		t.Fatalf("unknown user: status = %d, want 404", code)
+	}
+	if _, err := h.userService.CreateUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := stats(); code != http.StatusNotFound {
+		t.Fatalf("within the negative TTL: status = %d, want the cached 404", code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	code, first := stats()
+	if code != http.StatusOK {
+		t.Fatalf("after the negative TTL: status = %d, want 200", code)
+	}
+
+	// Stats are served from the cache until CACHE_TTL passes
+	if _, _, err := h.userService.ChargeWords(ctx, "alice", 3, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, cached := stats(); cached.WordsLeft != first.WordsLeft {
+		t.Fatalf("within the TTL: words_left = %d, want the cached %d", cached.WordsLeft, first.WordsLeft)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, fresh := stats(); fresh.WordsLeft != first.WordsLeft-3 {
+		t.Fatalf("after the TTL: words_left = %d, want %d", fresh.WordsLeft, first.WordsLeft-3)
+	}
+}
+
+// blockedRequests holds every save until release is closed.
+type blockedRequests struct {
+	*services.MemoryRequestRepository
+	release chan struct{}
+}
+
+func (r *blockedRequests) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	<-r.release
+	return r.MemoryRequestRepository.SaveRequest(ctx, requestID, userID, data, durationMs)
+}
+
+func TestWaitForPersistenceIsBounded(t *testing.T) {
+	requests := &blockedRequests{services.NewMemoryRequestRepository(), make(chan struct{})}
+	h := newTestHandler(t, requests, nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "3"}); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	// A stuck save doesn't hold shutdown past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := h.WaitForPersistence(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitForPersistence with a stuck save = %v, want deadline exceeded", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("waited %s past a 50ms deadline", waited)
+	}
+
+	// One that finishes in time is waited for
+	close(requests.release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.WaitForPersistence(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := requests.RequestTotals(context.Background()); n != 1 {
+		t.Fatalf("%d requests saved after the wait, want 1", n)
+	}
+}
+
+func TestUnlimitedUsersSkipQuota(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 2
+		cfg.UnlimitedUsers = []string{"loadtest"}
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	// Well past the quota, twice, without being charged
+	for i := 0; i < 2; i++ {
+		rec := generate(t, e, map[string]string{userid.Header: "loadtest", "X-Max-Tokens": "5"})
+		if rec.Code != http.StatusOK || rec.Header().Get(wordCountHeader) != "5" {
+			t.Fatalf("run %d: status = %d, %s = %q; want 200 and 5 words", i, rec.Code, wordCountHeader, rec.Header().Get(wordCountHeader))
+		}
+	}
+	if user, err := h.userService.GetUser(context.Background(), "loadtest"); err != nil || user.WordsLeft != 2 {
+		t.Fatalf("loadtest user = %+v, %v; want the quota untouched", user, err)
+	}
+
+	// Everyone else is still held to it
+	generate(t, e, map[string]string{"X-Max-Tokens": "2"})
+	if rec := generate(t, e, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice past her quota: status = %d, want 403", rec.Code)
+	}
+}
+
+func TestNoDelayRequiresFastMode(t *testing.T) {
+	headers := map[string]string{"X-Max-Tokens": "5", "X-Delay-Ms": "200", "X-No-Delay": "true"}
+
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	if rec := generate(t, e, headers); rec.Code != http.StatusBadRequest {
+		t.Fatalf("X-No-Delay without FAST_MODE: status = %d, want 400", rec.Code)
+	}
+
+	h = newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.FastMode = true
+	})
+	e = echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	start := time.Now()
+	rec := generate(t, e, headers)
+	// Five words at 200ms each would take a second
+	if elapsed := time.Since(start); rec.Code != http.StatusOK || elapsed > 500*time.Millisecond {
+		t.Fatalf("X-No-Delay with FAST_MODE: status = %d after %s, want 200 without the pauses", rec.Code, elapsed)
+	}
+	if got := rec.Header().Get(wordCountHeader); got != "5" {
+		t.Fatalf("%s = %q, want 5", wordCountHeader, got)
+	}
+}
+
+func TestQuotaWarningHeader(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 100
+		cfg.QuotaWarningPercent = 10
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.GET("/user/stats", h.GetUserStats, userid.Middleware())
+
+	// The warning reflects the balance when the stream starts
+	for _, step := range []struct {
+		tokens string
+		want   string
+	}{
+		{"85", ""},   // 100 left
+		{"10", ""},   // 15 left
+		{"1", "low"}, // 5 left
+	} {
+		rec := generate(t, e, map[string]string{"X-Max-Tokens": step.tokens})
+		if got := rec.Header().Get(quotaWarningHeader); got != step.want {
+			t.Fatalf("stream of %s: %s = %q, want %q", step.tokens, quotaWarningHeader, got, step.want)
+		}
+	}
+
+	// Both the DB lookup and the cached one warn
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if got := rec.Header().Get(quotaWarningHeader); got != "low" {
+			t.Fatalf("stats lookup %d: %s = %q, want low", i, quotaWarningHeader, got)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.Handler
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.GET("/user/stats", h.GetUserStats, userid.Middleware())
+	e.DELETE("/user", h.DeleteUser, userid.Middleware())
+
+	request := func(method, path string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	generate(t, e, map[string]string{"X-Max-Tokens": "3"})
+	if code := request(http.MethodGet, "/user/stats"); code != http.StatusOK {
+		t.Fatalf("stats before delete: status = %d", code)
+	}
+	if code := request(http.MethodDelete, "/user"); code != http.StatusOK {
+		t.Fatalf("delete: status = %d, want 200", code)
+	}
+	// The cached stats go with the user
+	if code := request(http.MethodGet, "/user/stats"); code != http.StatusNotFound {
+		t.Fatalf("stats after delete: status = %d, want 404", code)
+	}
+	if code := request(http.MethodDelete, "/user"); code != http.StatusNotFound {
+		t.Fatalf("second delete: status = %d, want 404", code)
+	}
+}
+
+// unflushableWriter is a bare http.ResponseWriter that counts writes and
+// can't flush, like one behind a buffering middleware.
+type unflushableWriter struct {
+	header http.Header
+	body   strings.Builder
+	code   int
+	writes int
+}
+
+func (w *unflushableWriter) Header() http.Header  { return w.header }
+func (w *unflushableWriter) WriteHeader(code int) { w.code = code }
+
+func (w *unflushableWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.body.Write(b)
+}
+
+func TestGenerateDataWithoutFlusherWritesOnce(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	req := httptest.NewRequest(http.MethodPost, "/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "5")
+	req.Header.Set("X-Delay-Ms", "200")
+	w := &unflushableWriter{header: http.Header{}}
+
+	start := time.Now()
+	e.ServeHTTP(w, req)
+	// Pacing is skipped: five words at 200ms each would take a second
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("stream took %s, want no pauses without a flusher", elapsed)
+	}
+	if w.code != http.StatusOK || w.writes != 1 {
+		t.Fatalf("status = %d after %d writes, want 200 in one write", w.code, w.writes)
+	}
+	if words := strings.Fields(w.body.String()); len(words) != 5 {
+		t.Fatalf("body %q has %d words, want 5", w.body.String(), len(words))
+	}
+}
+
+func TestGlobalStats(t *testing.T) {
+	requests := services.NewMemoryRequestRepository()
+	h := newTestHandler(t, requests, func(cfg *config.Config) {
+		cfg.DefaultQuota = 10
+	})
+	e := echo.New()
+	e.GET("/stats/global", h.GlobalStats)
+	ctx := context.Background()
+	for id, used := range map[string]int{"alice": 3, "bob": 2} {
+		h.userService.CreateUser(ctx, id)
+		h.userService.ChargeWords(ctx, id, used, false)
+	}
+	requests.SaveRequest(ctx, "req-1", "alice", "a b c ", 100)
+	requests.SaveRequest(ctx, "req-2", "bob", "d e ", 300)
+
+	global := func() models.GlobalStats {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats/global", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d", rec.Code)
+		}
+		var stats models.GlobalStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	want := models.GlobalStats{TotalUsers: 2, TotalRequests: 2, TotalWordsGenerated: 5, AvgDurationMs: 200}
+	if got := global(); got != want {
+		t.Fatalf("global stats = %+v, want %+v", got, want)
+	}
+	// The scans are cached, so a new request doesn't show up yet
+	requests.SaveRequest(ctx, "req-3", "alice", "f ", 600)
+	if got := global(); got != want {
+		t.Fatalf("cached global stats = %+v, want %+v", got, want)
+	}
+}
+
+// saveContext is what contextRequests saw of a save's context.
+type saveContext struct {
+	err       error
+	deadline  time.Time
+	requestID string
+}
+
+// contextRequests records the context each save runs with, as it was
+// during the save.
+type contextRequests struct {
+	*services.MemoryRequestRepository
+	saved chan saveContext
+}
+
+func (r *contextRequests) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	deadline, _ := ctx.Deadline()
+	r.saved <- saveContext{ctx.Err(), deadline, requestid.FromContext(ctx)}
+	return r.MemoryRequestRepository.SaveRequest(ctx, requestID, userID, data, durationMs)
+}
+
+func TestPersistenceOutlivesClientCancel(t *testing.T) {
+	requests := &contextRequests{services.NewMemoryRequestRepository(), make(chan saveContext, 1)}
+	h := newTestHandler(t, requests, func(cfg *config.Config) {
+		cfg.DBWriteTimeout = 7 * time.Second
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	ctx, cancel := context.WithCancel(requestid.WithID(context.Background(), "req-1"))
+	req := httptest.NewRequest(http.MethodPost, "/generate-data", nil).WithContext(ctx)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "50")
+	req.Header.Set("X-Delay-Ms", "10")
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case saved := <-requests.saved:
+		if saved.err != nil {
+			t.Fatalf("save ran with a done context: %v", saved.err)
+		}
+		if saved.deadline.Before(start.Add(6*time.Second)) || saved.deadline.After(time.Now().Add(7*time.Second)) {
+			t.Fatalf("save deadline %v, want DB_WRITE_TIMEOUT (7s) from the end of the stream", saved.deadline)
+		}
+		if saved.requestID != "req-1" {
+			t.Fatalf("save lost the request ID: %q", saved.requestID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled stream was never saved")
+	}
+}
+
+func TestGenerateTextMatchesStream(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 20
+	})
+	e := echo.New()
+	e.Use(requestid.Middleware())
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.POST("/generate", h.GenerateText, userid.Middleware())
+	headers := map[string]string{"X-Seed": "7", "X-Max-Tokens": "6"}
+
+	streamed := generate(t, e, headers)
+
+	req := httptest.NewRequest(http.MethodPost, "/generate", nil)
+	req.Header.Set(userid.Header, "bob")
+	req.Header.Set("X-Delay-Ms", "0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		t.Fatalf("status = %d, content type %q; want JSON", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	var body models.GenerateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := models.GenerateResponse{
+		Text:       strings.TrimSpace(streamed.Body.String()),
+		Words:      6,
+		RequestID:  rec.Header().Get(requestid.Header),
+		StopReason: "max_tokens",
+	}
+	if body != want {
+		t.Fatalf("body = %+v, want %+v", body, want)
+	}
+
+	// Both routes charge the quota the same
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.WaitForPersistence(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if user, err := h.userService.GetUser(ctx, id); err != nil || user.WordsLeft != 14 {
+			t.Fatalf("%s = %+v, %v; want 14 words left", id, user, err)
+		}
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/admin/cache/invalidate", h.InvalidateCache)
+	ctx := context.Background()
+
+	seed := func() {
+		for _, id := range []string{"alice", "bob"} {
+			h.cache.Set(ctx, cache.Key("user_stats", id), "{}", time.Minute)
+		}
+		h.cache.Set(ctx, cache.Key("user_missing", "ghost"), "1", time.Minute)
+		h.cache.Set(ctx, cache.Key("global_stats"), "{}", time.Minute)
+	}
+	invalidate := func(query, user string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/cache/invalidate"+query, nil)
+		if user != "" {
+			req.Header.Set(userid.Header, user)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	cached := func(parts ...string) bool {
+		ok, _ := h.cache.Exists(ctx, cache.Key(parts...))
+		return ok
+	}
+
+	seed()
+	if code, body := invalidate("", "alice"); code != http.StatusOK || body != `{"deleted":1}` {
+		t.Fatalf("one user: %d %s, want 200 {\"deleted\":1}", code, body)
+	}
+	if cached("user_stats", "alice") || !cached("user_stats", "bob") {
+		t.Fatal("invalidating alice should leave only bob's stats")
+	}
+
+	seed()
+	if code, body := invalidate("?all=true", ""); code != http.StatusOK || body != `{"deleted":4}` {
+		t.Fatalf("all: %d %s, want 200 {\"deleted\":4}", code, body)
+	}
+	if cached("user_stats", "bob") || cached("user_missing", "ghost") || cached("global_stats") {
+		t.Fatal("all=true left stats cached")
+	}
+
+	if code, _ := invalidate("", ""); code != http.StatusBadRequest {
+		t.Fatalf("no user and no all: status = %d, want 400", code)
+	}
+}
+
+// scriptedUsers fails GetUser with each of getErrs in turn before passing
+// lookups through, and counts the calls it sees.
+type scriptedUsers struct {
+	services.UserRepository
+	mu      sync.Mutex
+	getErrs []error
+	gets    int
+	creates int
+}
+
+func (u *scriptedUsers) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	u.mu.Lock()
+	u.gets++
+	var err error
+	if len(u.getErrs) > 0 {
+		err, u.getErrs = u.getErrs[0], u.getErrs[1:]
+	}
+	u.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return u.UserRepository.GetUser(ctx, userID)
+}
+
+func (u *scriptedUsers) CreateUser(ctx context.Context, userID string) (*models.User, error) {
+	u.mu.Lock()
+	u.creates++
+	u.mu.Unlock()
+	return u.UserRepository.CreateUser(ctx, userID)
+}
+
+func TestGetOrCreateUserMatchesWrappedNoRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		creates int
+	}{
+		{"wrapped no rows", fmt.Errorf("failed to get user: %w", sql.ErrNoRows), http.StatusOK, 1},
+		{"other error", fmt.Errorf("failed to get user: %w", errConnectionLost), http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+			users := &scriptedUsers{UserRepository: h.userService, getErrs: []error{tt.err}}
+			h.userService = users
+			e := echo.New()
+			e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+			if rec := generate(t, e, map[string]string{"X-Max-Tokens": "2"}); rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if users.creates != tt.creates {
+				t.Fatalf("CreateUser called %d times, want %d", users.creates, tt.creates)
+			}
+		})
+	}
+}
+
+func TestAutoCreateUsersOff(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.AutoCreateUsers = false
+	})
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.Handler
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	rec := generate(t, e, map[string]string{"X-Max-Tokens": "2"})
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), apierror.CodeUserNotFound) {
+		t.Fatalf("unknown user: %d %s, want 404 %s", rec.Code, rec.Body.String(), apierror.CodeUserNotFound)
+	}
+	if _, err := h.userService.GetUser(context.Background(), "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("alice was created: err = %v", err)
+	}
+
+	// Users created out of band are served as usual
+	if _, err := h.userService.CreateUser(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "2"}); rec.Code != http.StatusOK {
+		t.Fatalf("existing user: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestChargeUser(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 10
+	})
+	e := echo.New()
+	e.POST("/user/charge", h.ChargeUser, userid.Middleware())
+	ctx := context.Background()
+	h.userService.CreateUser(ctx, "alice")
+	h.cache.Set(ctx, cache.Key("user_stats", "alice"), "{}", time.Minute)
+
+	charge := func(body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/user/charge", strings.NewReader(body))
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"words":4}`, http.StatusOK, `{"user_id":"alice","words_charged":4,"words_left":6}`},
+		// Strict refuses and charges nothing
+		{`{"words":7,"strict":true}`, http.StatusPaymentRequired, ""},
+		// Otherwise the balance floors at 0
+		{`{"words":7}`, http.StatusOK, `{"user_id":"alice","words_charged":6,"words_left":0}`},
+		{`{"words":0}`, http.StatusBadRequest, ""},
+		{`words=1`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		code, body := charge(tt.body)
+		if code != tt.status || (tt.want != "" && body != tt.want) {
+			t.Fatalf("charge %s: %d %s, want %d %s", tt.body, code, body, tt.status, tt.want)
+		}
+	}
+	if ok, _ := h.cache.Exists(ctx, cache.Key("user_stats", "alice")); ok {
+		t.Fatal("cached stats survived a charge")
+	}
+}
+
+// poolUsers reports stats as its connection pool.
+type poolUsers struct {
+	services.UserRepository
+	stats *sql.DBStats
+}
+
+func (u *poolUsers) PoolStats() *sql.DBStats { return u.stats }
+
+func TestHealthReportsPoolSaturation(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.GET("/health", h.HealthCheck)
+	health := func() models.HealthResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var body models.HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// The memory store has no pool to report
+	if body := health(); body.Status != "healthy" || body.DBPool != nil {
+		t.Fatalf("memory store: %+v, want healthy without db_pool", body)
+	}
+
+	users := &poolUsers{UserRepository: h.userService}
+	h.userService = users
+	steps := []struct {
+		name   string
+		stats  sql.DBStats
+		status string
+	}{
+		{"full with new waits", sql.DBStats{MaxOpenConnections: 4, InUse: 4, WaitCount: 5}, "degraded"},
+		{"full with no new waits", sql.DBStats{MaxOpenConnections: 4, InUse: 4, WaitCount: 5}, "healthy"},
+		{"waits with room left", sql.DBStats{MaxOpenConnections: 4, InUse: 2, WaitCount: 9}, "healthy"},
+		{"unlimited pool", sql.DBStats{InUse: 40, WaitCount: 12}, "healthy"},
+	}
+	for _, step := range steps {
+		users.stats = &step.stats
+		body := health()
+		if body.Status != step.status {
+			t.Fatalf("%s: status = %q, want %q", step.name, body.Status, step.status)
+		}
+		if body.DBPool == nil || body.DBPool.InUse != step.stats.InUse || body.DBPool.WaitCount != step.stats.WaitCount {
+			t.Fatalf("%s: db_pool = %+v, want the pool stats", step.name, body.DBPool)
+		}
+	}
+}
+
+func TestGetOrCreateUserRereadsOnlyAfterDuplicate(t *testing.T) {
+	noRows := fmt.Errorf("failed to get user: %w", sql.ErrNoRows)
+	tests := []struct {
+		name    string
+		exists  bool // a concurrent request created alice after the lookup
+		getErrs []error
+		gets    int
+	}{
+		{"created", false, nil, 1},
+		{"lost the insert race", true, []error{noRows}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+			if tt.exists {
+				if _, err := h.userService.CreateUser(context.Background(), "alice"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			users := &scriptedUsers{UserRepository: h.userService, getErrs: tt.getErrs}
+			h.userService = users
+
+			user, err := h.getOrCreateUser(context.Background(), "alice")
+			if err != nil || user.UserID != "alice" {
+				t.Fatalf("getOrCreateUser = %+v, %v", user, err)
+			}
+			if users.gets != tt.gets || users.creates != 1 {
+				t.Fatalf("%d lookups and %d creates, want %d and 1", users.gets, users.creates, tt.gets)
+			}
+		})
+	}
+}
+
+func TestStatsCacheHitsAndMisses(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.GET("/user/stats", h.GetUserStats, userid.Middleware())
+	h.userService.CreateUser(context.Background(), "alice")
+
+	counts := func() [4]float64 {
+		return [4]float64{
+			testutil.ToFloat64(appmetrics.CacheHitsTotal.WithLabelValues("user_stats")),
+			testutil.ToFloat64(appmetrics.CacheMissesTotal.WithLabelValues("user_stats")),
+			testutil.ToFloat64(appmetrics.CacheHitsTotal.WithLabelValues("user_missing")),
+			testutil.ToFloat64(appmetrics.CacheMissesTotal.WithLabelValues("user_missing")),
+		}
+	}
+	stats := func(user string) {
+		req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+		req.Header.Set(userid.Header, user)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// user_stats hits/misses, then user_missing hits/misses, after each lookup
+	steps := []struct {
+		user string
+		want [4]float64
+	}{
+		{"alice", [4]float64{0, 1, 0, 1}}, // from the DB
+		{"alice", [4]float64{1, 0, 0, 0}}, // cached
+		{"ghost", [4]float64{0, 1, 0, 1}}, // not found in the DB
+		{"ghost", [4]float64{0, 1, 1, 0}}, // negative cache
+	}
+	for i, step := range steps {
+		before := counts()
+		stats(step.user)
+		after := counts()
+		for j := range after {
+			if got := after[j] - before[j]; got != step.want[j] {
+				t.Fatalf("lookup %d (%s): deltas %v, want %v", i, step.user, [4]float64{after[0] - before[0], after[1] - before[1], after[2] - before[2], after[3] - before[3]}, step.want)
+			}
+		}
+	}
+}
+
+func TestListStreams(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.Use(requestid.Middleware())
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.DELETE("/generate-data/:id", h.CancelStream, userid.Middleware())
+	e.GET("/admin/streams", h.ListStreams)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	list := func() []models.ActiveStream {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/admin/streams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var streams []models.ActiveStream
+		if err := json.NewDecoder(resp.Body).Decode(&streams); err != nil {
+			t.Fatal(err)
+		}
+		return streams
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/generate-data", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "1000")
+	req.Header.Set("X-Delay-Ms", "10")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	id := resp.Header.Get(streamIDHeader)
+
+	// Wait for a few words, then the stream is listed with its progress
+	deadline := time.Now().Add(5 * time.Second)
+	var streams []models.ActiveStream
+	for {
+		streams = list()
+		if len(streams) == 1 && streams[0].Words >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("streams = %+v, want alice's stream with some words", streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s := streams[0]
+	if strconv.FormatUint(s.StreamID, 10) != id || s.UserID != "alice" || s.RequestID != resp.Header.Get(requestid.Header) || s.RunningMs <= 0 {
+		t.Fatalf("listed %+v, want stream %s for alice", s, id)
+	}
+
+	cancelStream(t, srv, id)
+	io.Copy(io.Discard, resp.Body)
+	// finish deregisters the stream right after the body ends
+	for deadline := time.Now().Add(5 * time.Second); len(list()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("finished stream still listed: %+v", list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGenerateDataTemperature(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	for _, bad := range []string{"-0.1", "1.5", "warm"} {
+		if rec := generate(t, e, map[string]string{"X-Temperature": bad}); rec.Code != http.StatusBadRequest {
+			t.Errorf("X-Temperature %s: status = %d, want 400", bad, rec.Code)
+		}
+	}
+
+	// Temperature 1 is the default, so seeded streams are unchanged by it
+	headers := map[string]string{"X-Seed": "42", "X-Max-Tokens": "20"}
+	plain := generate(t, e, headers).Body.String()
+	headers["X-Temperature"] = "1"
+	if warmed := generate(t, e, headers).Body.String(); warmed != plain {
+		t.Fatalf("temperature 1 changed the seeded stream: %q vs %q", warmed, plain)
+	}
+	headers["X-Temperature"] = "0"
+	if cold := generate(t, e, headers).Body.String(); cold == plain {
+		t.Fatal("temperature 0 left the seeded stream unchanged")
+	}
+}
+
+func TestPauseWritesHeartbeats(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.StreamHeartbeatInterval = 10 * time.Millisecond
+	})
+	ticks := make(chan time.Time)
+	started := 0
+	h.tickEvery = func(d time.Duration) (<-chan time.Time, func()) {
+		if d != 10*time.Millisecond {
+			t.Errorf("ticker interval = %v, want 10ms", d)
+		}
+		started++
+		return ticks, func() {}
+	}
+
+	// A delay within one interval needs no heartbeat
+	rec := httptest.NewRecorder()
+	h.pause(context.Background(), rec, http.NewResponseController(rec), 5*time.Millisecond, " ")
+	if started != 0 || rec.Body.Len() != 0 {
+		t.Fatalf("short pause started %d tickers and wrote %q", started, rec.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.pause(ctx, rec, http.NewResponseController(rec), time.Minute, "\n")
+	}()
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+	}
+	cancel()
+	<-done
+
+	if started != 1 {
+		t.Fatalf("started %d tickers, want 1", started)
+	}
+	if rec.Body.String() != "\n\n\n" || !rec.Flushed {
+		t.Fatalf("body = %q, flushed = %v; want three flushed heartbeats", rec.Body.String(), rec.Flushed)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.CacheWarmUsers = 2
+	})
+	e := echo.New()
+	e.POST("/admin/cache/warm", h.WarmCache)
+	ctx := context.Background()
+
+	for _, id := range []string{"alice", "bob", "carol"} {
+		if _, err := h.userService.CreateUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // distinct UpdatedAt, so "recent" is well defined
+	}
+	warm := func(query string) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/cache/warm"+query, nil))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	cached := func(id string) bool {
+		ok, _ := h.cache.Exists(ctx, cache.Key("user_stats", id))
+		return ok
+	}
+
+	// CACHE_WARM_USERS bounds the default, most recently updated first
+	if code, body := warm(""); code != http.StatusOK || body != `{"warmed":2}` {
+		t.Fatalf("default limit: %d %s, want 200 {\"warmed\":2}", code, body)
+	}
+	if cached("alice") || !cached("bob") || !cached("carol") {
+		t.Fatal("default warm should cache only bob and carol")
+	}
+	if got, _ := h.cache.Get(ctx, cache.Key("user_stats", "carol")); !strings.Contains(got, `"words_left":`) {
+		t.Fatalf("cached stats = %q", got)
+	}
+
+	if code, body := warm("?limit=10"); code != http.StatusOK || body != `{"warmed":3}` || !cached("alice") {
+		t.Fatalf("limit=10: %d %s, want 200 {\"warmed\":3} and alice cached", code, body)
+	}
+	for _, bad := range []string{"?limit=0", "?limit=-1", "?limit=lots"} {
+		if code, _ := warm(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, code)
+		}
+	}
+}
+
+func TestGenerateDataStreamFormats(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), nil)
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	stream := func(format string) (*httptest.ResponseRecorder, []string) {
+		t.Helper()
+		rec := generate(t, e, map[string]string{userid.Header: "user-" + format, "X-Seed": "42", "X-Max-Tokens": "5", streamFormatHeader: format})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", format, rec.Code, rec.Body.String())
+		}
+		return rec, strings.Fields(rec.Body.String())
+	}
+
+	plain, words := stream("plain")
+	if len(words) != 5 || plain.Body.String() != strings.Join(words, " ")+" " {
+		t.Fatalf("plain body = %q, want five space-separated words", plain.Body.String())
+	}
+	if ct := plain.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("plain content type = %q", ct)
+	}
+
+	// The same seed gives the same words whatever the framing
+	lines, _ := stream("lines")
+	if lines.Body.String() != strings.Join(words, "\n")+"\n" {
+		t.Fatalf("lines body = %q, want one word per line", lines.Body.String())
+	}
+
+	jsonl, _ := stream("jsonl")
+	if ct := jsonl.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, "application/x-ndjson") {
+		t.Fatalf("jsonl content type = %q", ct)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(jsonl.Body.String(), "\n"), "\n") {
+		var obj struct {
+			Word string `json:"word"`
+		}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("jsonl line %q: %v", line, err)
+		}
+		got = append(got, obj.Word)
+	}
+	if strings.Join(got, " ") != strings.Join(words, " ") {
+		t.Fatalf("jsonl words = %v, want %v", got, words)
+	}
+
+	if rec := generate(t, e, map[string]string{streamFormatHeader: "xml"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown format: status = %d, want 400", rec.Code)
+	}
+}
+
+// observations stands in for a histogram and keeps every observed value.
+type observations struct {
+	prometheus.Histogram
+	mu     sync.Mutex
+	values []float64
+}
+
+func (o *observations) Observe(v float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.values = append(o.values, v)
+}
+
+func (o *observations) observed() []float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]float64(nil), o.values...)
+}
+
+// recordHistogram swaps *target for observations until the test ends.
+func recordHistogram(t *testing.T, target *prometheus.Histogram) *observations {
+	t.Helper()
+	o := &observations{Histogram: *target}
+	saved := *target
+	*target = o
+	t.Cleanup(func() { *target = saved })
+	return o
+}
+
+func TestTimeToFirstWord(t *testing.T) {
+	firstWord := recordHistogram(t, &appmetrics.TimeToFirstWordSeconds)
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 5
+	})
+	e := echo.New()
+	// Measured from when the access log saw the request, not from the handler
+	e.POST("/generate-data", h.GenerateData, userid.Middleware(), func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(accesslog.StartTimeKey, time.Now().Add(-time.Second))
+			return next(c)
+		}
+	})
+
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "5"}); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	got := firstWord.observed()
+	if len(got) != 1 || got[0] < 1 || got[0] > 2 {
+		t.Fatalf("time to first word = %v, want one observation of about 1s", got)
+	}
+
+	// A stream that never sends a word has no first word to time
+	if rec := generate(t, e, nil); rec.Code == http.StatusOK {
+		t.Fatalf("exhausted quota: status = %d", rec.Code)
+	}
+	if got := firstWord.observed(); len(got) != 1 {
+		t.Fatalf("observations = %v, want still one", got)
+	}
+}
+
+func TestWordsPerSecond(t *testing.T) {
+	rate := recordHistogram(t, &appmetrics.WordsPerSecond)
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.DefaultQuota = 4
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+
+	// Four words 10ms apart take at least 30ms, so no more than ~133 words/s
+	start := time.Now()
+	if rec := generate(t, e, map[string]string{"X-Max-Tokens": "4", "X-Delay-Ms": "10"}); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	floor := 4 / time.Since(start).Seconds()
+	got := rate.observed()
+	if len(got) != 1 || got[0] < floor || got[0] > 4/0.03 {
+		t.Fatalf("words per second = %v, want one observation between %.0f and 133", got, floor)
+	}
+
+	// A stream that sends nothing has no rate
+	if rec := generate(t, e, nil); rec.Code == http.StatusOK {
+		t.Fatalf("exhausted quota: status = %d", rec.Code)
+	}
+	if got := rate.observed(); len(got) != 1 {
+		t.Fatalf("observations = %v, want still one", got)
+	}
+}
+
+func TestGenerationDelayDisabled(t *testing.T) {
+	h := newTestHandler(t, services.NewMemoryRequestRepository(), func(cfg *config.Config) {
+		cfg.GenerationDelayEnabled = false
+	})
+	e := echo.New()
+	e.POST("/generate-data", h.GenerateData, userid.Middleware())
+	e.POST("/generate-data/preview", h.PreviewGeneration, userid.Middleware())
+
+	// Five words asking for 200ms apart would take 800ms with delays on
+	start := time.Now()
+	rec := generate(t, e, map[string]string{"X-Max-Tokens": "5", "X-Delay-Ms": "200"})
+	if rec.Code != http.StatusOK || len(strings.Fields(rec.Body.String())) != 5 {
+		t.Fatalf("status = %d, body %q; want five words", rec.Code, rec.Body.String())
+	}
+	if took := time.Since(start); took > 400*time.Millisecond {
+		t.Fatalf("stream took %v, want no per-word delay", took)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/generate-data/preview", nil)
+	req.Header.Set(userid.Header, "alice")
+	req.Header.Set("X-Max-Tokens", "5")
+	req.Header.Set("X-Delay-Ms", "200")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var preview models.PreviewResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("preview: %d %s", rec.Code, rec.Body.String())
+	}
+	if preview.EstimatedWords != 5 || preview.EstimatedSeconds != 0 {
+		t.Fatalf("preview = %+v, want 5 words in 0s", preview)
+	}
+}
+
+// pagedRequests records the cursor of every ListRequests call and fails
+// the ones listed in failAfter.
+type pagedRequests struct {
+	*services.MemoryRequestRepository
+	cursors   []int
+	failAfter map[int]bool
+}
+
+func (r *pagedRequests) ListRequests(ctx context.Context, userID string, afterID, limit int) ([]models.Request, error) {
+	r.cursors = append(r.cursors, afterID)
+	if r.failAfter[afterID] {
+		return nil, errConnectionLost
+	}
+	return r.MemoryRequestRepository.ListRequests(ctx, userID, afterID, limit)
+}
+
+func TestExportRequests(t *testing.T) {
+	requests := &pagedRequests{MemoryRequestRepository: services.NewMemoryRequestRepository()}
+	h := newTestHandler(t, requests, nil)
+	e := echo.New()
+	e.GET("/user/export", h.ExportRequests, userid.Middleware())
+	ctx := context.Background()
+
+	// Two full batches and a partial one, with someone else's rows mixed in
+	total := 2*exportBatchSize + 3
+	for i := 0; i < total; i++ {
+		if err := requests.SaveRequest(ctx, fmt.Sprintf("req-%d", i), "alice", "hello world", 10); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			_ = requests.SaveRequest(ctx, fmt.Sprintf("bob-%d", i), "bob", "other", 10)
+		}
+	}
+	export := func() *httptest.ResponseRecorder {
+		t.Helper()
+		requests.cursors = nil
+		req := httptest.NewRequest(http.MethodGet, "/user/export", nil)
+		req.Header.Set(userid.Header, "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(body string) []models.Request {
+		t.Helper()
+		var rows []models.Request
+		for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+			var row models.Request
+			if err := json.Unmarshal([]byte(line), &row); err != nil {
+				t.Fatalf("line %q: %v", line, err)
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	rec := export()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "application/x-ndjson") {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	rows := decode(rec.Body.String())
+	if len(rows) != total {
+		t.Fatalf("exported %d rows, want %d", len(rows), total)
+	}
+	for i, row := range rows {
+		if row.UserID != "alice" || row.RequestID != fmt.Sprintf("req-%d", i) || (i > 0 && row.ID <= rows[i-1].ID) {
+			t.Fatalf("row %d = %+v, want alice's req-%d in id order", i, row, i)
+		}
+	}
+	// Read in batches, each continuing after the last id sent
+	want := []int{0, rows[exportBatchSize-1].ID, rows[2*exportBatchSize-1].ID}
+	if fmt.Sprint(requests.cursors) != fmt.Sprint(want) {
+		t.Fatalf("cursors = %v, want %v", requests.cursors, want)
+	}
+
+	// A failure after the first batch leaves a short export, not an error
+	requests.failAfter = map[int]bool{want[1]: true}
+	if rec := export(); rec.Code != http.StatusOK || len(decode(rec.Body.String())) != exportBatchSize {
+		t.Fatalf("failure mid-stream: status = %d, %d rows; want 200 with one batch", rec.Code, len(decode(rec.Body.String())))
+	}
+
+	requests.failAfter = map[int]bool{0: true}
+	if rec := export(); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failure before the first batch: status = %d, want 500", rec.Code)
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/apierror"
+	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/middleware/requestid"
+	"manifold-test/internal/services"
+)
+
+// wordStream is the transport-independent part of a generation: the seeded
+// word sequence, the caller's limits and the quota reserved so far. The HTTP
+// and WebSocket handlers drive it and write the words themselves.
+type wordStream struct {
+	h          *Handler
+	requestID  string
+	userID     string
+	profile    string // word bank in use, after defaulting to the user's
+	candidates services.WordSource
+	stop       *services.StopMatcher
+	maxTokens  int
+	delayMs    int
+	rng        *rand.Rand
+	delayRand  *rand.Rand
+	unmetered  bool // UNLIMITED_USERS member: no quota is reserved
+	quotaLow   bool // words_left was under the warning threshold at start
+
+	reserved  int
+	generated int
+	data      strings.Builder
+	active    *activeStream // registry entry, until finish
+}
+
+// startStream looks up the user, picks the word bank and makes the first
+// quota reservation. profile overrides the user's stored profile when set.
+// Errors are HTTP errors, so transports must call it before committing a
+// response.
+func (h *Handler) startStream(ctx context.Context, userID, profile string, params generateParams, resumeOffset int) (*wordStream, error) {
+	// Get or create user + quota
+	user, err := h.getOrCreateUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	h.observeWordsLeft(userID, user.WordsLeft)
+	unmetered := h.unlimitedUsers[userID]
+	if user.WordsLeft <= 0 && !unmetered {
+		appmetrics.QuotaExhaustedTotal.Inc()
+		return nil, apierror.New(http.StatusForbidden, apierror.CodeNoWordsLeft, "No words left")
+	}
+
+	if profile == "" {
+		profile = user.Profile
+	}
+	bank, ok := h.wordBanks[profile]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unknown profile")
+	}
+	candidates := bank.Filter(params.minWordLen, params.maxWordLen)
+	if len(candidates) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "No words match the requested length bounds")
+	}
+
+	// Per-request sources avoid contention on the global rand lock. Delay
+	// jitter has its own source so it can't perturb the seeded word sequence
+	s := &wordStream{
+		h:          h,
+		requestID:  requestid.FromContext(ctx),
+		userID:     userID,
+		profile:    profile,
+		candidates: services.WithTemperature(candidates, params.temperature),
+		stop:       services.NewStopMatcher(params.stopToken),
+		maxTokens:  params.maxTokens,
+		delayMs:    params.delayMs,
+		rng:        rand.New(rand.NewSource(params.seed)),
+		delayRand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		unmetered:  unmetered,
+		quotaLow:   !unmetered && h.quotaLow(user.WordsLeft, user.TotalWords),
+	}
+	// Skipped words still count towards multi-word stop sequences
+	for i := 0; i < resumeOffset; i++ {
+		s.stop.Push(s.candidates.Next(s.rng))
+	}
+
+	if unmetered {
+		s.active = h.streams.add(s.requestID, userID)
+		return s, nil
+	}
+
+	// Reserve quota before streaming so concurrent streams for the same user
+	// can't spend more than the balance; unused words are refunded at the end
+	s.reserved, err = h.userService.ReserveWords(ctx, userID, h.reservationSize(s.maxTokens, 0))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to reserve words")
+	}
+	if s.reserved == 0 {
+		appmetrics.QuotaExhaustedTotal.Inc()
+		return nil, apierror.New(http.StatusForbidden, apierror.CodeNoWordsLeft, "No words left")
+	}
+
+	s.active = h.streams.add(s.requestID, userID)
+	return s, nil
+}
+
+// next generates the next word. When a limit is reached first it returns a
+// stream-end reason instead (max_tokens, max_words or quota_exhausted).
+func (s *wordStream) next(ctx context.Context) (word string, stopTokenFound bool, stopReason string) {
+	// Server-side hard cap, independent of quota. It is checked first since
+	// max tokens is clamped to it, so a clamped stream reports the cap
+	if s.h.streamMaxWords != -1 && s.generated >= s.h.streamMaxWords {
+		return "", false, "max_words"
+	}
+	if s.maxTokens != -1 && s.generated >= s.maxTokens {
+		return "", false, "max_tokens"
+	}
+
+	// Reservation used up: reserve the next chunk
+	if !s.unmetered && s.generated >= s.reserved {
+		more, err := s.h.userService.ReserveWords(ctx, s.userID, s.h.reservationSize(s.maxTokens, s.generated))
+		if err != nil || more == 0 {
+			return "", false, "quota_exhausted"
+		}
+		s.reserved += more
+	}
+
+	word = s.candidates.Next(s.rng)
+	return word, s.stop.Push(word), ""
+}
+
+// delivered records a word the client received; only those are charged.
+func (s *wordStream) delivered(word string) {
+	s.data.WriteString(word + " ")
+	s.generated++
+	s.active.words.Add(1)
+}
+
+// delay is the pause before the next word: the requested delay, or
+// 500–1000ms by default. It is always 0 with GENERATION_DELAY_ENABLED off.
+func (s *wordStream) delay() time.Duration {
+	if !s.h.delayEnabled {
+		return 0
+	}
+	if s.delayMs >= 0 {
+		return time.Duration(s.delayMs) * time.Millisecond
+	}
+	return time.Duration(s.delayRand.Intn(500)+500) * time.Millisecond
+}
+
+// finish persists the stream off the request goroutine and refunds the
+// unused reservation; past the persistence cap the request log is
+// dead-lettered and only the refund is written, synchronously. ctx is the
+// request context; the writes keep its values but not its cancellation.
+func (s *wordStream) finish(ctx context.Context, startWall time.Time) {
+	s.h.streams.remove(s.active)
+	durationMs := time.Since(startWall).Milliseconds()
+	data := s.data.String()
+	unused := max(s.reserved-s.generated, 0)
+	userID := s.userID
+	ctx = context.WithoutCancel(ctx)
+	if !s.h.persistLimiter.Go(func() { s.h.persistRequest(ctx, userID, data, unused, durationMs) }) {
+		appmetrics.PersistenceShedTotal.Inc()
+		slog.WarnContext(ctx, "Persistence cap reached, dead-lettering request record", "user_id", userID)
+		s.h.shedRequest(ctx, userID, data, unused, durationMs)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/middleware/userid"
+	"manifold-test/internal/models"
+)
+
+// activeStream is a registry entry. words is bumped by the stream's own
+// goroutine and read by ListStreams, hence atomic. stopped is cancelled by
+// DELETE /generate-data/:id to ask the stream to end.
+type activeStream struct {
+	id        uint64
+	requestID string
+	userID    string
+	startedAt time.Time
+	words     atomic.Int64
+
+	stopped context.Context
+	stop    context.CancelFunc
+}
+
+// streamRegistry tracks the generations in flight on this instance, for
+// operational debugging. Entries are added by startStream and removed by
+// finish, which every transport runs, including after a disconnect.
+type streamRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	streams map[uint64]*activeStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[uint64]*activeStream)}
+}
+
+func (r *streamRegistry) add(requestID, userID string) *activeStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	s := &activeStream{id: r.nextID, requestID: requestID, userID: userID, startedAt: time.Now()}
+	s.stopped, s.stop = context.WithCancel(context.Background())
+	r.streams[s.id] = s
+	return s
+}
+
+func (r *streamRegistry) remove(s *activeStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, s.id)
+	s.stop()
+}
+
+// cancel asks userID's stream id to stop and reports whether there was
+// one. Other users' streams are treated as missing.
+func (r *streamRegistry) cancel(id uint64, userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[id]
+	if !ok || s.userID != userID {
+		return false
+	}
+	s.stop()
+	return true
+}
+
+// snapshot returns the live streams, oldest first.
+func (r *streamRegistry) snapshot() []models.ActiveStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	list := make([]models.ActiveStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		list = append(list, models.ActiveStream{
+			StreamID:  s.id,
+			RequestID: s.requestID,
+			UserID:    s.userID,
+			StartedAt: s.startedAt,
+			RunningMs: now.Sub(s.startedAt).Milliseconds(),
+			Words:     s.words.Load(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StreamID < list[j].StreamID })
+	return list
+}
+
+// CancelStream ends the caller's stream whose X-Stream-Id is :id, as if it
+// had reached its stop token early: what was delivered is persisted and
+// charged, and the stream ends with reason client_stop, whichever
+// transport serves it. Streams are per instance, so the DELETE must reach
+// the instance serving the stream.
+func (h *Handler) CancelStream(c echo.Context) error {
+	userID := userid.FromContext(c.Request().Context())
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Stream ID must be a positive integer")
+	}
+	if !h.streams.cancel(id, userID) {
+		return echo.NewHTTPError(http.StatusNotFound, "No such stream")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ListStreams reports the streams currently running on this instance.
+func (h *Handler) ListStreams(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.streams.snapshot())
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/middleware/accesslog"
+	"manifold-test/internal/middleware/userid"
+)
+
+// Client message that ends a WebSocket stream early
+const wsStopMessage = "stop"
+
+// GenerateDataWS streams words as WebSocket text messages, one word per
+// message, for clients behind proxies that buffer chunked responses. It
+// takes the same headers as GenerateData and is charged the same way; the
+// client can send "stop" to end generation early. Setup failures are
+// returned as HTTP errors before the upgrade.
+func (h *Handler) GenerateDataWS(c echo.Context) (err error) {
+	ctx := c.Request().Context()
+
+	appmetrics.RequestsTotal.Inc()
+	appmetrics.ActiveRequests.Inc()
+	defer appmetrics.ActiveRequests.Dec()
+
+	startWall := time.Now()
+	var stream *wordStream
+	defer func() {
+		appmetrics.RequestDurationSeconds.WithLabelValues(outcomeFor(err)).Observe(time.Since(startWall).Seconds())
+		wordsGenerated := 0
+		if stream != nil {
+			wordsGenerated = stream.generated
+		}
+		appmetrics.WordsGeneratedTotal.Add(float64(wordsGenerated))
+		c.Set(accesslog.WordsGeneratedKey, wordsGenerated)
+	}()
+
+	userID := userid.FromContext(c.Request().Context())
+	params, err := h.parseGenerateParams(c)
+	if err != nil {
+		return err
+	}
+	stream, err = h.startStream(ctx, userID, c.Request().Header.Get("X-Profile"), params, 0)
+	if err != nil {
+		return err
+	}
+
+	// No origin check: callers authenticate with headers, not cookies. The
+	// handshake carries X-Stream-Id for DELETE /generate-data/:id
+	websocket.Server{Config: websocket.Config{
+		Header: http.Header{streamIDHeader: {strconv.FormatUint(stream.active.id, 10)}},
+	}, Handler: func(ws *websocket.Conn) {
+		stopReason := h.streamWebSocket(ws, stream)
+		appmetrics.StreamEndedTotal.WithLabelValues(stopReason).Inc()
+	}}.ServeHTTP(c.Response(), c.Request())
+
+	// Persist whatever was delivered, including after a disconnect or a
+	// failed upgrade (which refunds the whole reservation)
+	stream.finish(ctx, startWall)
+	return nil
+}
+
+// streamWebSocket sends words until a limit is hit, the client sends
+// "stop", a DELETE for its stream ID stops it or the client goes away, and
+// returns the stream-end reason.
+func (h *Handler) streamWebSocket(ws *websocket.Conn, stream *wordStream) string {
+	streamCtx, cancel := context.WithTimeout(context.Background(), h.streamTimeout)
+	defer cancel()
+	defer context.AfterFunc(stream.active.stopped, cancel)()
+
+	// The HTTP server's read deadline outlives the upgrade; clear it so
+	// only closing the connection ends the reader
+	_ = ws.SetReadDeadline(time.Time{})
+	stopped := make(chan struct{})
+	gone := make(chan struct{})
+	go func() {
+		for {
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				close(gone)
+				return
+			}
+			if strings.TrimSpace(msg) == wsStopMessage {
+				close(stopped)
+				return
+			}
+		}
+	}()
+
+	for {
+		word, stopTokenFound, limitReason := stream.next(streamCtx)
+		if limitReason != "" {
+			if reason := endReason(context.Background(), streamCtx, stream); reason != "" {
+				return reason
+			}
+			return limitReason
+		}
+
+		if h.writeTimeout > 0 {
+			_ = ws.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		}
+		if err := websocket.Message.Send(ws, word); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				appmetrics.SlowConsumerStreamsTotal.Inc()
+				return "slow_consumer"
+			}
+			return "client_cancel"
+		}
+		stream.delivered(word)
+
+		if stopTokenFound {
+			return "completed"
+		}
+
+		select {
+		case <-streamCtx.Done():
+			return endReason(context.Background(), streamCtx, stream)
+		case <-stopped:
+			return "client_stop"
+		case <-gone:
+			return "client_cancel"
+		case <-time.After(stream.delay()):
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"manifold-test/internal/cache"
+)
+
+// Header is the request header carrying the client's idempotency key.
+const Header = "Idempotency-Key"
+
+// Conflict modes for a request whose key is already being generated
+const (
+	ModeWait   = "wait"
+	ModeReject = "reject"
+)
+
+// Store keeps finished results per (user, key) in the cache and serialises
+// concurrent requests for the same key with a SET NX lock.
+type Store struct {
+	client    cache.Cache
+	resultTTL time.Duration
+	lockTTL   time.Duration
+}
+
+func NewStore(client cache.Cache, resultTTL, lockTTL time.Duration) *Store {
+	return &Store{client: client, resultTTL: resultTTL, lockTTL: lockTTL}
+}
+
+// Lock is held while a request generates the result for its key.
+type Lock struct {
+	key   string
+	token string
+}
+
+// Get returns the stored result for key, if any.
+func (s *Store) Get(ctx context.Context, userID, key string) (string, bool, error) {
+	result, err := s.client.Get(ctx, resultKey(userID, key))
+	if err == cache.ErrMiss {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read idempotent result: %w", err)
+	}
+	return result, true, nil
+}
+
+// TryLock acquires the lock for key. It returns nil without error when
+// another request already holds it.
+func (s *Store) TryLock(ctx context.Context, userID, key string) (*Lock, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	lock := &Lock{key: lockKey(userID, key), token: hex.EncodeToString(buf)}
+
+	ok, err := s.client.SetNX(ctx, lock.key, lock.token, s.lockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire idempotency lock: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// Unlock releases lock if it is still held by the caller.
+func (s *Store) Unlock(ctx context.Context, lock *Lock) error {
+	return s.client.DelIfValue(ctx, lock.key, lock.token)
+}
+
+// Save stores the finished result for key.
+func (s *Store) Save(ctx context.Context, userID, key, result string) error {
+	if err := s.client.Set(ctx, resultKey(userID, key), result, s.resultTTL); err != nil {
+		return fmt.Errorf("failed to save idempotent result: %w", err)
+	}
+	return nil
+}
+
+// Wait polls until the request holding the lock for key stores its result
+// or gives up the lock. found is false when the lock went away without a
+// result (e.g. the first request failed).
+func (s *Store) Wait(ctx context.Context, userID, key string, pollInterval time.Duration) (result string, found bool, err error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if result, found, err := s.Get(ctx, userID, key); err != nil || found {
+			return result, found, err
+		}
+
+		held, err := s.client.Exists(ctx, lockKey(userID, key))
+		if err != nil {
+			return "", false, fmt.Errorf("failed to check idempotency lock: %w", err)
+		}
+		if !held {
+			// The holder may have saved just before releasing
+			return s.Get(ctx, userID, key)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func resultKey(userID, key string) string {
+	return cache.Key("idempotency", userID, key)
+}
+
+func lockKey(userID, key string) string {
+	return cache.Key("idempotency_lock", userID, key)
+}
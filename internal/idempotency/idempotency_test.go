@@ -0,0 +1,107 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"manifold-test/internal/cache"
+)
+
+func newTestStore() *Store {
+	return NewStore(cache.NewMemoryCache(), time.Minute, time.Minute)
+}
+
+func TestFirstCallMissesAndLocks(t *testing.T) {
+	s := newTestStore()
+	ctx := context.Background()
+
+	if _, found, err := s.Get(ctx, "alice", "k1"); err != nil || found {
+		t.Fatalf("Get on a fresh key: found = %v, err = %v", found, err)
+	}
+	lock, err := s.TryLock(ctx, "alice", "k1")
+	if err != nil || lock == nil {
+		t.Fatalf("TryLock on a fresh key: lock = %v, err = %v", lock, err)
+	}
+}
+
+func TestDuplicateReplaysSavedResult(t *testing.T) {
+	s := newTestStore()
+	ctx := context.Background()
+
+	lock, _ := s.TryLock(ctx, "alice", "k1")
+	if err := s.Save(ctx, "alice", "k1", "lorem ipsum"); err != nil {
+		t.Fatal(err)
+	}
+	s.Unlock(ctx, lock)
+
+	result, found, err := s.Get(ctx, "alice", "k1")
+	if err != nil || !found || result != "lorem ipsum" {
+		t.Fatalf("replay = %q, found = %v, err = %v", result, found, err)
+	}
+
+	// Keys are per user
+	if _, found, _ := s.Get(ctx, "bob", "k1"); found {
+		t.Fatal("bob saw alice's result")
+	}
+}
+
+func TestConcurrentDuplicateWaitsForHolder(t *testing.T) {
+	s := newTestStore()
+	ctx := context.Background()
+
+	lock, _ := s.TryLock(ctx, "alice", "k1")
+	if second, err := s.TryLock(ctx, "alice", "k1"); err != nil || second != nil {
+		t.Fatalf("second TryLock: lock = %v, err = %v, want nil", second, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var result string
+	var found bool
+	go func() {
+		defer wg.Done()
+		result, found, _ = s.Wait(ctx, "alice", "k1", time.Millisecond)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Save(ctx, "alice", "k1", "lorem ipsum")
+	s.Unlock(ctx, lock)
+	wg.Wait()
+
+	if !found || result != "lorem ipsum" {
+		t.Fatalf("Wait = %q, found = %v", result, found)
+	}
+}
+
+func TestWaitGivesUpWhenHolderFails(t *testing.T) {
+	s := newTestStore()
+	ctx := context.Background()
+
+	lock, _ := s.TryLock(ctx, "alice", "k1")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Unlock(ctx, lock)
+	}()
+
+	if _, found, err := s.Wait(ctx, "alice", "k1", time.Millisecond); err != nil || found {
+		t.Fatalf("Wait after failed holder: found = %v, err = %v", found, err)
+	}
+
+	// The key can be retried once the lock is gone
+	if retry, _ := s.TryLock(ctx, "alice", "k1"); retry == nil {
+		t.Fatal("TryLock after release returned nil")
+	}
+}
+
+func TestWaitHonorsContext(t *testing.T) {
+	s := newTestStore()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	s.TryLock(ctx, "alice", "k1")
+	if _, _, err := s.Wait(ctx, "alice", "k1", time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("Wait err = %v, want deadline exceeded", err)
+	}
+}
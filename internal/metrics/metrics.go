@@ -1,6 +1,26 @@
 package metrics
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Histogram buckets used unless Init is given overrides
+var (
+	DefaultRequestDurationBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 20, 40, 60, 75}
+	DefaultDBWriteDurationBuckets = []float64{0.005, 0.01, 0.02, 0.05, 0.1, 0.25, 0.5}
+	// Default pacing (500–1000ms a word) lands in 1–2; X-Delay-Ms and
+	// FAST_MODE streams run far faster
+	DefaultWordsPerSecondBuckets = []float64{0.5, 1, 1.5, 2, 5, 10, 50, 100, 1000, 10000}
+)
+
+// Config overrides histogram buckets; a nil slice keeps the default.
+type Config struct {
+	RequestDurationBuckets []float64
+	DBWriteDurationBuckets []float64
+	WordsPerSecondBuckets  []float64
+}
 
 var (
 	// Request volume
@@ -15,13 +35,22 @@ var (
 		Help: "Current number of in-flight requests.",
 	})
 
-	// Request latency (handler duration)
-	RequestDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "request_duration_seconds",
-		Help:    "End-to-end handler duration for API requests.",
-		Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 20, 40, 60, 75},
+	// Generate request latency (handler duration) by outcome:
+	// streamed, rate_limited (recorded by the limiters), no_words,
+	// bad_request, error
+	RequestDurationSeconds = newRequestDuration(DefaultRequestDurationBuckets)
+
+	// From the request reaching the server (before auth and rate limiting)
+	// to the first streamed word being flushed: the latency clients feel
+	TimeToFirstWordSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "time_to_first_word_seconds",
+		Help:    "Time from request arrival until the first word of a stream is flushed.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
 	})
 
+	// Throughput of each stream that delivered words: words / wall duration
+	WordsPerSecond = newWordsPerSecond(DefaultWordsPerSecondBuckets)
+
 	// Output volume
 	WordsGeneratedTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "words_generated_total",
@@ -29,26 +58,220 @@ var (
 	})
 
 	// DB write latency
-	DBWriteDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "db_write_duration_seconds",
-		Help:    "Duration of INSERT into the requests table.",
-		Buckets: []float64{0.005, 0.01, 0.02, 0.05, 0.1, 0.25, 0.5},
-	})
+	DBWriteDurationSeconds = newDBWriteDuration(DefaultDBWriteDurationBuckets)
 
 	// Rate limiting drops
 	RateLimitDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "rate_limit_dropped_total",
 		Help: "Requests rejected by the per-user rate limiter.",
 	})
+	// Requests that queued for the per-user limiter (RATE_LIMIT_MAX_WAIT), by
+	// whether they were admitted in time
+	RateLimitWaitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_waits_total",
+		Help: "Requests that waited for a rate limit window, by whether they were admitted.",
+	}, []string{"admitted"})
+	RateLimitIPDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limit_ip_dropped_total",
+		Help: "Requests rejected by the per-IP rate limiter.",
+	})
+
+	// Requests rejected with 403 because the user has no words left
+	QuotaExhaustedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "quota_exhausted_total",
+		Help: "Requests rejected because the user's word quota is exhausted.",
+	})
+
+	// Why streams ended: completed, timeout, client_cancel, quota_exhausted,
+	// max_tokens, max_words, slow_consumer, client_stop (WebSocket "stop" or
+	// DELETE /generate-data/:id)
+	StreamEndedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_ended_total",
+		Help: "Streams ended, by reason.",
+	}, []string{"reason"})
+
+	// Streams cut off because a write missed its deadline
+	SlowConsumerStreamsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "slow_consumer_streams_total",
+		Help: "Streams ended because the client did not read within the write deadline.",
+	})
+
+	// Background persistence
+	PersistenceGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "persistence_goroutines",
+		Help: "Current number of goroutines writing finished requests to the DB.",
+	})
+	PersistenceShedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "persistence_shed_total",
+		Help: "Request records dead-lettered because the persistence goroutine cap was reached.",
+	})
+
+	DeadLetterDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dead_letter_depth",
+		Help: "Persistence operations waiting in the dead-letter store for replay.",
+	})
+
+	// One entry per (user, route) pair seen within the last minute or so;
+	// steady growth points at a leak in the limiter's cleanup
+	RateLimiterTrackedUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rate_limiter_tracked_users",
+		Help: "Per-user, per-route counters held by the rate limiter.",
+	})
+	RateLimiterTrackedIPs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rate_limiter_tracked_ips",
+		Help: "Per-IP, per-route counters held by the IP rate limiter.",
+	})
+
+	// Redis read circuit breaker
+	RedisBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "redis_breaker_state",
+		Help: "State of the Redis read circuit breaker (0=closed, 1=open, 2=half-open).",
+	})
+
+	// DB write circuit breaker
+	DBWriteBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_write_breaker_state",
+		Help: "State of the database write circuit breaker (0=closed, 1=open, 2=half-open).",
+	})
+
+	// Quota headroom. The per-user gauge has one series per user ID, so it
+	// is opt-in and only suitable for a small user base; words_remaining is
+	// a periodic snapshot across all users with fixed cardinality.
+	UserWordsRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "user_words_remaining",
+		Help: "Words left for a user, updated when the user is read.",
+	}, []string{"user_id"})
+	WordsRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "words_remaining",
+		Help: "Users with words_left at or below le, as of the last sample.",
+	}, []string{"le"})
+
+	UsersPurgedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "users_purged_total",
+		Help: "Users deleted by the retention job for inactivity.",
+	})
+
+	// Quota mutations that ran without the Redis per-user lock because it
+	// wasn't acquired in time or Redis failed
+	QuotaLockFallbacksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "quota_lock_fallbacks_total",
+		Help: "Quota updates that fell back to the database row lock.",
+	})
+
+	// Cache lookups by cache: user_stats, user_missing, global_stats. A
+	// read skipped by the Redis breaker or failed counts as a miss.
+	CacheHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_hits_total",
+		Help: "Cache lookups answered from the cache.",
+	}, []string{"cache"})
+	CacheMissesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_misses_total",
+		Help: "Cache lookups that fell through to the database.",
+	}, []string{"cache"})
 )
 
+// Init rebuilds the histograms whose buckets cfg overrides. Call it before
+// MustRegister and before any request is served.
+func Init(cfg Config) {
+	if cfg.RequestDurationBuckets != nil {
+		RequestDurationSeconds = newRequestDuration(cfg.RequestDurationBuckets)
+	}
+	if cfg.DBWriteDurationBuckets != nil {
+		DBWriteDurationSeconds = newDBWriteDuration(cfg.DBWriteDurationBuckets)
+	}
+	if cfg.WordsPerSecondBuckets != nil {
+		WordsPerSecond = newWordsPerSecond(cfg.WordsPerSecondBuckets)
+	}
+}
+
+func newRequestDuration(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_duration_seconds",
+		Help:    "End-to-end handler duration for API requests.",
+		Buckets: buckets,
+	}, []string{"outcome"})
+}
+
+func newDBWriteDuration(buckets []float64) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_write_duration_seconds",
+		Help:    "Duration of INSERT into the requests table.",
+		Buckets: buckets,
+	})
+}
+
+func newWordsPerSecond(buckets []float64) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "words_per_second",
+		Help:    "Words delivered per second of wall time, per stream.",
+		Buckets: buckets,
+	})
+}
+
 func MustRegister(reg prometheus.Registerer) {
 	reg.MustRegister(
 		RequestsTotal,
 		ActiveRequests,
 		RequestDurationSeconds,
+		TimeToFirstWordSeconds,
+		WordsPerSecond,
 		WordsGeneratedTotal,
 		DBWriteDurationSeconds,
 		RateLimitDroppedTotal,
+		RateLimitIPDroppedTotal,
+		RateLimitWaitsTotal,
+		QuotaExhaustedTotal,
+		StreamEndedTotal,
+		SlowConsumerStreamsTotal,
+		PersistenceGoroutines,
+		PersistenceShedTotal,
+		DeadLetterDepth,
+		RateLimiterTrackedUsers,
+		RateLimiterTrackedIPs,
+		RedisBreakerState,
+		DBWriteBreakerState,
+		UserWordsRemaining,
+		WordsRemaining,
+		UsersPurgedTotal,
+		QuotaLockFallbacksTotal,
+		CacheHitsTotal,
+		CacheMissesTotal,
 	)
 }
+
+// WordsRemainingBuckets are the le bounds of words_remaining; every sample
+// also sets le="+Inf", the number of users.
+var WordsRemainingBuckets = []float64{0, 1000, 10000, 50000, 100000, 250000, 500000, 750000, 1000000}
+
+// WordsRemainingSample counts users into the words_remaining buckets. Add
+// every user, then Publish to replace the previous sample, so users counted
+// once don't pile up across samples the way histogram observations would.
+type WordsRemainingSample struct {
+	counts []int // per bucket, the last for words above every bound
+}
+
+func NewWordsRemainingSample() *WordsRemainingSample {
+	return &WordsRemainingSample{counts: make([]int, len(WordsRemainingBuckets)+1)}
+}
+
+func (s *WordsRemainingSample) Add(wordsLeft int) {
+	for i, bound := range WordsRemainingBuckets {
+		if float64(wordsLeft) <= bound {
+			s.counts[i]++
+			return
+		}
+	}
+	s.counts[len(WordsRemainingBuckets)]++
+}
+
+// Publish sets words_remaining to this sample's cumulative counts.
+func (s *WordsRemainingSample) Publish() {
+	WordsRemaining.Reset()
+	total := 0
+	for i, bound := range WordsRemainingBuckets {
+		total += s.counts[i]
+		WordsRemaining.WithLabelValues(strconv.FormatFloat(bound, 'f', -1, 64)).Set(float64(total))
+	}
+	total += s.counts[len(WordsRemainingBuckets)]
+	WordsRemaining.WithLabelValues("+Inf").Set(float64(total))
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInitOverridesBuckets(t *testing.T) {
+	defer Init(Config{
+		RequestDurationBuckets: DefaultRequestDurationBuckets,
+		DBWriteDurationBuckets: DefaultDBWriteDurationBuckets,
+		WordsPerSecondBuckets:  DefaultWordsPerSecondBuckets,
+	})
+
+	// Only the DB write buckets are overridden
+	Init(Config{DBWriteDurationBuckets: []float64{0.1, 1}})
+	DBWriteDurationSeconds.Observe(0.5)
+
+	want := `
+# HELP db_write_duration_seconds Duration of INSERT into the requests table.
+# TYPE db_write_duration_seconds histogram
+db_write_duration_seconds_bucket{le="0.1"} 0
+db_write_duration_seconds_bucket{le="1"} 1
+db_write_duration_seconds_bucket{le="+Inf"} 1
+db_write_duration_seconds_sum 0.5
+db_write_duration_seconds_count 1
+`
+	if err := testutil.CollectAndCompare(DBWriteDurationSeconds, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	WordsPerSecond.Observe(3)
+	if err := testutil.CollectAndCompare(WordsPerSecond, strings.NewReader(`
+# HELP words_per_second Words delivered per second of wall time, per stream.
+# TYPE words_per_second histogram
+words_per_second_bucket{le="0.5"} 0
+words_per_second_bucket{le="1"} 0
+words_per_second_bucket{le="1.5"} 0
+words_per_second_bucket{le="2"} 0
+words_per_second_bucket{le="5"} 1
+words_per_second_bucket{le="10"} 1
+words_per_second_bucket{le="50"} 1
+words_per_second_bucket{le="100"} 1
+words_per_second_bucket{le="1000"} 1
+words_per_second_bucket{le="10000"} 1
+words_per_second_bucket{le="+Inf"} 1
+words_per_second_sum 3
+words_per_second_count 1
+`)); err != nil {
+		t.Fatalf("words_per_second lost its default buckets: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package accesslog
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/middleware/requestid"
+)
+
+// WordsGeneratedKey is the echo context key handlers use to report how many
+// words they streamed, so the access log can include it.
+const WordsGeneratedKey = "words_generated"
+
+// StartTimeKey holds the time.Time the request reached this middleware,
+// before auth and rate limiting, for handlers that time from arrival.
+const StartTimeKey = "request_start"
+
+// Middleware writes one structured JSON log line per request.
+func Middleware(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			c.Set(StartTimeKey, start)
+
+			err := next(c)
+			if err != nil {
+				// Let Echo write the error response so the status is final
+				c.Error(err)
+			}
+
+			req := c.Request()
+			res := c.Response()
+
+			wordsGenerated, _ := c.Get(WordsGeneratedKey).(int)
+
+			logger.Info("request",
+				slog.String("timestamp", start.UTC().Format(time.RFC3339Nano)),
+				slog.String("request_id", requestid.FromContext(req.Context())),
+				slog.String("user_id", req.Header.Get("X-User-Id")),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", res.Status),
+				slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+				slog.Int("words_generated", wordsGenerated),
+				slog.Int64("bytes_written", res.Size),
+			)
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/middleware/requestid"
+)
+
+func TestMiddlewareLogsJSONFields(t *testing.T) {
+	var buf bytes.Buffer
+	e := echo.New()
+	e.Use(requestid.Middleware(), Middleware(slog.New(slog.NewJSONHandler(&buf, nil))))
+	e.POST("/generate-data", func(c echo.Context) error {
+		c.Set(WordsGeneratedKey, 3)
+		return c.String(http.StatusOK, "one two three ")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/generate-data?seed=1", nil)
+	req.Header.Set("X-User-Id", "alice")
+	req.Header.Set(requestid.Header, "req-1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q isn't JSON: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":             "request",
+		"request_id":      "req-1",
+		"user_id":         "alice",
+		"method":          http.MethodPost,
+		"path":            "/generate-data",
+		"status":          float64(http.StatusOK),
+		"words_generated": float64(3),
+		"bytes_written":   float64(len("one two three ")),
+	}
+	for field, value := range want {
+		if line[field] != value {
+			t.Errorf("%s = %v, want %v", field, line[field], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, line["timestamp"].(string)); err != nil {
+		t.Errorf("timestamp: %v", err)
+	}
+	if _, ok := line["latency_ms"].(float64); !ok {
+		t.Errorf("latency_ms = %v, want a number", line["latency_ms"])
+	}
+}
+
+func TestMiddlewareLogsFinalErrorStatus(t *testing.T) {
+	var buf bytes.Buffer
+	e := echo.New()
+	e.Use(Middleware(slog.New(slog.NewJSONHandler(&buf, nil))))
+	e.GET("/user/stats", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "slow down")
+	})
+	e.GET("/boom", func(c echo.Context) error { return errors.New("boom") })
+
+	for path, status := range map[string]int{"/user/stats": http.StatusTooManyRequests, "/boom": http.StatusInternalServerError} {
+		buf.Reset()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var line struct {
+			Status         int `json:"status"`
+			WordsGenerated int `json:"words_generated"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Status != status || rec.Code != status || line.WordsGenerated != 0 {
+			t.Errorf("%s: logged %+v, responded %d; want status %d", path, line, rec.Code, status)
+		}
+	}
+}
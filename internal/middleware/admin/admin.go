@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Header carries the shared admin token.
+const Header = "X-Admin-Token"
+
+// Middleware guards admin routes with a shared token. With no token
+// configured the admin API is disabled entirely.
+func Middleware(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return echo.NewHTTPError(http.StatusForbidden, "Admin API is disabled")
+			}
+
+			given := c.Request().Header.Get(Header)
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid admin token")
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// KeyStore resolves an API key to the user it belongs to. Implementations
+// return sql.ErrNoRows for unknown or revoked keys.
+type KeyStore interface {
+	LookupUser(ctx context.Context, apiKey string) (string, error)
+}
+
+// Middleware requires an "Authorization: Bearer <key>" header and replaces
+// any client-supplied X-User-Id with the user that owns the key, so
+// downstream handlers and the rate limiter see the authenticated identity.
+func Middleware(store KeyStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get("Authorization")
+			apiKey, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok || apiKey == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Missing API key")
+			}
+
+			userID, err := store.LookupUser(c.Request().Context(), apiKey)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusUnauthorized, "Invalid API key")
+				}
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to verify API key")
+			}
+
+			c.Request().Header.Set("X-User-Id", userID)
+			return next(c)
+		}
+	}
+}
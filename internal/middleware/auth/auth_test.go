@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// mapKeyStore resolves keys from a map; revoked keys are absent, as the
+// database leaves them out of active lookups.
+type mapKeyStore struct {
+	users map[string]string
+	err   error
+}
+
+func (s mapKeyStore) LookupUser(ctx context.Context, apiKey string) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	userID, ok := s.users[apiKey]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+func TestMiddlewareAPIKeys(t *testing.T) {
+	store := mapKeyStore{users: map[string]string{"key-alice": "alice"}}
+	tests := []struct {
+		name          string
+		store         KeyStore
+		authorization string
+		wantStatus    int
+	}{
+		{"valid key", store, "Bearer key-alice", http.StatusOK},
+		{"missing header", store, "", http.StatusUnauthorized},
+		{"empty key", store, "Bearer ", http.StatusUnauthorized},
+		{"wrong scheme", store, "Basic key-alice", http.StatusUnauthorized},
+		{"revoked key", store, "Bearer key-revoked", http.StatusUnauthorized},
+		{"store down", mapKeyStore{err: errors.New("connection refused")}, "Bearer key-alice", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.GET("/user/stats", func(c echo.Context) error {
+				return c.String(http.StatusOK, c.Request().Header.Get("X-User-Id"))
+			}, Middleware(tt.store))
+
+			req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+			req.Header.Set("X-User-Id", "mallory")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			// The key's owner replaces the client-supplied X-User-Id
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != "alice" {
+				t.Fatalf("handler saw user %q, want alice", rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Minimum gap between JWKS fetches, so tokens with unknown key IDs can't
+// make every request hit the identity provider
+const jwksRefreshInterval = time.Minute
+
+// JWKSVerifier accepts RS256/RS384/RS512 tokens signed by any RSA key in a
+// JSON Web Key Set. Keys are fetched on first use and refetched when a
+// token names a key ID that isn't known yet, to pick up rotations.
+type JWKSVerifier struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	fetching  chan struct{} // closed when the fetch in flight ends; nil if none
+}
+
+func NewJWKSVerifier(url string) *JWKSVerifier {
+	return &JWKSVerifier{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (v *JWKSVerifier) Verify(token string) (string, error) {
+	return parseSubject(token, rsaAlgorithms, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(kid)
+	})
+}
+
+// key returns the public key for kid, fetching the key set if kid is new.
+// The fetch runs without the lock, so tokens signed with known keys are
+// never held up by a slow identity provider; concurrent lookups of unknown
+// keys wait for the one fetch in flight instead of starting their own.
+func (v *JWKSVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	if key, ok := v.keys[kid]; ok {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		<-done
+		return v.cachedKey(kid)
+	}
+	if time.Since(v.fetchedAt) < jwksRefreshInterval {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	v.fetchedAt = time.Now()
+	done := make(chan struct{})
+	v.fetching = done
+	v.mu.Unlock()
+
+	keys, err := v.fetch()
+
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetching = nil
+	v.mu.Unlock()
+	close(done)
+
+	if err != nil {
+		return nil, err
+	}
+	return v.cachedKey(kid)
+}
+
+func (v *JWKSVerifier) cachedKey(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// fetch downloads the key set; non-RSA keys are skipped.
+func (v *JWKSVerifier) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := v.client.Get(v.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent for key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
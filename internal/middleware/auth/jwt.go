@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+// TokenVerifier checks a bearer JWT and returns its subject. Any error
+// (bad signature, expired, missing sub) means the token is rejected.
+type TokenVerifier interface {
+	Verify(token string) (string, error)
+}
+
+// Signing algorithms each verifier accepts. The parser rejects any other
+// alg, "none" included, before the key is looked up.
+var (
+	hmacAlgorithms = []string{"HS256", "HS384", "HS512"}
+	rsaAlgorithms  = []string{"RS256", "RS384", "RS512"}
+)
+
+// HMACVerifier accepts HS256/HS384/HS512 tokens signed with a shared secret.
+type HMACVerifier struct {
+	secret []byte
+}
+
+func NewHMACVerifier(secret []byte) *HMACVerifier {
+	return &HMACVerifier{secret: secret}
+}
+
+func (v *HMACVerifier) Verify(token string) (string, error) {
+	return parseSubject(token, hmacAlgorithms, func(t *jwt.Token) (interface{}, error) {
+		return v.secret, nil
+	})
+}
+
+// parseSubject checks that the token uses one of algorithms, validates the
+// signature and the exp/nbf/iat claims, then returns sub. exp is required.
+func parseSubject(token string, algorithms []string, keyFunc jwt.Keyfunc) (string, error) {
+	parser := jwt.Parser{ValidMethods: algorithms}
+	var claims jwt.StandardClaims
+	if _, err := parser.ParseWithClaims(token, &claims, keyFunc); err != nil {
+		return "", err
+	}
+	// StandardClaims only checks exp when it is present, so a token without
+	// one would be accepted forever
+	if claims.ExpiresAt == 0 {
+		return "", errors.New("token has no exp claim")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no sub claim")
+	}
+	return claims.Subject, nil
+}
+
+// JWTMiddleware requires an "Authorization: Bearer <jwt>" header and
+// replaces any client-supplied X-User-Id with the token's sub claim, so
+// downstream handlers and the rate limiter see the verified identity.
+func JWTMiddleware(verifier TokenVerifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get("Authorization")
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok || token == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Missing bearer token")
+			}
+
+			userID, err := verifier.Verify(token)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired token")
+			}
+
+			c.Request().Header.Set("X-User-Id", userID)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func signHMAC(t *testing.T, secret []byte, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHMACVerifier(t *testing.T) {
+	secret := []byte("secret")
+	v := NewHMACVerifier(secret)
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "alice", "exp": future}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantSub string
+	}{
+		{"valid", signHMAC(t, secret, jwt.MapClaims{"sub": "alice", "exp": future}), "alice"},
+		{"expired", signHMAC(t, secret, jwt.MapClaims{"sub": "alice", "exp": past}), ""},
+		{"no exp", signHMAC(t, secret, jwt.MapClaims{"sub": "alice"}), ""},
+		{"no sub", signHMAC(t, secret, jwt.MapClaims{"exp": future}), ""},
+		{"wrong secret", signHMAC(t, []byte("other"), jwt.MapClaims{"sub": "alice", "exp": future}), ""},
+		{"alg none", unsigned, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := v.Verify(tt.token)
+			if tt.wantSub == "" {
+				if err == nil {
+					t.Fatalf("Verify accepted the token as %q", sub)
+				}
+				return
+			}
+			if err != nil || sub != tt.wantSub {
+				t.Fatalf("Verify = %q, %v; want %q", sub, err, tt.wantSub)
+			}
+		})
+	}
+}
+
+// jwksServer serves key under kid, taking delay to answer.
+func jwksServer(t *testing.T, kid string, key *rsa.PublicKey, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWKSVerifierRejectsHMAC(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewJWKSVerifier(jwksServer(t, "k1", &key.PublicKey, 0).URL)
+
+	if sub, err := v.Verify(signRSA(t, key, "k1")); err != nil || sub != "alice" {
+		t.Fatalf("Verify = %q, %v; want alice", sub, err)
+	}
+	// An HS256 token "signed" with the public key must not pass as RS256
+	hmacToken := signHMAC(t, key.PublicKey.N.Bytes(), jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := v.Verify(hmacToken); err == nil {
+		t.Fatal("Verify accepted an HS256 token")
+	}
+}
+
+func TestJWKSVerifierKnownKeyDoesNotWaitForFetch(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewJWKSVerifier(jwksServer(t, "k1", &key.PublicKey, time.Second).URL)
+	// Known key already cached; the next fetch (for an unknown kid) is slow
+	v.keys = map[string]*rsa.PublicKey{"k1": &key.PublicKey}
+
+	go v.Verify(signRSA(t, key, "unknown"))
+	time.Sleep(50 * time.Millisecond) // let the slow fetch start
+
+	start := time.Now()
+	if _, err := v.Verify(signRSA(t, key, "k1")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("verifying with a known key took %s, waiting on the fetch", elapsed)
+	}
+}
@@ -1,23 +1,87 @@
 package ratelimit
 
 import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"manifold-test/internal/apierror"
+	appmetrics "manifold-test/internal/metrics"
 )
 
+// MaxWaitHeader lets a client shorten how long it queues for the limiter.
+const MaxWaitHeader = "X-Max-Wait"
+
 type UserCounter struct {
 	Count     int
 	LastReset time.Time
+
+	elem *list.Element // position in RateLimiter.recent
 }
 
+// Clock supplies the current time. The real clock's readings carry Go's
+// monotonic component, so window arithmetic ignores wall-clock steps.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
 type RateLimiter struct {
-	counters map[string]*UserCounter
-	mu       sync.RWMutex
+	counters     map[string]*UserCounter
+	limits       map[string]int
+	defaultLimit int
+	exempt       map[string]bool
+	timed        map[string]bool // routes whose rejections feed request_duration_seconds
+	clock        Clock
+	mu           sync.RWMutex
+
+	// Counter keys, most recently used first, for evicting the least
+	// recently used once maxTracked is reached; 0 means no cap
+	recent     *list.List
+	maxTracked int
+
+	// Longest a request over its limit may wait for its window to free up
+	// before it is rejected; 0 rejects at once
+	maxWait time.Duration
+
+	// What the middleware keys on ("" passes the request through) and the
+	// metrics it reports to; per user unless built with NewIPRateLimiter
+	key     func(c echo.Context) string
+	dropped prometheus.Counter
+	tracked prometheus.Gauge
+}
+
+// NewRateLimiter builds a limiter with a per-minute budget for each endpoint.
+// Endpoints missing from limits fall back to defaultLimit.
+func NewRateLimiter(defaultLimit int, limits map[string]int) *RateLimiter {
+	return NewRateLimiterWithClock(realClock{}, defaultLimit, limits)
 }
 
-func NewRateLimiter() *RateLimiter {
+// NewRateLimiterWithClock is NewRateLimiter with an injectable time source.
+func NewRateLimiterWithClock(clock Clock, defaultLimit int, limits map[string]int) *RateLimiter {
 	rl := &RateLimiter{
-		counters: make(map[string]*UserCounter),
+		counters:     make(map[string]*UserCounter),
+		limits:       limits,
+		defaultLimit: defaultLimit,
+		exempt:       make(map[string]bool),
+		timed:        make(map[string]bool),
+		clock:        clock,
+		recent:       list.New(),
+		key:          userKey,
+		dropped:      appmetrics.RateLimitDroppedTotal,
+		tracked:      appmetrics.RateLimiterTrackedUsers,
+	}
+	if rl.limits == nil {
+		rl.limits = make(map[string]int)
 	}
 
 	go func() {
@@ -31,45 +95,237 @@ func NewRateLimiter() *RateLimiter {
 	return rl
 }
 
-func (rl *RateLimiter) IsAllowed(userID string) bool {
+// NewIPRateLimiter builds a limiter keyed on the client IP (c.RealIP, so
+// configure Echo's IPExtractor for trusted proxies) with the same per-minute
+// budget on every endpoint. It stops clients that rotate X-User-Id.
+func NewIPRateLimiter(limit int) *RateLimiter {
+	rl := NewRateLimiter(limit, nil)
+	rl.key = ipKey
+	rl.dropped = appmetrics.RateLimitIPDroppedTotal
+	rl.tracked = appmetrics.RateLimiterTrackedIPs
+	return rl
+}
+
+func userKey(c echo.Context) string {
+	return c.Request().Header.Get("X-User-Id")
+}
+
+func ipKey(c echo.Context) string {
+	return c.RealIP()
+}
+
+// Limit returns the per-minute budget configured for endpoint.
+func (rl *RateLimiter) Limit(endpoint string) int {
+	if limit, ok := rl.limits[endpoint]; ok {
+		return limit
+	}
+	return rl.defaultLimit
+}
+
+// Exempt lets requests from userIDs through without counting them. Call it
+// before the limiter starts serving.
+func (rl *RateLimiter) Exempt(userIDs ...string) {
+	for _, id := range userIDs {
+		rl.exempt[id] = true
+	}
+}
+
+// TimeRoutes records rejected requests on these route paths in
+// request_duration_seconds with outcome rate_limited, alongside the outcomes
+// their handlers record. Other routes are only counted as dropped. Call it
+// before the limiter starts serving.
+func (rl *RateLimiter) TimeRoutes(paths ...string) {
+	for _, path := range paths {
+		rl.timed[path] = true
+	}
+}
+
+// SetMaxTracked caps how many (key, endpoint) counters are held; past the
+// cap the least recently used is evicted, and that key simply starts a fresh
+// window on its next request. It bounds memory when a flood of unique user
+// IDs arrives faster than cleanup runs. 0 removes the cap. Call it before
+// the limiter starts serving.
+func (rl *RateLimiter) SetMaxTracked(n int) {
+	rl.maxTracked = n
+}
+
+// SetMaxWait lets requests over their limit queue for up to d, or less if
+// they send a shorter X-Max-Wait, instead of being rejected straight away.
+// Call it before the limiter starts serving.
+func (rl *RateLimiter) SetMaxWait(d time.Duration) {
+	rl.maxWait = d
+}
+
+// IsAllowed counts a request against the (userID, endpoint) budget so each
+// route is limited independently.
+func (rl *RateLimiter) IsAllowed(userID, endpoint string) bool {
+	allowed, _ := rl.allow(userID, endpoint)
+	return allowed
+}
+
+// Wait is IsAllowed that, when the budget is spent, blocks until the window
+// resets and tries again, as long as that happens within maxWait. It
+// returns false once waiting longer wouldn't help or ctx is done.
+func (rl *RateLimiter) Wait(ctx context.Context, userID, endpoint string, maxWait time.Duration) bool {
+	deadline := rl.clock.Now().Add(maxWait)
+	for {
+		allowed, retryIn := rl.allow(userID, endpoint)
+		if allowed {
+			return true
+		}
+		if retryIn < 0 || rl.clock.Now().Add(retryIn).After(deadline) {
+			return false
+		}
+
+		timer := time.NewTimer(retryIn)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// allow implements IsAllowed. When it refuses, retryIn is how long until
+// the window resets, or -1 if the endpoint allows nothing at all.
+func (rl *RateLimiter) allow(userID, endpoint string) (allowed bool, retryIn time.Duration) {
+	if rl.exempt[userID] {
+		return true, 0
+	}
+
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	counter, exists := rl.counters[userID]
+	now := rl.clock.Now()
+	key := userID + "|" + endpoint
+	limit := rl.Limit(endpoint)
+	counter, exists := rl.counters[key]
 
 	if !exists {
-		rl.counters[userID] = &UserCounter{
+		if limit <= 0 {
+			return false, -1
+		}
+		if rl.maxTracked > 0 && len(rl.counters) >= rl.maxTracked {
+			oldest := rl.recent.Remove(rl.recent.Back()).(string)
+			delete(rl.counters, oldest)
+		}
+		rl.counters[key] = &UserCounter{
 			Count:     1,
 			LastReset: now,
+			elem:      rl.recent.PushFront(key),
 		}
-		return true
+		rl.tracked.Set(float64(len(rl.counters)))
+		return true, 0
 	}
+	rl.recent.MoveToFront(counter.elem)
 
-	// Reset counter if a minute has passed
-	if now.Sub(counter.LastReset) >= time.Minute {
+	elapsed := now.Sub(counter.LastReset)
+
+	// Reset counter if a minute has passed. A clock that went backwards
+	// starts a fresh window too: keeping the count against a window restarted
+	// from now would hold it for up to a minute past its original end
+	if elapsed >= time.Minute || elapsed < 0 {
 		counter.Count = 1
 		counter.LastReset = now
-		return true
+		return true, 0
 	}
 
-	// Check if under limit (100 requests per minute)
-	if counter.Count >= 100 {
-		return false
+	// Check if under the endpoint's per-minute limit
+	if counter.Count >= limit {
+		return false, time.Minute - elapsed
 	}
 
 	counter.Count++
-	return true
+	return true, 0
+}
+
+// Middleware enforces the limit for the matched route. Requests without
+// X-User-Id (or, for an IP limiter, without an IP) are passed through so the
+// handler can reject them.
+func (rl *RateLimiter) Middleware() echo.MiddlewareFunc {
+	return rl.middleware(func(c echo.Context) string { return c.Path() })
+}
+
+// RateLimitFor is Middleware counting against the named route instead of
+// the matched path, with a per-minute budget of limit. Every route it is
+// attached to shares one counter per user, so routes that do the same work
+// can't be used to multiply a user's budget. Call it before the limiter
+// starts serving.
+func (rl *RateLimiter) RateLimitFor(routeName string, limit int) echo.MiddlewareFunc {
+	rl.limits[routeName] = limit
+	return rl.middleware(func(echo.Context) string { return routeName })
+}
+
+// middleware enforces the limit for the endpoint that route names.
+func (rl *RateLimiter) middleware(route func(c echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := rl.key(c)
+			if key == "" {
+				return next(c)
+			}
+
+			start := time.Now()
+			endpoint := route(c)
+			allowed := rl.IsAllowed(key, endpoint)
+			if !allowed && rl.maxWait > 0 {
+				maxWait, err := rl.requestMaxWait(c)
+				if err != nil {
+					return err
+				}
+				allowed = rl.Wait(c.Request().Context(), key, endpoint, maxWait)
+				appmetrics.RateLimitWaitsTotal.WithLabelValues(strconv.FormatBool(allowed)).Inc()
+			}
+			if !allowed {
+				rl.dropped.Inc()
+				if rl.timed[c.Path()] {
+					appmetrics.RequestDurationSeconds.WithLabelValues("rate_limited").Observe(time.Since(start).Seconds())
+				}
+				return apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// requestMaxWait is how long this request may wait for its window: the
+// server's maxWait, or a shorter X-Max-Wait (milliseconds) from the client.
+func (rl *RateLimiter) requestMaxWait(c echo.Context) (time.Duration, error) {
+	value := c.Request().Header.Get(MaxWaitHeader)
+	if value == "" {
+		return rl.maxWait, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, MaxWaitHeader+" must be a non-negative integer")
+	}
+	return min(time.Duration(ms)*time.Millisecond, rl.maxWait), nil
 }
 
 func (rl *RateLimiter) cleanup() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	for userID, counter := range rl.counters {
+	now := rl.clock.Now()
+	for key, counter := range rl.counters {
 		if now.Sub(counter.LastReset) >= time.Minute {
-			delete(rl.counters, userID)
+			rl.recent.Remove(counter.elem)
+			delete(rl.counters, key)
 		}
 	}
-} 
\ No newline at end of file
+	rl.tracked.Set(float64(len(rl.counters)))
+}
+
+// Tracked returns the number of (user, route) counters currently held.
+func (rl *RateLimiter) Tracked() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return len(rl.counters)
+}
+
+// DebugHandler reports the limiter's size as JSON, for admin diagnostics.
+func (rl *RateLimiter) DebugHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]int{"tracked": rl.Tracked()})
+}
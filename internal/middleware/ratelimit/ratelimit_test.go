@@ -0,0 +1,337 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	appmetrics "manifold-test/internal/metrics"
+)
+
+func TestMiddlewareTimesOnlyGenerateRoutes(t *testing.T) {
+	// Fresh histogram, so earlier observations don't count
+	appmetrics.Init(appmetrics.Config{RequestDurationBuckets: appmetrics.DefaultRequestDurationBuckets})
+
+	rl := NewRateLimiter(0, nil)
+	rl.TimeRoutes("/generate-data")
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/user/stats", ok, rl.Middleware())
+	e.POST("/generate-data", ok, rl.Middleware())
+
+	request := func(method, path string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User-Id", "alice")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s %s: status = %d, want 429", method, path, rec.Code)
+		}
+	}
+
+	request(http.MethodGet, "/user/stats")
+	if n := testutil.CollectAndCount(appmetrics.RequestDurationSeconds); n != 0 {
+		t.Fatalf("a rejected /user/stats was recorded in request_duration_seconds (%d series)", n)
+	}
+	request(http.MethodPost, "/generate-data")
+	if n := testutil.CollectAndCount(appmetrics.RequestDurationSeconds); n != 1 {
+		t.Fatalf("a rejected /generate-data was not recorded (%d series)", n)
+	}
+}
+
+// fakeClock is a Clock the test moves by hand.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestAllowClockStepBack(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	rl := NewRateLimiterWithClock(clock, 2, nil)
+
+	rl.IsAllowed("alice", "/generate-data")
+	rl.IsAllowed("alice", "/generate-data")
+	if rl.IsAllowed("alice", "/generate-data") {
+		t.Fatal("third request in the window was allowed")
+	}
+
+	// Step the clock back 30s: the spent budget must not be held for a
+	// window that now ends more than a minute away
+	clock.now = clock.now.Add(-30 * time.Second)
+	if allowed, _ := rl.allow("alice", "/generate-data"); !allowed {
+		t.Fatal("request after the clock stepped back was refused")
+	}
+	rl.IsAllowed("alice", "/generate-data")
+	allowed, retryIn := rl.allow("alice", "/generate-data")
+	if allowed {
+		t.Fatal("the fresh window allowed more than its limit")
+	}
+	if retryIn > time.Minute {
+		t.Fatalf("retry in %s, longer than a window", retryIn)
+	}
+}
+
+func TestEndpointsHaveIndependentBudgets(t *testing.T) {
+	rl := NewRateLimiterWithClock(&fakeClock{now: time.Unix(1_700_000_000, 0)}, 5, map[string]int{
+		"/generate-data": 2,
+		"/user/stats":    3,
+	})
+
+	allowed := func(user, endpoint string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if rl.IsAllowed(user, endpoint) {
+				count++
+			}
+		}
+		return count
+	}
+
+	if got := allowed("alice", "/generate-data", 10); got != 2 {
+		t.Fatalf("/generate-data allowed %d, want 2", got)
+	}
+	// Spending one endpoint's budget leaves the others untouched
+	if got := allowed("alice", "/user/stats", 10); got != 3 {
+		t.Fatalf("/user/stats allowed %d, want 3", got)
+	}
+	if got := allowed("alice", "/generate", 10); got != 5 {
+		t.Fatalf("unconfigured endpoint allowed %d, want the default 5", got)
+	}
+	// and other users
+	if got := allowed("bob", "/generate-data", 10); got != 2 {
+		t.Fatalf("bob's /generate-data allowed %d, want 2", got)
+	}
+}
+
+func TestZeroLimitRefusesEndpoint(t *testing.T) {
+	rl := NewRateLimiter(5, map[string]int{"/generate-data": 0})
+	if allowed, retryIn := rl.allow("alice", "/generate-data"); allowed || retryIn != -1 {
+		t.Fatalf("allow = %v, %s; want refused with no retry", allowed, retryIn)
+	}
+}
+
+func TestMaxTrackedEvictsLeastRecentlyUsed(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	rl := NewRateLimiterWithClock(clock, 1, nil)
+	rl.SetMaxTracked(2)
+
+	rl.IsAllowed("alice", "/generate-data")
+	rl.IsAllowed("bob", "/generate-data")
+	rl.IsAllowed("alice", "/generate-data") // refused, but marks alice recently used
+	rl.IsAllowed("carol", "/generate-data") // evicts bob
+
+	if n := rl.Tracked(); n != 2 {
+		t.Fatalf("tracking %d counters, want 2", n)
+	}
+	if rl.IsAllowed("alice", "/generate-data") {
+		t.Fatal("alice's counter was evicted instead of the least recently used")
+	}
+	// Bob was evicted, so he starts a fresh window
+	if !rl.IsAllowed("bob", "/generate-data") {
+		t.Fatal("bob's counter survived eviction")
+	}
+	if n := rl.Tracked(); n != 2 {
+		t.Fatalf("tracking %d counters after re-adding bob, want 2", n)
+	}
+}
+
+func TestMaxTrackedZeroIsUnbounded(t *testing.T) {
+	rl := NewRateLimiter(1, nil)
+	for i := 0; i < 100; i++ {
+		rl.IsAllowed(fmt.Sprintf("user-%d", i), "/generate-data")
+	}
+	if n := rl.Tracked(); n != 100 {
+		t.Fatalf("tracking %d counters, want 100", n)
+	}
+}
+
+func TestRateLimitForSharesCounterAcrossRoutes(t *testing.T) {
+	rl := NewRateLimiter(100, nil)
+	streams := rl.RateLimitFor("streams", 2)
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.POST("/a", ok, streams)
+	e.POST("/b", ok, streams)
+	e.GET("/stats", ok, rl.RateLimitFor("stats", 1))
+
+	status := func(method, path, user string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User-Id", user)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if status(http.MethodPost, "/a", "alice") != http.StatusOK || status(http.MethodPost, "/b", "alice") != http.StatusOK {
+		t.Fatal("first two requests on the shared route name were refused")
+	}
+	if code := status(http.MethodPost, "/a", "alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("third request across /a and /b: status = %d, want 429", code)
+	}
+	// Other route names and other users keep their own counters
+	if code := status(http.MethodGet, "/stats", "alice"); code != http.StatusOK {
+		t.Fatalf("/stats status = %d, want 200", code)
+	}
+	if code := status(http.MethodPost, "/b", "bob"); code != http.StatusOK {
+		t.Fatalf("bob's /b status = %d, want 200", code)
+	}
+	if n := rl.Tracked(); n != 3 {
+		t.Fatalf("tracking %d counters, want one per user and route name", n)
+	}
+}
+
+func TestIPLimiterThrottlesRotatingUserIDs(t *testing.T) {
+	ipLimiter := NewIPRateLimiter(3)
+	userLimiter := NewRateLimiter(100, nil)
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.POST("/generate-data", func(c echo.Context) error { return c.NoContent(http.StatusOK) },
+		ipLimiter.Middleware(), userLimiter.Middleware())
+
+	status := func(remoteAddr, user, forwardedFor string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/generate-data", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-User-Id", user)
+		if forwardedFor != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	dropped := testutil.ToFloat64(appmetrics.RateLimitIPDroppedTotal)
+	for i := 0; i < 3; i++ {
+		if code := status("203.0.113.7:4000", fmt.Sprintf("user%d", i), ""); code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, code)
+		}
+	}
+	// A fresh user ID, or a spoofed X-Forwarded-For from an untrusted
+	// client, doesn't buy more requests from the same IP
+	if code := status("203.0.113.7:4000", "user3", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("rotated user ID: status = %d, want 429", code)
+	}
+	if code := status("203.0.113.7:4001", "user4", "198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed X-Forwarded-For: status = %d, want 429", code)
+	}
+	if got := testutil.ToFloat64(appmetrics.RateLimitIPDroppedTotal) - dropped; got != 2 {
+		t.Fatalf("rate_limit_ip_dropped_total grew by %v, want 2", got)
+	}
+
+	// Another IP has its own budget
+	if code := status("198.51.100.9:4000", "user0", ""); code != http.StatusOK {
+		t.Fatalf("other IP: status = %d, want 200", code)
+	}
+}
+
+func TestExemptUsersSkipTheLimit(t *testing.T) {
+	rl := NewRateLimiter(0, nil)
+	rl.Exempt("loadtest")
+	e := echo.New()
+	e.GET("/user/stats", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, rl.Middleware())
+
+	for user, want := range map[string]int{"loadtest": http.StatusOK, "alice": http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+		req.Header.Set("X-User-Id", user)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", user, rec.Code, want)
+		}
+	}
+}
+
+func TestTrackedGaugeAndDebugHandler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	rl := NewRateLimiterWithClock(clock, 5, nil)
+	rl.IsAllowed("alice", "/generate-data")
+	rl.IsAllowed("alice", "/user/stats")
+	rl.IsAllowed("bob", "/generate-data")
+
+	if got := testutil.ToFloat64(appmetrics.RateLimiterTrackedUsers); got != 3 {
+		t.Fatalf("rate_limiter_tracked_users = %v, want 3", got)
+	}
+
+	e := echo.New()
+	debug := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/ratelimit", nil))
+		return strings.TrimSpace(rec.Body.String())
+	}
+	e.GET("/debug/ratelimit", rl.DebugHandler)
+	if body := debug(); body != `{"tracked":3}` {
+		t.Fatalf("debug body = %s, want {\"tracked\":3}", body)
+	}
+
+	// Expired windows are dropped from both
+	clock.now = clock.now.Add(time.Minute)
+	rl.cleanup()
+	if got := testutil.ToFloat64(appmetrics.RateLimiterTrackedUsers); got != 0 {
+		t.Fatalf("rate_limiter_tracked_users after cleanup = %v, want 0", got)
+	}
+	if body := debug(); body != `{"tracked":0}` {
+		t.Fatalf("debug body after cleanup = %s, want {\"tracked\":0}", body)
+	}
+}
+
+// shiftedClock is the real clock moved by shift, so Wait's real timers
+// still move it forward.
+type shiftedClock struct{ shift time.Duration }
+
+func (c *shiftedClock) Now() time.Time { return time.Now().Add(c.shift) }
+
+func TestMaxWait(t *testing.T) {
+	clock := &shiftedClock{}
+	rl := NewRateLimiterWithClock(clock, 1, nil)
+	rl.SetMaxWait(time.Second)
+	e := echo.New()
+	e.GET("/user/stats", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, rl.Middleware())
+
+	request := func(maxWait string) (int, time.Duration) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+		req.Header.Set("X-User-Id", "alice")
+		if maxWait != "" {
+			req.Header.Set(MaxWaitHeader, maxWait)
+		}
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		e.ServeHTTP(rec, req)
+		return rec.Code, time.Since(start)
+	}
+
+	if code, _ := request(""); code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want 200", code)
+	}
+
+	// The window frees up in 50ms: within the server's wait but not the client's
+	clock.shift = time.Minute - 50*time.Millisecond
+	timedOut := testutil.ToFloat64(appmetrics.RateLimitWaitsTotal.WithLabelValues("false"))
+	if code, took := request("10"); code != http.StatusTooManyRequests || took > 40*time.Millisecond {
+		t.Fatalf("X-Max-Wait 10: status = %d after %v, want an immediate 429", code, took)
+	}
+	if got := testutil.ToFloat64(appmetrics.RateLimitWaitsTotal.WithLabelValues("false")) - timedOut; got != 1 {
+		t.Fatalf("timed-out waits = %v, want 1", got)
+	}
+
+	waited := testutil.ToFloat64(appmetrics.RateLimitWaitsTotal.WithLabelValues("true"))
+	if code, took := request(""); code != http.StatusOK || took < 40*time.Millisecond {
+		t.Fatalf("default wait: status = %d after %v, want 200 after about 50ms", code, took)
+	}
+	if got := testutil.ToFloat64(appmetrics.RateLimitWaitsTotal.WithLabelValues("true")) - waited; got != 1 {
+		t.Fatalf("successful waits = %v, want 1", got)
+	}
+
+	if code, _ := request("soon"); code != http.StatusBadRequest {
+		t.Fatalf("invalid %s: status = %d, want 400", MaxWaitHeader, code)
+	}
+}
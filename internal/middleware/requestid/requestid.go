@@ -0,0 +1,98 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Header carries the correlation ID in both directions.
+const Header = echo.HeaderXRequestID
+
+// Longest client-supplied ID that is accepted; longer ones are replaced
+const maxLength = 128
+
+type ctxKey struct{}
+
+// Middleware takes the caller's X-Request-Id, or generates a UUID, stores it
+// in the request context and echoes it in the response header.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			id := req.Header.Get(Header)
+			if !valid(id) {
+				id = newID()
+			}
+
+			c.Response().Header().Set(Header, id)
+			c.SetRequest(req.WithContext(WithID(req.Context(), id)))
+			return next(c)
+		}
+	}
+}
+
+// WithID returns a copy of ctx carrying id, e.g. to hand the ID to
+// background work that outlives the request.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// LogHandler wraps an slog.Handler so records logged with a context (e.g.
+// slog.InfoContext) carry the request ID in ctx as a request_id attribute.
+type LogHandler struct {
+	slog.Handler
+}
+
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// valid accepts non-empty IDs of printable ASCII so a client can't inject
+// line breaks or control characters into the logs.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newID returns a random (version 4) UUID.
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("requestid: crypto/rand failed: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
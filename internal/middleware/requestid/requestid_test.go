@@ -0,0 +1,82 @@
+package requestid
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// serve runs one request carrying header (if any) through the middleware
+// and returns the response header and the ID the handler logged with.
+func serve(t *testing.T, header string) (string, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil)))
+
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error {
+		logger.InfoContext(c.Request().Context(), "handled")
+		return c.NoContent(http.StatusOK)
+	}, Middleware())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		req.Header.Set(Header, header)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q: %v", buf.String(), err)
+	}
+	return rec.Header().Get(Header), line
+}
+
+func TestClientIDIsEchoedAndLogged(t *testing.T) {
+	id, line := serve(t, "req-123")
+	if id != "req-123" {
+		t.Fatalf("response %s = %q, want req-123", Header, id)
+	}
+	if line["request_id"] != "req-123" {
+		t.Fatalf("log line request_id = %v, want req-123", line["request_id"])
+	}
+}
+
+func TestMissingIDIsGenerated(t *testing.T) {
+	id, line := serve(t, "")
+	if !uuidPattern.MatchString(id) {
+		t.Fatalf("generated ID %q is not a v4 UUID", id)
+	}
+	if line["request_id"] != id {
+		t.Fatalf("log line request_id = %v, want %s", line["request_id"], id)
+	}
+}
+
+func TestInvalidIDIsReplaced(t *testing.T) {
+	for _, bad := range []string{"has space", "tab\there", strings.Repeat("x", maxLength+1)} {
+		if id, _ := serve(t, bad); id == bad || !uuidPattern.MatchString(id) {
+			t.Errorf("ID %q was kept as %q, want a fresh UUID", bad, id)
+		}
+	}
+}
+
+func TestLogHandlerWithoutID(t *testing.T) {
+	var buf bytes.Buffer
+	slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil))).With("component", "test").Info("no request")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Fatalf("log line without a request carries request_id: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"component":"test"`) {
+		t.Fatalf("WithAttrs dropped the attribute: %s", buf.String())
+	}
+}
@@ -0,0 +1,65 @@
+package userid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/apierror"
+)
+
+// Header names the user a request acts for. Auth middleware overwrites it
+// with the authenticated user, so Middleware must run after auth.
+const Header = "X-User-Id"
+
+// Longest accepted ID, the width of users.user_id
+const maxLength = 255
+
+type ctxKey struct{}
+
+// Middleware rejects requests whose X-User-Id is missing, too long or uses
+// characters outside letters, digits and ._-@+ with 400, and stores the
+// ID in the request context for FromContext. The character set keeps IDs
+// safe to put in logs and cache keys, and free of the separators those
+// keys use.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			id := req.Header.Get(Header)
+			if id == "" {
+				return apierror.New(http.StatusBadRequest, apierror.CodeMissingUserID, "X-User-Id header is required")
+			}
+			if !Valid(id) {
+				return apierror.New(http.StatusBadRequest, apierror.CodeInvalidUserID, "X-User-Id must be at most 255 letters, digits or ._-@+ characters")
+			}
+
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), ctxKey{}, id)))
+			return next(c)
+		}
+	}
+}
+
+// FromContext returns the user ID stored by Middleware, or "" if there is
+// none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// Valid reports whether id is an acceptable user ID.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch ch := id[i]; {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		case ch == '.', ch == '_', ch == '-', ch == '@', ch == '+':
+		default:
+			return false
+		}
+	}
+	return true
+}
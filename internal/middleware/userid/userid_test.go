@@ -0,0 +1,60 @@
+package userid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"manifold-test/internal/apierror"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.Handler
+	e.GET("/user/stats", func(c echo.Context) error {
+		return c.String(http.StatusOK, FromContext(c.Request().Context()))
+	}, Middleware())
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode string // "" for success
+	}{
+		{"valid", "alice.smith+test@example.com", ""},
+		{"longest allowed", strings.Repeat("a", maxLength), ""},
+		{"empty", "", apierror.CodeMissingUserID},
+		{"too long", strings.Repeat("a", maxLength+1), apierror.CodeInvalidUserID},
+		{"space", "alice smith", apierror.CodeInvalidUserID},
+		{"cache key separator", "alice:admin", apierror.CodeInvalidUserID},
+		{"rate limit key separator", "alice|generate", apierror.CodeInvalidUserID},
+		{"non-ASCII", "alicé", apierror.CodeInvalidUserID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/user/stats", nil)
+			req.Header.Set(Header, tt.id)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if tt.wantCode == "" {
+				if rec.Code != http.StatusOK || rec.Body.String() != tt.id {
+					t.Fatalf("status = %d, body %q; want 200 with the ID", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			var body struct {
+				Error apierror.Error `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusBadRequest || body.Error.Code != tt.wantCode {
+				t.Fatalf("status = %d, code %q; want 400 %s", rec.Code, body.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -8,16 +8,28 @@ type User struct {
 	UserID     string    `json:"user_id" db:"user_id"`
 	WordsLeft  int       `json:"words_left" db:"words_left"`
 	TotalWords int       `json:"total_words" db:"total_words"`
+	Profile    string    `json:"profile" db:"profile"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type Request struct {
-	ID        int       `json:"id" db:"id"`
-	UserID    string    `json:"user_id" db:"user_id"`
-	Data      string    `json:"data" db:"data"`
-	Duration  float64   `json:"duration" db:"duration"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID         int       `json:"id" db:"id"`
+	RequestID  string    `json:"request_id" db:"request_id"`
+	UserID     string    `json:"user_id" db:"user_id"`
+	Data       string    `json:"data" db:"data"`
+	DurationMs int64     `json:"duration_ms" db:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// RequestPage is one page of a user's requests, with what is needed to
+// fetch the rest.
+type RequestPage struct {
+	Requests []Request `json:"requests"`
+	Total    int       `json:"total"` // matching requests across all pages
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
+	HasMore  bool      `json:"has_more"`
 }
 
 type UserStats struct {
@@ -27,9 +39,53 @@ type UserStats struct {
 	WordsUsed  int    `json:"words_used"`
 }
 
+// GlobalStats aggregates usage across all users.
+type GlobalStats struct {
+	TotalUsers          int64   `json:"total_users"`
+	TotalRequests       int64   `json:"total_requests"`
+	TotalWordsGenerated int64   `json:"total_words_generated"`
+	AvgDurationMs       float64 `json:"avg_duration_ms"`
+}
+
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp string `json:"timestamp"`
-	Database  string `json:"database"`
-	Redis     string `json:"redis"`
-} 
\ No newline at end of file
+	Status    string       `json:"status"`
+	Timestamp string       `json:"timestamp"`
+	Database  string       `json:"database"`
+	Redis     string       `json:"redis"`
+	DBPool    *DBPoolStats `json:"db_pool,omitempty"`
+}
+
+// DBPoolStats is the subset of sql.DBStats that shows pool saturation.
+type DBPoolStats struct {
+	MaxOpen        int   `json:"max_open"`
+	Open           int   `json:"open"`
+	InUse          int   `json:"in_use"`
+	Idle           int   `json:"idle"`
+	WaitCount      int64 `json:"wait_count"`
+	WaitDurationMs int64 `json:"wait_duration_ms"`
+}
+
+// GenerateResponse is a whole generation returned in one body. Partial is
+// set when the stream timeout cut it short.
+type GenerateResponse struct {
+	Text       string `json:"text"`
+	Words      int    `json:"words"`
+	RequestID  string `json:"request_id"`
+	StopReason string `json:"stop_reason"`
+	Partial    bool   `json:"partial"`
+}
+
+// ActiveStream is a generation in flight, as listed by GET /admin/streams.
+type ActiveStream struct {
+	StreamID  uint64    `json:"stream_id"`
+	RequestID string    `json:"request_id"`
+	UserID    string    `json:"user_id"`
+	StartedAt time.Time `json:"started_at"`
+	RunningMs int64     `json:"running_ms"`
+	Words     int64     `json:"words"`
+}
+
+type PreviewResponse struct {
+	EstimatedWords   int     `json:"estimated_words"`
+	EstimatedSeconds float64 `json:"estimated_seconds"`
+}
@@ -0,0 +1,58 @@
+package resume
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignerRoundTrip(t *testing.T) {
+	s := NewSigner([]byte("secret"))
+	want := Token{
+		UserID:      "alice",
+		Seed:        42,
+		Offset:      7,
+		Profile:     "tech",
+		Temperature: 0.5,
+		MinWordLen:  3,
+		MaxWordLen:  9,
+		Stop:        "done",
+		MaxTokens:   20,
+	}
+
+	got, err := s.Decode("alice", s.Encode(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("Decode = %+v, want %+v", got, want)
+	}
+}
+
+func TestSignerRejects(t *testing.T) {
+	s := NewSigner([]byte("secret"))
+	valid := s.Encode(Token{UserID: "alice", Seed: 42, Offset: 7, MaxTokens: 20})
+	payload, sig, _ := strings.Cut(valid, ".")
+	forged := NewSigner([]byte("secret"))
+	forged.secret = []byte("other")
+
+	tests := []struct {
+		name   string
+		userID string
+		raw    string
+	}{
+		{"other user", "bob", valid},
+		{"no signature", "alice", payload},
+		{"tampered payload", "alice", payload + "x." + sig},
+		{"wrong secret", "alice", forged.Encode(Token{UserID: "alice", MaxTokens: 20})},
+		{"negative offset", "alice", s.Encode(Token{UserID: "alice", Offset: -1, MaxTokens: 20})},
+		{"zero max tokens", "alice", s.Encode(Token{UserID: "alice"})},
+		{"not json", "alice", "bm90IGpzb24." + s.sign("bm90IGpzb24")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Decode(tt.userID, tt.raw); err != ErrInvalidToken {
+				t.Fatalf("Decode error = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"manifold-test/internal/database/dialect"
+	"manifold-test/internal/models"
+)
+
+// QueuedRequest is a saved request waiting for the next batch INSERT.
+type QueuedRequest struct {
+	RequestID  string
+	UserID     string
+	Data       string
+	DurationMs int64
+}
+
+// BatchingConfig configures a BatchingRequestService.
+type BatchingConfig struct {
+	Dialect       dialect.Dialect
+	QueryTimeout  time.Duration // bounds reads without a deadline
+	WriteTimeout  time.Duration // bounds each batch INSERT
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxDataBytes  int
+
+	// Breaker guards every flush, shared with the other persistence writes
+	// so a failing batch counts towards opening it. Batches it refuses or
+	// that fail to insert are passed to OnFailure, since SaveRequest has
+	// already returned nil for them; OnFailure must not keep the slice.
+	Breaker   *WriteBreaker
+	OnFailure func(ctx context.Context, failed []QueuedRequest, err error)
+}
+
+// BatchingRequestService queues saved requests and writes them with a
+// multi-row INSERT once BatchSize rows are queued or FlushInterval has
+// passed, whichever comes first. Data is truncated to MaxDataBytes as for
+// RequestService.
+type BatchingRequestService struct {
+	db    *sql.DB
+	cfg   BatchingConfig
+	queue chan QueuedRequest
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewBatchingRequestService(db *sql.DB, cfg BatchingConfig) *BatchingRequestService {
+	s := &BatchingRequestService{
+		db:    db,
+		cfg:   cfg,
+		queue: make(chan QueuedRequest, cfg.BatchSize*4),
+		stop:  make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s
+}
+
+// SaveRequest enqueues the request; it only blocks while the queue is full.
+func (s *BatchingRequestService) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	data = truncateData(ctx, requestID, data, s.cfg.MaxDataBytes)
+	select {
+	case s.queue <- QueuedRequest{RequestID: requestID, UserID: userID, Data: data, DurationMs: durationMs}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to queue request: %w", ctx.Err())
+	}
+}
+
+// RequestExists only sees requests that have been flushed.
+func (s *BatchingRequestService) RequestExists(ctx context.Context, requestID string) (bool, error) {
+	ctx, cancel := boundedContext(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+
+	return requestExists(ctx, s.db, s.cfg.Dialect, requestID)
+}
+
+// RequestTotals only sees requests that have been flushed.
+func (s *BatchingRequestService) RequestTotals(ctx context.Context) (int64, float64, error) {
+	ctx, cancel := boundedContext(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+
+	return requestTotals(ctx, s.db)
+}
+
+// ListRequests only sees requests that have been flushed.
+func (s *BatchingRequestService) ListRequests(ctx context.Context, userID string, afterID, limit int) ([]models.Request, error) {
+	ctx, cancel := boundedContext(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+
+	return listRequests(ctx, s.db, s.cfg.Dialect, userID, afterID, limit)
+}
+
+// ListRequestsFiltered only sees requests that have been flushed.
+func (s *BatchingRequestService) ListRequestsFiltered(ctx context.Context, userID string, from, to time.Time, limit, offset int) (*models.RequestPage, error) {
+	ctx, cancel := boundedContext(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+
+	return listRequestsFiltered(ctx, s.db, s.cfg.Dialect, userID, from, to, limit, offset)
+}
+
+// Close stops the background writer after flushing everything queued.
+// SaveRequest must not be called after Close.
+func (s *BatchingRequestService) Close() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *BatchingRequestService) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]QueuedRequest, 0, s.cfg.BatchSize)
+	for {
+		select {
+		case req := <-s.queue:
+			batch = append(batch, req)
+			if len(batch) >= s.cfg.BatchSize {
+				batch = s.flush(batch)
+			}
+		case <-ticker.C:
+			batch = s.flush(batch)
+		case <-s.stop:
+			// Drain whatever is still queued
+			for {
+				select {
+				case req := <-s.queue:
+					batch = append(batch, req)
+					if len(batch) >= s.cfg.BatchSize {
+						batch = s.flush(batch)
+					}
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes batch through the write breaker and returns it emptied for
+// reuse. A batch that can't be written goes to OnFailure.
+func (s *BatchingRequestService) flush(batch []QueuedRequest) []QueuedRequest {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	placeholders := make([]string, len(batch))
+	args := make([]interface{}, 0, len(batch)*5)
+	for i, req := range batch {
+		placeholders[i] = "(?, ?, ?, ?, ?)"
+		args = append(args, req.RequestID, req.UserID, req.Data, durationSeconds(req.DurationMs), req.DurationMs)
+	}
+	query := s.cfg.Dialect.Rebind(`INSERT INTO requests (request_id, user_id, data, duration, duration_ms) VALUES ` + strings.Join(placeholders, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.WriteTimeout)
+	defer cancel()
+	err := s.cfg.Breaker.Do(func() error {
+		_, err := s.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to flush requests", "count", len(batch), "error", err)
+		if s.cfg.OnFailure != nil {
+			s.cfg.OnFailure(ctx, batch, err)
+		}
+	}
+
+	return batch[:0]
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"manifold-test/internal/database/dialect"
+)
+
+func newTestBatching(t *testing.T, size int, interval time.Duration) (*BatchingRequestService, *fakeDB) {
+	t.Helper()
+	db, fake := newFakeDB(t)
+	s := NewBatchingRequestService(db, BatchingConfig{
+		Dialect:       dialect.MySQL,
+		QueryTimeout:  time.Second,
+		WriteTimeout:  time.Second,
+		BatchSize:     size,
+		FlushInterval: interval,
+		Breaker:       NewWriteBreaker(5, time.Minute),
+	})
+	return s, fake
+}
+
+func saveN(t *testing.T, s *BatchingRequestService, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := s.SaveRequest(context.Background(), fmt.Sprintf("req-%d", i), "alice", "words ", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitForExecs polls until fake has run n statements.
+func waitForExecs(t *testing.T, fake *fakeDB, n int) []execCall {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if calls := fake.calls(); len(calls) >= n {
+			return calls
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d statements after 5s, want %d", len(fake.calls()), n)
+	return nil
+}
+
+func TestBatchingFlushesWhenBatchIsFull(t *testing.T) {
+	s, fake := newTestBatching(t, 3, time.Hour)
+	defer s.Close()
+
+	saveN(t, s, 3)
+	calls := waitForExecs(t, fake, 1)
+	if len(calls) != 1 || len(calls[0].args) != 3*5 {
+		t.Fatalf("%d statements, first with %d args; want one 3-row INSERT", len(calls), len(calls[0].args))
+	}
+}
+
+func TestBatchingFlushesOnInterval(t *testing.T) {
+	s, fake := newTestBatching(t, 100, 20*time.Millisecond)
+	defer s.Close()
+
+	start := time.Now()
+	saveN(t, s, 2)
+	calls := waitForExecs(t, fake, 1)
+	if len(calls[0].args) != 2*5 {
+		t.Fatalf("INSERT has %d args, want 2 rows", len(calls[0].args))
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Fatalf("flushed after %s, before the interval", waited)
+	}
+}
+
+func TestBatchingCloseDrainsQueue(t *testing.T) {
+	s, fake := newTestBatching(t, 100, time.Hour)
+
+	saveN(t, s, 5)
+	s.Close()
+
+	calls := fake.calls()
+	if len(calls) != 1 || len(calls[0].args) != 5*5 {
+		t.Fatalf("%d statements after Close; want one 5-row INSERT", len(calls))
+	}
+}
+
+func TestBatchingReportsFailedFlush(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.execErr = errors.New("connection refused")
+	var failed []string
+	s := NewBatchingRequestService(db, BatchingConfig{
+		Dialect:       dialect.MySQL,
+		WriteTimeout:  time.Second,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Breaker:       NewWriteBreaker(5, time.Minute),
+		OnFailure: func(ctx context.Context, batch []QueuedRequest, err error) {
+			for _, req := range batch {
+				failed = append(failed, req.RequestID)
+			}
+		},
+	})
+
+	saveN(t, s, 2)
+	s.Close()
+	if len(failed) != 2 || failed[0] != "req-0" || failed[1] != "req-1" {
+		t.Fatalf("OnFailure got %v, want both requests", failed)
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	appmetrics "manifold-test/internal/metrics"
+)
+
+// Breaker states, as reported by the db_write_breaker_state gauge
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// ErrWriteBreakerOpen is returned instead of writing to the DB while the
+// breaker is open.
+var ErrWriteBreakerOpen = errors.New("database write circuit breaker open")
+
+// WriteBreaker guards DB writes. After threshold consecutive failures it
+// fails writes immediately for cooldown, so a struggling MySQL isn't piled
+// on by retries, then lets a single probe through to decide whether to
+// close again.
+type WriteBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	state     int
+	openUntil time.Time
+}
+
+func NewWriteBreaker(threshold int, cooldown time.Duration) *WriteBreaker {
+	appmetrics.DBWriteBreakerState.Set(breakerClosed)
+	return &WriteBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Do runs op unless the breaker is open. sql.ErrNoRows is an answer from
+// a healthy DB, so it doesn't count as a failure.
+func (b *WriteBreaker) Do(op func() error) error {
+	if !b.allow() {
+		return ErrWriteBreakerOpen
+	}
+
+	err := op()
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		b.recordFailure()
+		return err
+	}
+
+	b.recordSuccess()
+	return err
+}
+
+// IsOpen reports whether writes are currently being refused. Unlike Do it
+// doesn't let a half-open probe through.
+func (b *WriteBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == breakerHalfOpen || (b.state == breakerOpen && time.Now().Before(b.openUntil))
+}
+
+func (b *WriteBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *WriteBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.setState(breakerClosed)
+}
+
+func (b *WriteBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *WriteBreaker) setState(state int) {
+	b.state = state
+	appmetrics.DBWriteBreakerState.Set(float64(state))
+}
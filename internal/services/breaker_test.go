@@ -0,0 +1,91 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteBreakerOpensAndRecovers(t *testing.T) {
+	b := NewWriteBreaker(2, 20*time.Millisecond)
+	failing := errors.New("connection refused")
+	calls := 0
+	op := func(err error) func() error {
+		return func() error {
+			calls++
+			return err
+		}
+	}
+
+	b.Do(op(failing))
+	if b.IsOpen() {
+		t.Fatal("open after one failure")
+	}
+	b.Do(op(failing))
+	if !b.IsOpen() {
+		t.Fatal("closed after threshold failures")
+	}
+	if err := b.Do(op(nil)); !errors.Is(err, ErrWriteBreakerOpen) || calls != 2 {
+		t.Fatalf("open breaker: err = %v, %d calls", err, calls)
+	}
+
+	// After the cooldown a failing probe opens it again
+	time.Sleep(30 * time.Millisecond)
+	if b.IsOpen() {
+		t.Fatal("still refusing writes after the cooldown")
+	}
+	if err := b.Do(op(failing)); err != failing || !b.IsOpen() {
+		t.Fatalf("failed probe: err = %v, open = %v", err, b.IsOpen())
+	}
+
+	// A successful probe closes it
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Do(op(nil)); err != nil || b.IsOpen() {
+		t.Fatalf("successful probe: err = %v, open = %v", err, b.IsOpen())
+	}
+	if calls != 4 {
+		t.Fatalf("%d writes ran, want 4", calls)
+	}
+}
+
+func TestWriteBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	b := NewWriteBreaker(1, 0)
+	b.Do(func() error { return errors.New("deadlock") })
+
+	probing := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(func() error {
+			close(probing)
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-probing
+
+	if !b.IsOpen() {
+		t.Fatal("IsOpen = false while the probe is in flight")
+	}
+	if err := b.Do(func() error { return nil }); !errors.Is(err, ErrWriteBreakerOpen) {
+		t.Fatalf("second write during the probe: err = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b.IsOpen() {
+		t.Fatal("still open after a successful probe")
+	}
+}
+
+func TestWriteBreakerNoRowsIsSuccess(t *testing.T) {
+	b := NewWriteBreaker(1, time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := b.Do(func() error { return sql.ErrNoRows }); err != sql.ErrNoRows {
+			t.Fatalf("Do error = %v, want sql.ErrNoRows", err)
+		}
+	}
+	if b.IsOpen() {
+		t.Fatal("sql.ErrNoRows opened the breaker")
+	}
+}
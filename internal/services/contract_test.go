@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"manifold-test/internal/database/dialect"
+)
+
+// repositories is one storage backend as the contract tests see it: an
+// empty store whose first CreateUser succeeds and whose second CreateUser
+// for the same user collides.
+type repositories struct {
+	users    UserRepository
+	requests RequestRepository
+}
+
+// backends returns the memory store and the SQL services over a fakeDB
+// scripted to answer like an empty MySQL database.
+func backends() map[string]func(t *testing.T) repositories {
+	return map[string]func(t *testing.T) repositories{
+		"memory": func(t *testing.T) repositories {
+			return repositories{NewMemoryUserRepository(10), NewMemoryRequestRepository()}
+		},
+		"mysql": func(t *testing.T) repositories {
+			db, fake := newFakeDB(t)
+			// Aggregates over empty tables still return a row
+			fake.rowsFor = func(query string) [][]driver.Value {
+				switch {
+				case strings.Contains(query, "COUNT(*), "):
+					return [][]driver.Value{{int64(0), int64(0)}}
+				case strings.Contains(query, "COUNT(*)"):
+					return [][]driver.Value{{int64(0)}}
+				}
+				return nil
+			}
+			fake.execErrs = []error{nil, &mysql.MySQLError{Number: errDuplicateEntry}}
+			return repositories{
+				NewUserService(db, dialect.MySQL, 10, time.Second),
+				NewRequestService(db, dialect.MySQL, time.Second, 0),
+			}
+		},
+	}
+}
+
+func TestUserRepositoryContract(t *testing.T) {
+	for name, open := range backends() {
+		t.Run(name, func(t *testing.T) {
+			users := open(t).users
+			ctx := context.Background()
+
+			if err := users.Ping(ctx); err != nil {
+				t.Fatalf("Ping: %v", err)
+			}
+			if _, err := users.GetUser(ctx, "ghost"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("GetUser of a missing user: err = %v, want sql.ErrNoRows", err)
+			}
+			if _, err := users.GetUserStats(ctx, "ghost"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("GetUserStats of a missing user: err = %v, want sql.ErrNoRows", err)
+			}
+			if stats, err := users.GetUsersStats(ctx, []string{"ghost"}); err != nil || len(stats) != 0 {
+				t.Fatalf("GetUsersStats of a missing user = %v, %v; want none", stats, err)
+			}
+			if stats, err := users.RecentUsersStats(ctx, 10); err != nil || len(stats) != 0 {
+				t.Fatalf("RecentUsersStats of an empty store = %v, %v; want none", stats, err)
+			}
+			if n, used, err := users.UsageTotals(ctx); err != nil || n != 0 || used != 0 {
+				t.Fatalf("UsageTotals of an empty store = %d, %d, %v; want 0, 0", n, used, err)
+			}
+
+			user, err := users.CreateUser(ctx, "alice")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if user.WordsLeft != 10 || user.TotalWords != 10 || user.Profile != DefaultProfile {
+				t.Fatalf("new user = %+v, want 10 words and the default profile", user)
+			}
+			if _, err := users.CreateUser(ctx, "alice"); !errors.Is(err, ErrUserExists) {
+				t.Fatalf("second CreateUser: err = %v, want ErrUserExists", err)
+			}
+		})
+	}
+}
+
+func TestRequestRepositoryContract(t *testing.T) {
+	for name, open := range backends() {
+		t.Run(name, func(t *testing.T) {
+			requests := open(t).requests
+			ctx := context.Background()
+
+			if exists, err := requests.RequestExists(ctx, "req-1"); err != nil || exists {
+				t.Fatalf("RequestExists of a missing request = %v, %v; want false", exists, err)
+			}
+			if n, avg, err := requests.RequestTotals(ctx); err != nil || n != 0 || avg != 0 {
+				t.Fatalf("RequestTotals of an empty store = %d, %v, %v; want 0, 0", n, avg, err)
+			}
+			if list, err := requests.ListRequests(ctx, "alice", 0, 10); err != nil || len(list) != 0 {
+				t.Fatalf("ListRequests of an empty store = %v, %v; want none", list, err)
+			}
+
+			page, err := requests.ListRequestsFiltered(ctx, "alice", time.Time{}, time.Time{}, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Requests == nil || len(page.Requests) != 0 || page.Total != 0 || page.HasMore {
+				t.Fatalf("empty page = %+v, want no requests and a non-nil slice", page)
+			}
+			now := time.Now()
+			if _, err := requests.ListRequestsFiltered(ctx, "alice", now, now.Add(-time.Hour), 10, 0); !errors.Is(err, ErrInvalidRange) {
+				t.Fatalf("reversed range: err = %v, want ErrInvalidRange", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// execCall is one statement run against a fakeDB.
+type execCall struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeDB is a database/sql driver that records every Exec and answers
+// them with the next of execErrs, then with execErr. Every query is recorded too and returns queryRows, or
+// what rowsFor returns for it when set; with hang, queries block until
+// their context is done, like a stuck server. It lets the SQL services be
+// tested without a MySQL server.
+type fakeDB struct {
+	mu        sync.Mutex
+	execs     []execCall
+	execErr   error
+	execErrs  []error
+	queries   []execCall
+	queryRows [][]driver.Value
+	rowsFor   func(query string) [][]driver.Value
+	hang      bool
+}
+
+func (f *fakeDB) calls() []execCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]execCall(nil), f.execs...)
+}
+
+func (f *fakeDB) queryCalls() []execCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]execCall(nil), f.queries...)
+}
+
+var fakeDBSeq atomic.Int64
+
+// newFakeDB opens a *sql.DB backed by a fresh fakeDB.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	f := &fakeDB{}
+	name := fmt.Sprintf("fakedb-%d", fakeDBSeq.Add(1))
+	sql.Register(name, fakeDriver{f})
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements not supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs = append(c.db.execs, execCall{query: query, args: values})
+	if len(c.db.execErrs) > 0 {
+		err := c.db.execErrs[0]
+		c.db.execErrs = c.db.execErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(1), nil
+	}
+	if c.db.execErr != nil {
+		return nil, c.db.execErr
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.queries = append(c.db.queries, execCall{query: query, args: values})
+	if c.db.hang {
+		c.db.mu.Unlock()
+		<-ctx.Done()
+		c.db.mu.Lock()
+		return nil, ctx.Err()
+	}
+	if c.db.rowsFor != nil {
+		return &fakeRows{rows: c.db.rowsFor(query)}, nil
+	}
+	return &fakeRows{rows: append([][]driver.Value(nil), c.db.queryRows...)}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.rows[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	return columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
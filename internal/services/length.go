@@ -0,0 +1,40 @@
+package services
+
+import (
+	"math/rand"
+)
+
+// Length modes for GenerationLength
+const (
+	LengthNone    = "none"    // no default cap
+	LengthFixed   = "fixed"   // always Max
+	LengthUniform = "uniform" // uniform in [Min, Max]
+	LengthNormal  = "normal"  // normal around the midpoint, clamped to [Min, Max]
+)
+
+// LengthConfig selects how many words a stream produces when the client
+// doesn't ask for a limit.
+type LengthConfig struct {
+	Mode string
+	Min  int
+	Max  int
+}
+
+// GenerationLength draws a stream length from cfg. It returns -1 (no limit)
+// for LengthNone. For LengthNormal, Min and Max are three standard
+// deviations from the mean, so values outside them are rare and clamped.
+func GenerationLength(r *rand.Rand, cfg LengthConfig) int {
+	switch cfg.Mode {
+	case LengthFixed:
+		return cfg.Max
+	case LengthUniform:
+		return cfg.Min + r.Intn(cfg.Max-cfg.Min+1)
+	case LengthNormal:
+		mean := float64(cfg.Min+cfg.Max) / 2
+		stddev := float64(cfg.Max-cfg.Min) / 6
+		n := int(mean + r.NormFloat64()*stddev + 0.5)
+		return min(max(n, cfg.Min), cfg.Max)
+	default:
+		return -1
+	}
+}
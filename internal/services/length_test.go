@@ -0,0 +1,60 @@
+package services
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestGenerationLengthBounds(t *testing.T) {
+	tests := []struct {
+		cfg      LengthConfig
+		min, max int
+	}{
+		{LengthConfig{Mode: LengthNone, Min: 10, Max: 20}, -1, -1},
+		{LengthConfig{Mode: "", Min: 10, Max: 20}, -1, -1},
+		{LengthConfig{Mode: LengthFixed, Min: 10, Max: 20}, 20, 20},
+		{LengthConfig{Mode: LengthUniform, Min: 10, Max: 20}, 10, 20},
+		{LengthConfig{Mode: LengthUniform, Min: 7, Max: 7}, 7, 7},
+		{LengthConfig{Mode: LengthNormal, Min: 10, Max: 20}, 10, 20},
+		{LengthConfig{Mode: LengthNormal, Min: 1, Max: 2}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Mode, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			seen := map[int]bool{}
+			for i := 0; i < 10000; i++ {
+				n := GenerationLength(r, tt.cfg)
+				if n < tt.min || n > tt.max {
+					t.Fatalf("GenerationLength(%+v) = %d, outside [%d, %d]", tt.cfg, n, tt.min, tt.max)
+				}
+				seen[n] = true
+			}
+			// Random modes reach both ends of the range
+			if tt.cfg.Mode == LengthUniform && (!seen[tt.min] || !seen[tt.max]) {
+				t.Fatalf("uniform lengths never hit %d or %d", tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestGenerationLengthNormalCentred(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cfg := LengthConfig{Mode: LengthNormal, Min: 100, Max: 400}
+	sum := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		sum += GenerationLength(r, cfg)
+	}
+	if mean := float64(sum) / n; mean < 240 || mean > 260 {
+		t.Fatalf("mean length %.1f, want about 250", mean)
+	}
+}
+
+func TestGenerationLengthDeterministic(t *testing.T) {
+	cfg := LengthConfig{Mode: LengthUniform, Min: 1, Max: 1000}
+	a := GenerationLength(rand.New(rand.NewSource(42)), cfg)
+	b := GenerationLength(rand.New(rand.NewSource(42)), cfg)
+	if a != b {
+		t.Fatalf("same seed gave %d and %d", a, b)
+	}
+}
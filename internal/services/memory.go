@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	appmetrics "manifold-test/internal/metrics"
+	"manifold-test/internal/models"
+)
+
+// MemoryUserRepository is an in-process UserRepository for running without
+// MySQL. It mirrors UserService, including sql.ErrNoRows for missing users.
+type MemoryUserRepository struct {
+	defaultQuota int
+
+	mu       sync.Mutex
+	users    map[string]*models.User
+	refunded map[string]bool // request IDs already refunded
+}
+
+func NewMemoryUserRepository(defaultQuota int) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		defaultQuota: defaultQuota,
+		users:        make(map[string]*models.User),
+		refunded:     make(map[string]bool),
+	}
+}
+
+func (r *MemoryUserRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *MemoryUserRepository) PoolStats() *sql.DBStats {
+	return nil
+}
+
+func (r *MemoryUserRepository) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user: %w", sql.ErrNoRows)
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (r *MemoryUserRepository) CreateUser(ctx context.Context, userID string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; ok {
+		return nil, fmt.Errorf("failed to create user: %w", ErrUserExists)
+	}
+	now := time.Now()
+	user := &models.User{
+		UserID:     userID,
+		WordsLeft:  r.defaultQuota,
+		TotalWords: r.defaultQuota,
+		Profile:    DefaultProfile,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	r.users[userID] = user
+
+	copied := *user
+	return &copied, nil
+}
+
+func (r *MemoryUserRepository) UpdateWordsLeft(ctx context.Context, userID string, wordsUsed int) error {
+	r.update(userID, func(u *models.User) {
+		u.WordsLeft = max(0, u.WordsLeft-wordsUsed)
+	})
+	return nil
+}
+
+func (r *MemoryUserRepository) SetProfile(ctx context.Context, userID, profile string) error {
+	r.update(userID, func(u *models.User) {
+		u.Profile = profile
+	})
+	return nil
+}
+
+func (r *MemoryUserRepository) ReserveWords(ctx context.Context, userID string, want int) (int, error) {
+	if want <= 0 {
+		return 0, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return 0, fmt.Errorf("failed to lock user quota: %w", sql.ErrNoRows)
+	}
+	reserved := min(want, user.WordsLeft)
+	if reserved <= 0 {
+		return 0, nil
+	}
+	user.WordsLeft -= reserved
+	user.UpdatedAt = time.Now()
+	return reserved, nil
+}
+
+func (r *MemoryUserRepository) ChargeWords(ctx context.Context, userID string, words int, strict bool) (int, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return 0, 0, fmt.Errorf("failed to lock user quota: %w", sql.ErrNoRows)
+	}
+	if strict && user.WordsLeft < words {
+		return 0, user.WordsLeft, ErrInsufficientWords
+	}
+	charged := max(min(words, user.WordsLeft), 0)
+	user.WordsLeft -= charged
+	user.UpdatedAt = time.Now()
+	return charged, user.WordsLeft, nil
+}
+
+func (r *MemoryUserRepository) RefundWords(ctx context.Context, requestID, userID string, words int) error {
+	if requestID != "" {
+		r.mu.Lock()
+		done := r.refunded[requestID]
+		r.refunded[requestID] = true
+		r.mu.Unlock()
+		if done {
+			return nil
+		}
+	}
+	r.update(userID, func(u *models.User) {
+		u.WordsLeft = min(u.TotalWords, u.WordsLeft+words)
+	})
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetQuota(ctx context.Context, userID string) error {
+	if !r.update(userID, func(u *models.User) { u.WordsLeft = u.TotalWords }) {
+		return fmt.Errorf("failed to reset quota: %w", sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteUser(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return fmt.Errorf("failed to delete user: %w", sql.ErrNoRows)
+	}
+	delete(r.users, userID)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetUserStats(ctx context.Context, userID string) (*models.UserStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user stats: %w", sql.ErrNoRows)
+	}
+	return &models.UserStats{
+		UserID:     user.UserID,
+		WordsLeft:  user.WordsLeft,
+		TotalWords: user.TotalWords,
+		WordsUsed:  user.TotalWords - user.WordsLeft,
+	}, nil
+}
+
+func (r *MemoryUserRepository) GetUsersStats(ctx context.Context, userIDs []string) ([]models.UserStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var stats []models.UserStats
+	for _, id := range userIDs {
+		if user, ok := r.users[id]; ok {
+			stats = append(stats, models.UserStats{
+				UserID:     user.UserID,
+				WordsLeft:  user.WordsLeft,
+				TotalWords: user.TotalWords,
+				WordsUsed:  user.TotalWords - user.WordsLeft,
+			})
+		}
+	}
+	return stats, nil
+}
+
+func (r *MemoryUserRepository) RecentUsersStats(ctx context.Context, limit int) ([]models.UserStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := make([]*models.User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UpdatedAt.After(users[j].UpdatedAt) })
+
+	stats := make([]models.UserStats, 0, min(limit, len(users)))
+	for _, user := range users[:min(limit, len(users))] {
+		stats = append(stats, models.UserStats{
+			UserID:     user.UserID,
+			WordsLeft:  user.WordsLeft,
+			TotalWords: user.TotalWords,
+			WordsUsed:  user.TotalWords - user.WordsLeft,
+		})
+	}
+	return stats, nil
+}
+
+func (r *MemoryUserRepository) SampleWordsLeft(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sample := appmetrics.NewWordsRemainingSample()
+	for _, user := range r.users {
+		sample.Add(user.WordsLeft)
+	}
+	sample.Publish()
+	return nil
+}
+
+func (r *MemoryUserRepository) PurgeStaleUsers(ctx context.Context, olderThan time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	deleted := 0
+	for id, user := range r.users {
+		if user.UpdatedAt.Before(cutoff) {
+			delete(r.users, id)
+			deleted++
+		}
+	}
+	appmetrics.UsersPurgedTotal.Add(float64(deleted))
+	return deleted, nil
+}
+
+func (r *MemoryUserRepository) UsageTotals(ctx context.Context) (int64, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var wordsUsed int64
+	for _, user := range r.users {
+		wordsUsed += int64(user.TotalWords - user.WordsLeft)
+	}
+	return int64(len(r.users)), wordsUsed, nil
+}
+
+// update applies fn to an existing user and reports whether it was found.
+func (r *MemoryUserRepository) update(userID string, fn func(*models.User)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return false
+	}
+	fn(user)
+	user.UpdatedAt = time.Now()
+	return true
+}
+
+// MemoryRequestRepository is an in-process RequestRepository.
+type MemoryRequestRepository struct {
+	mu       sync.Mutex
+	requests []models.Request
+}
+
+func NewMemoryRequestRepository() *MemoryRequestRepository {
+	return &MemoryRequestRepository{}
+}
+
+func (r *MemoryRequestRepository) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, models.Request{
+		ID:         len(r.requests) + 1,
+		RequestID:  requestID,
+		UserID:     userID,
+		Data:       data,
+		DurationMs: durationMs,
+		CreatedAt:  time.Now(),
+	})
+	return nil
+}
+
+func (r *MemoryRequestRepository) RequestExists(ctx context.Context, requestID string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, req := range r.requests {
+		if req.RequestID == requestID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MemoryRequestRepository) ListRequests(ctx context.Context, userID string, afterID, limit int) ([]models.Request, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var requests []models.Request
+	for _, req := range r.requests {
+		if len(requests) == limit {
+			break
+		}
+		if req.UserID == userID && req.ID > afterID {
+			requests = append(requests, req)
+		}
+	}
+	return requests, nil
+}
+
+func (r *MemoryRequestRepository) ListRequestsFiltered(ctx context.Context, userID string, from, to time.Time, limit, offset int) (*models.RequestPage, error) {
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return nil, ErrInvalidRange
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	page := &models.RequestPage{Requests: []models.Request{}, Limit: limit, Offset: offset}
+	for _, req := range r.requests {
+		if req.UserID != userID || (!from.IsZero() && req.CreatedAt.Before(from)) || (!to.IsZero() && req.CreatedAt.After(to)) {
+			continue
+		}
+		if page.Total >= offset && len(page.Requests) < limit {
+			page.Requests = append(page.Requests, req)
+		}
+		page.Total++
+	}
+	page.HasMore = offset+len(page.Requests) < page.Total
+	return page, nil
+}
+
+func (r *MemoryRequestRepository) RequestTotals(ctx context.Context) (int64, float64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.requests) == 0 {
+		return 0, 0, nil
+	}
+	var total int64
+	for _, req := range r.requests {
+		total += req.DurationMs
+	}
+	return int64(len(r.requests)), float64(total) / float64(len(r.requests)), nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"manifold-test/internal/cache"
+	appmetrics "manifold-test/internal/metrics"
+)
+
+// How often a waiting quota mutation retries the lock
+const quotaLockPollInterval = 10 * time.Millisecond
+
+// QuotaLockingUserRepository serialises quota mutations for a user across
+// API instances with a Redis SET NX lock, so hot users queue in Redis
+// rather than on the users row. If the lock isn't acquired within timeout,
+// or Redis fails, the mutation runs anyway and relies on the row lock.
+type QuotaLockingUserRepository struct {
+	UserRepository
+	locks   cache.Cache
+	timeout time.Duration
+	ttl     time.Duration
+}
+
+// NewQuotaLockingUserRepository wraps users. ttl bounds how long a crashed
+// holder can block others and should comfortably exceed one DB write.
+func NewQuotaLockingUserRepository(users UserRepository, locks cache.Cache, timeout, ttl time.Duration) *QuotaLockingUserRepository {
+	return &QuotaLockingUserRepository{
+		UserRepository: users,
+		locks:          locks,
+		timeout:        timeout,
+		ttl:            ttl,
+	}
+}
+
+func (r *QuotaLockingUserRepository) ReserveWords(ctx context.Context, userID string, want int) (int, error) {
+	defer r.lock(ctx, userID)()
+	return r.UserRepository.ReserveWords(ctx, userID, want)
+}
+
+func (r *QuotaLockingUserRepository) UpdateWordsLeft(ctx context.Context, userID string, wordsUsed int) error {
+	defer r.lock(ctx, userID)()
+	return r.UserRepository.UpdateWordsLeft(ctx, userID, wordsUsed)
+}
+
+func (r *QuotaLockingUserRepository) ChargeWords(ctx context.Context, userID string, words int, strict bool) (int, int, error) {
+	defer r.lock(ctx, userID)()
+	return r.UserRepository.ChargeWords(ctx, userID, words, strict)
+}
+
+func (r *QuotaLockingUserRepository) RefundWords(ctx context.Context, requestID, userID string, words int) error {
+	defer r.lock(ctx, userID)()
+	return r.UserRepository.RefundWords(ctx, requestID, userID, words)
+}
+
+// lock waits up to r.timeout for the user's quota lock and returns the
+// function that releases it. When the lock isn't acquired the returned
+// function does nothing.
+func (r *QuotaLockingUserRepository) lock(ctx context.Context, userID string) func() {
+	key := cache.Key("quota_lock", userID)
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		slog.WarnContext(ctx, "Failed to generate quota lock token", "error", err)
+		return r.fallback()
+	}
+	token := hex.EncodeToString(buf)
+
+	waitCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	ticker := time.NewTicker(quotaLockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := r.locks.SetNX(waitCtx, key, token, r.ttl)
+		if err != nil {
+			if waitCtx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to acquire quota lock", "user_id", userID, "error", err)
+			}
+			return r.fallback()
+		}
+		if ok {
+			return func() {
+				// Release even if the request context is already cancelled
+				if err := r.locks.DelIfValue(context.WithoutCancel(ctx), key, token); err != nil {
+					slog.WarnContext(ctx, "Failed to release quota lock", "user_id", userID, "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return r.fallback()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *QuotaLockingUserRepository) fallback() func() {
+	appmetrics.QuotaLockFallbacksTotal.Inc()
+	return func() {}
+}
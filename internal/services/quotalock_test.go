@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"manifold-test/internal/cache"
+	appmetrics "manifold-test/internal/metrics"
+)
+
+// overlapUsers records how many ReserveWords calls run at once.
+type overlapUsers struct {
+	UserRepository
+	active, maxActive atomic.Int32
+}
+
+func (u *overlapUsers) ReserveWords(ctx context.Context, userID string, want int) (int, error) {
+	n := u.active.Add(1)
+	defer u.active.Add(-1)
+	for {
+		max := u.maxActive.Load()
+		if n <= max || u.maxActive.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return u.UserRepository.ReserveWords(ctx, userID, want)
+}
+
+func TestQuotaLockSerialisesMutations(t *testing.T) {
+	users := &overlapUsers{UserRepository: NewMemoryUserRepository(1000)}
+	if _, err := users.CreateUser(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	r := NewQuotaLockingUserRepository(users, cache.NewMemoryCache(), 5*time.Second, 5*time.Second)
+	fallbacks := testutil.ToFloat64(appmetrics.QuotaLockFallbacksTotal)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.ReserveWords(context.Background(), "alice", 10); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := users.maxActive.Load(); max != 1 {
+		t.Fatalf("%d reservations ran at once, want 1", max)
+	}
+	if got := testutil.ToFloat64(appmetrics.QuotaLockFallbacksTotal) - fallbacks; got != 0 {
+		t.Fatalf("%v fallbacks, want 0", got)
+	}
+	user, _ := users.GetUser(context.Background(), "alice")
+	if user.WordsLeft != 1000-80 {
+		t.Fatalf("words left = %d, want %d", user.WordsLeft, 1000-80)
+	}
+}
+
+func TestQuotaLockFallsBackAfterTimeout(t *testing.T) {
+	locks := cache.NewMemoryCache()
+	users := NewMemoryUserRepository(1000)
+	if _, err := users.CreateUser(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	r := NewQuotaLockingUserRepository(users, locks, 20*time.Millisecond, 5*time.Second)
+	fallbacks := testutil.ToFloat64(appmetrics.QuotaLockFallbacksTotal)
+
+	// Another instance holds the lock and never releases it
+	if ok, _ := locks.SetNX(context.Background(), cache.Key("quota_lock", "alice"), "other", time.Minute); !ok {
+		t.Fatal("couldn't take the lock")
+	}
+
+	start := time.Now()
+	reserved, err := r.ReserveWords(context.Background(), "alice", 10)
+	if err != nil || reserved != 10 {
+		t.Fatalf("ReserveWords = %d, %v; want 10 under the row lock alone", reserved, err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("went ahead after %s, before the lock timeout", waited)
+	}
+	if got := testutil.ToFloat64(appmetrics.QuotaLockFallbacksTotal) - fallbacks; got != 1 {
+		t.Fatalf("%v fallbacks, want 1", got)
+	}
+
+	// The other holder's lock is left alone
+	if held, _ := locks.Exists(context.Background(), cache.Key("quota_lock", "alice")); !held {
+		t.Fatal("fallback released a lock it didn't hold")
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"manifold-test/internal/models"
+)
+
+// ErrInsufficientWords is returned by a strict ChargeWords when the balance
+// is smaller than the charge.
+var ErrInsufficientWords = errors.New("insufficient words")
+
+// ErrUserExists is returned by CreateUser when the user is already there,
+// typically because a concurrent first request created it.
+var ErrUserExists = errors.New("user already exists")
+
+// ErrInvalidRange is returned by ListRequestsFiltered when from is after to.
+var ErrInvalidRange = errors.New("from is after to")
+
+// UserRepository stores users and their word quotas. UserService is the
+// MySQL implementation; MemoryUserRepository keeps users in process.
+// Lookups of a missing user fail with an error wrapping sql.ErrNoRows.
+type UserRepository interface {
+	Ping(ctx context.Context) error
+	// PoolStats reports the connection pool, or nil when there is none.
+	PoolStats() *sql.DBStats
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	// CreateUser adds a user with the default quota; it fails with
+	// ErrUserExists if the user already exists.
+	CreateUser(ctx context.Context, userID string) (*models.User, error)
+	UpdateWordsLeft(ctx context.Context, userID string, wordsUsed int) error
+	SetProfile(ctx context.Context, userID, profile string) error
+	ReserveWords(ctx context.Context, userID string, want int) (int, error)
+	// RefundWords returns words to the balance. A non-empty requestID is
+	// recorded with the refund, and a second refund for the same request
+	// does nothing, so a dead-lettered refund can be replayed safely.
+	RefundWords(ctx context.Context, requestID, userID string, words int) error
+	// ChargeWords deducts up to words from the balance, floored at 0, and
+	// returns how many were charged and what is left. With strict it
+	// charges nothing and returns ErrInsufficientWords instead of flooring.
+	ChargeWords(ctx context.Context, userID string, words int, strict bool) (charged, wordsLeft int, err error)
+	ResetQuota(ctx context.Context, userID string) error
+	// DeleteUser removes the user and their requests; sql.ErrNoRows when
+	// the user doesn't exist.
+	DeleteUser(ctx context.Context, userID string) error
+	GetUserStats(ctx context.Context, userID string) (*models.UserStats, error)
+	// GetUsersStats omits users that don't exist.
+	GetUsersStats(ctx context.Context, userIDs []string) ([]models.UserStats, error)
+	// RecentUsersStats returns up to limit users, most recently updated
+	// first.
+	RecentUsersStats(ctx context.Context, limit int) ([]models.UserStats, error)
+	SampleWordsLeft(ctx context.Context) error
+	PurgeStaleUsers(ctx context.Context, olderThan time.Duration) (int, error)
+	// UsageTotals counts users and the words they have used in total.
+	UsageTotals(ctx context.Context) (users, wordsUsed int64, err error)
+}
+
+// RequestRepository records finished requests. RequestService writes each
+// one immediately; BatchingRequestService buffers them.
+type RequestRepository interface {
+	SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error
+	// RequestExists reports whether a request with requestID has been
+	// saved, so a replayed save can skip rows that were written after all.
+	RequestExists(ctx context.Context, requestID string) (bool, error)
+	// RequestTotals counts saved requests and their mean duration.
+	RequestTotals(ctx context.Context) (count int64, avgDurationMs float64, err error)
+	// ListRequests returns up to limit of the user's requests with an ID
+	// above afterID, in ID order, so callers can page through them all by
+	// passing the last ID they saw.
+	ListRequests(ctx context.Context, userID string, afterID, limit int) ([]models.Request, error)
+	// ListRequestsFiltered returns a page of the user's requests created
+	// between from and to inclusive, oldest first. A zero from or to leaves
+	// that end open; from after to fails with ErrInvalidRange.
+	ListRequestsFiltered(ctx context.Context, userID string, from, to time.Time, limit, offset int) (*models.RequestPage, error)
+}
+
+// StartWordsLeftSampler runs SampleWordsLeft every interval until ctx is done.
+func StartWordsLeftSampler(ctx context.Context, users UserRepository, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := users.SampleWordsLeft(ctx); err != nil {
+					slog.Error("Words left sampler failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// StartStaleUserPurger runs PurgeStaleUsers every interval until ctx is done.
+func StartStaleUserPurger(ctx context.Context, users UserRepository, interval, olderThan time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deleted, err := users.PurgeStaleUsers(ctx, olderThan)
+				if err != nil {
+					slog.Error("Stale user purge failed", "error", err)
+				}
+				if deleted > 0 {
+					slog.Info("Purged stale users", "count", deleted)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	maxRetries       = 3
+	retryBaseBackoff = 50 * time.Millisecond
+)
+
+// MySQL errors worth retrying
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+// Duplicate key on INSERT; not transient, but callers may want to know
+const errDuplicateEntry = 1062
+
+// The same conditions as Postgres SQLSTATEs
+const (
+	sqlStateUniqueViolation      = "23505"
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlock             = "40P01"
+	sqlStateLockNotAvailable     = "55P03"
+)
+
+// sqlState returns err's Postgres SQLSTATE, or "" if it has none. It goes
+// through the SQLState method of the lib/pq and pgx error types, so no
+// Postgres driver is needed to build.
+func sqlState(err error) string {
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
+
+// isRolledBack reports whether the database aborted the statement over a
+// lock conflict, so nothing it did was kept.
+func isRolledBack(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errLockWaitTimeout || mysqlErr.Number == errDeadlock
+	}
+	switch sqlState(err) {
+	case sqlStateDeadlock, sqlStateLockNotAvailable, sqlStateSerializationFailure:
+		return true
+	}
+	return false
+}
+
+// isDuplicateKey reports whether err is a unique-key violation.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errDuplicateEntry
+	}
+	return sqlState(err) == sqlStateUniqueViolation
+}
+
+// isTransient reports whether err is a dropped connection, deadlock or lock
+// wait timeout. No-rows and constraint errors are not transient.
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	return isRolledBack(err)
+}
+
+// IsRetryableWrite reports whether a write that failed with err certainly
+// didn't take effect, so running it again can't apply it twice: the driver
+// gave up before sending anything (driver.ErrBadConn), or the database
+// rolled the statement back (deadlock, lock wait timeout). A connection lost mid-query
+// (mysql.ErrInvalidConn) or a timeout may have struck after the commit, so
+// writes that aren't idempotent must not retry those.
+func IsRetryableWrite(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	return isRolledBack(err)
+}
+
+// withRetry runs op, retrying transient MySQL errors up to maxRetries times
+// with jittered exponential backoff. Use it for reads and idempotent writes.
+func withRetry(ctx context.Context, op func() error) error {
+	return retryWhile(ctx, isTransient, op)
+}
+
+// withWriteRetry is withRetry for writes that aren't idempotent, such as
+// relative updates of words_left: it only retries errors IsRetryableWrite
+// accepts.
+func withWriteRetry(ctx context.Context, op func() error) error {
+	return retryWhile(ctx, IsRetryableWrite, op)
+}
+
+func retryWhile(ctx context.Context, retryable func(error) bool, op func() error) error {
+	backoff := retryBaseBackoff
+	err := op()
+	if err == nil || !retryable(err) {
+		return err
+	}
+
+	// Local source rather than the global, lock-guarded one
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 0; attempt < maxRetries && retryable(err); attempt++ {
+		// Sleep somewhere in [backoff/2, backoff)
+		sleep := backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
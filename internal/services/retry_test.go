@@ -0,0 +1,67 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"manifold-test/internal/database/dialect"
+)
+
+func TestRetriesDeadlockAndLockWaitTimeout(t *testing.T) {
+	for _, number := range []uint16{errDeadlock, errLockWaitTimeout} {
+		db, fake := newFakeDB(t)
+		fake.execErrs = []error{&mysql.MySQLError{Number: number}}
+		s := NewUserService(db, dialect.MySQL, 1000, time.Second)
+
+		if err := s.SetProfile(context.Background(), "alice", "tech"); err != nil {
+			t.Fatalf("error %d: SetProfile = %v, want success on retry", number, err)
+		}
+		if n := len(fake.calls()); n != 2 {
+			t.Fatalf("error %d: %d attempts, want 2", number, n)
+		}
+	}
+}
+
+func TestRetryGivesUpAfterMaxRetries(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.execErr = &mysql.MySQLError{Number: errDeadlock}
+	s := NewUserService(db, dialect.MySQL, 1000, time.Second)
+
+	var mysqlErr *mysql.MySQLError
+	if err := s.SetProfile(context.Background(), "alice", "tech"); !errors.As(err, &mysqlErr) {
+		t.Fatalf("SetProfile = %v, want the deadlock", err)
+	}
+	if n := len(fake.calls()); n != maxRetries+1 {
+		t.Fatalf("%d attempts, want %d", n, maxRetries+1)
+	}
+}
+
+func TestNoRowsIsNotRetried(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewUserService(db, dialect.MySQL, 1000, time.Second)
+
+	if _, err := s.GetUser(context.Background(), "nobody"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("GetUser = %v, want sql.ErrNoRows", err)
+	}
+	if n := len(fake.queryCalls()); n != 1 {
+		t.Fatalf("%d queries, want 1", n)
+	}
+}
+
+func TestDuplicateKeyIsNotRetried(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.execErr = &mysql.MySQLError{Number: errDuplicateEntry}
+	s := NewUserService(db, dialect.MySQL, 1000, time.Second)
+
+	if err := s.SetProfile(context.Background(), "alice", "tech"); err == nil {
+		t.Fatal("SetProfile succeeded")
+	}
+	if n := len(fake.calls()); n != 1 {
+		t.Fatalf("%d attempts, want 1", n)
+	}
+}
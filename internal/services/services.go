@@ -2,75 +2,329 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand"
 	"strings"
 	"time"
 
+	"manifold-test/internal/database/dialect"
+	appmetrics "manifold-test/internal/metrics"
 	"manifold-test/internal/models"
 )
 
+// Users deleted per statement by PurgeStaleUsers
+const purgeBatchSize = 1000
+
 type UserService struct {
-	db *sql.DB
+	db           *sql.DB
+	dialect      dialect.Dialect
+	defaultQuota int
+	queryTimeout time.Duration
 }
 
 type RequestService struct {
-	db *sql.DB
+	db           *sql.DB
+	dialect      dialect.Dialect
+	queryTimeout time.Duration
+	maxDataBytes int
+}
+
+type APIKeyService struct {
+	db           *sql.DB
+	dialect      dialect.Dialect
+	queryTimeout time.Duration
+}
+
+// NewUserService returns a service that creates new users with
+// defaultQuota words. Queries are rebound for d. Calls whose context has no
+// deadline are bounded by queryTimeout, as for the other SQL services.
+func NewUserService(db *sql.DB, d dialect.Dialect, defaultQuota int, queryTimeout time.Duration) *UserService {
+	return &UserService{db: db, dialect: d, defaultQuota: defaultQuota, queryTimeout: queryTimeout}
+}
+
+// NewRequestService returns a service that stores at most maxDataBytes of
+// each request's data, truncating longer data so the insert still succeeds;
+// 0 stores everything.
+func NewRequestService(db *sql.DB, d dialect.Dialect, queryTimeout time.Duration, maxDataBytes int) *RequestService {
+	return &RequestService{db: db, dialect: d, queryTimeout: queryTimeout, maxDataBytes: maxDataBytes}
 }
 
-func NewUserService(db *sql.DB) *UserService {
-	return &UserService{db: db}
+func NewAPIKeyService(db *sql.DB, d dialect.Dialect, queryTimeout time.Duration) *APIKeyService {
+	return &APIKeyService{db: db, dialect: d, queryTimeout: queryTimeout}
 }
 
-func NewRequestService(db *sql.DB) *RequestService {
-	return &RequestService{db: db}
+// boundedContext limits ctx to timeout unless it already has a deadline,
+// so a hung database can't block a caller that didn't set one.
+func boundedContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (s *UserService) PoolStats() *sql.DBStats {
+	stats := s.db.Stats()
+	return &stats
+}
+
+// Ping checks that the database is reachable.
+func (s *UserService) Ping(ctx context.Context) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
 }
 
-func (s *UserService) GetOrCreateUser(ctx context.Context, userID string) (*models.User, error) {
+func (s *UserService) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
 	var user models.User
-	query := `SELECT user_id, words_left, total_words, created_at, updated_at FROM users WHERE user_id = ?`
-	
-	err := s.db.QueryRowContext(ctx, query, userID).Scan(
-		&user.UserID, &user.WordsLeft, &user.TotalWords, &user.CreatedAt, &user.UpdatedAt,
-	)
-	
-	if err == sql.ErrNoRows {
-		// Create new user with 1M words
-		insertQuery := `INSERT INTO users (user_id, words_left, total_words) VALUES (?, ?, ?)`
-		_, err = s.db.ExecContext(ctx, insertQuery, userID, 1000000, 1000000)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create user: %w", err)
-		}
-		
-		user = models.User{
-			UserID:     userID,
-			WordsLeft:  1000000,
-			TotalWords: 1000000,
-			CreatedAt:  time.Now(),
-			UpdatedAt:  time.Now(),
-		}
-	} else if err != nil {
+	query := `SELECT user_id, words_left, total_words, profile, created_at, updated_at FROM users WHERE user_id = ?`
+
+	err := withRetry(ctx, func() error {
+		return s.db.QueryRowContext(ctx, s.dialect.Rebind(query), userID).Scan(
+			&user.UserID, &user.WordsLeft, &user.TotalWords, &user.Profile, &user.CreatedAt, &user.UpdatedAt,
+		)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
-	
 	return &user, nil
 }
 
+// CreateUser inserts a user with the configured starting quota.
+func (s *UserService) CreateUser(ctx context.Context, userID string) (*models.User, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	insertQuery := `INSERT INTO users (user_id, words_left, total_words) VALUES (?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(insertQuery), userID, s.defaultQuota, s.defaultQuota)
+	if isDuplicateKey(err) {
+		return nil, fmt.Errorf("failed to create user: %w", ErrUserExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	return &models.User{
+		UserID:     userID,
+		WordsLeft:  s.defaultQuota,
+		TotalWords: s.defaultQuota,
+		Profile:    DefaultProfile,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}, nil
+}
+
+// UpdateWordsLeft deducts wordsUsed from the balance. It doesn't retry:
+// the deduction isn't idempotent, and the persistence path that calls it
+// retries safe failures itself.
 func (s *UserService) UpdateWordsLeft(ctx context.Context, userID string, wordsUsed int) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
 	query := `UPDATE users SET words_left = GREATEST(0, words_left - ?), updated_at = NOW() WHERE user_id = ?`
-	_, err := s.db.ExecContext(ctx, query, wordsUsed, userID)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), wordsUsed, userID)
 	if err != nil {
 		return fmt.Errorf("failed to update words left: %w", err)
 	}
 	return nil
 }
 
+// SetProfile stores the user's default word-bank profile.
+func (s *UserService) SetProfile(ctx context.Context, userID, profile string) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET profile = ?, updated_at = NOW() WHERE user_id = ?`
+	err := withRetry(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), profile, userID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set profile: %w", err)
+	}
+	return nil
+}
+
+// ReserveWords atomically takes up to want words from the user's balance
+// and returns how many were reserved (0 when the balance is empty). The row
+// lock serialises concurrent reservations for the same user.
+func (s *UserService) ReserveWords(ctx context.Context, userID string, want int) (int, error) {
+	if want <= 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	var reserved int
+	err := withWriteRetry(ctx, func() error {
+		var err error
+		reserved, err = s.reserveWords(ctx, userID, want)
+		return err
+	})
+	return reserved, err
+}
+
+func (s *UserService) reserveWords(ctx context.Context, userID string, want int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin reservation: %w", err)
+	}
+	defer tx.Rollback()
+
+	var wordsLeft int
+	err = tx.QueryRowContext(ctx, s.dialect.Rebind(`SELECT words_left FROM users WHERE user_id = ? FOR UPDATE`), userID).Scan(&wordsLeft)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock user quota: %w", err)
+	}
+
+	reserved := want
+	if wordsLeft < reserved {
+		reserved = wordsLeft
+	}
+	if reserved <= 0 {
+		return 0, nil
+	}
+
+	query := `UPDATE users SET words_left = words_left - ?, updated_at = NOW() WHERE user_id = ?`
+	if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), reserved, userID); err != nil {
+		return 0, fmt.Errorf("failed to reserve words: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit reservation: %w", err)
+	}
+
+	return reserved, nil
+}
+
+// ChargeWords deducts words out of band (e.g. usage metered elsewhere),
+// under the same row lock as ReserveWords.
+func (s *UserService) ChargeWords(ctx context.Context, userID string, words int, strict bool) (int, int, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	var charged, wordsLeft int
+	err := withWriteRetry(ctx, func() error {
+		var err error
+		charged, wordsLeft, err = s.chargeWords(ctx, userID, words, strict)
+		return err
+	})
+	return charged, wordsLeft, err
+}
+
+func (s *UserService) chargeWords(ctx context.Context, userID string, words int, strict bool) (int, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin charge: %w", err)
+	}
+	defer tx.Rollback()
+
+	var wordsLeft int
+	err = tx.QueryRowContext(ctx, s.dialect.Rebind(`SELECT words_left FROM users WHERE user_id = ? FOR UPDATE`), userID).Scan(&wordsLeft)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to lock user quota: %w", err)
+	}
+	if strict && wordsLeft < words {
+		return 0, wordsLeft, ErrInsufficientWords
+	}
+
+	charged := min(words, wordsLeft)
+	if charged <= 0 {
+		return 0, wordsLeft, nil
+	}
+
+	query := `UPDATE users SET words_left = words_left - ?, updated_at = NOW() WHERE user_id = ?`
+	if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), charged, userID); err != nil {
+		return 0, 0, fmt.Errorf("failed to charge words: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit charge: %w", err)
+	}
+
+	return charged, wordsLeft - charged, nil
+}
+
+// RefundWords returns unused reserved words to the user's balance. A
+// non-empty requestID goes into the refunds ledger in the same
+// transaction: a replay of a refund that committed before its error (a
+// timeout or lost connection) hits the ledger's primary key and is
+// skipped. Like UpdateWordsLeft it doesn't retry; the persistence path
+// does.
+func (s *UserService) RefundWords(ctx context.Context, requestID, userID string, words int) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin refund: %w", err)
+	}
+	defer tx.Rollback()
+
+	if requestID != "" {
+		ledger := `INSERT INTO refunds (request_id, user_id, words) VALUES (?, ?, ?)`
+		_, err := tx.ExecContext(ctx, s.dialect.Rebind(ledger), requestID, userID, words)
+		if isDuplicateKey(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record refund: %w", err)
+		}
+	}
+
+	query := `UPDATE users SET words_left = LEAST(total_words, words_left + ?), updated_at = NOW() WHERE user_id = ?`
+	if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), words, userID); err != nil {
+		return fmt.Errorf("failed to refund words: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit refund: %w", err)
+	}
+	return nil
+}
+
+// ResetQuota restores words_left to total_words. It returns sql.ErrNoRows
+// if the user does not exist.
+func (s *UserService) ResetQuota(ctx context.Context, userID string) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET words_left = total_words, updated_at = NOW() WHERE user_id = ?`
+	var result sql.Result
+	err := withRetry(ctx, func() error {
+		var err error
+		result, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), userID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset quota: %w", err)
+	}
+
+	// MySQL reports 0 affected rows when nothing changed, so check existence
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	var exists int
+	if err := s.db.QueryRowContext(ctx, s.dialect.Rebind(`SELECT 1 FROM users WHERE user_id = ?`), userID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to reset quota: %w", err)
+	}
+	return nil
+}
+
 func (s *UserService) GetUserStats(ctx context.Context, userID string) (*models.UserStats, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
 	var stats models.UserStats
 	query := `SELECT user_id, words_left, total_words FROM users WHERE user_id = ?`
 	
-	err := s.db.QueryRowContext(ctx, query, userID).Scan(&stats.UserID, &stats.WordsLeft, &stats.TotalWords)
+	err := withRetry(ctx, func() error {
+		return s.db.QueryRowContext(ctx, s.dialect.Rebind(query), userID).Scan(&stats.UserID, &stats.WordsLeft, &stats.TotalWords)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user stats: %w", err)
 	}
@@ -79,43 +333,343 @@ func (s *UserService) GetUserStats(ctx context.Context, userID string) (*models.
 	return &stats, nil
 }
 
-func (s *RequestService) SaveRequest(ctx context.Context, userID, data string, duration float64) error {
-	query := `INSERT INTO requests (user_id, data, duration) VALUES (?, ?, ?)`
-	_, err := s.db.ExecContext(ctx, query, userID, data, duration)
+// GetUsersStats returns stats for the given users in a single query.
+// Users that don't exist are left out.
+func (s *UserService) GetUsersStats(ctx context.Context, userIDs []string) ([]models.UserStats, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(userIDs)), ",")
+	query := `SELECT user_id, words_left, total_words FROM users WHERE user_id IN (` + placeholders + `)`
+	args := make([]any, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+
+	var stats []models.UserStats
+	err := withRetry(ctx, func() error {
+		stats = stats[:0]
+		rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var st models.UserStats
+			if err := rows.Scan(&st.UserID, &st.WordsLeft, &st.TotalWords); err != nil {
+				return err
+			}
+			st.WordsUsed = st.TotalWords - st.WordsLeft
+			stats = append(stats, st)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users stats: %w", err)
+	}
+	return stats, nil
+}
+
+func (s *UserService) RecentUsersStats(ctx context.Context, limit int) ([]models.UserStats, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	query := `SELECT user_id, words_left, total_words FROM users ORDER BY updated_at DESC LIMIT ?`
+
+	var stats []models.UserStats
+	err := withRetry(ctx, func() error {
+		stats = stats[:0]
+		rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var st models.UserStats
+			if err := rows.Scan(&st.UserID, &st.WordsLeft, &st.TotalWords); err != nil {
+				return err
+			}
+			st.WordsUsed = st.TotalWords - st.WordsLeft
+			stats = append(stats, st)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent users stats: %w", err)
+	}
+	return stats, nil
+}
+
+// SampleWordsLeft replaces the words_remaining gauge with a count of users
+// by words_left. A failed sample leaves the previous one in place.
+func (s *UserService) SampleWordsLeft(ctx context.Context) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT words_left FROM users`)
+	if err != nil {
+		return fmt.Errorf("failed to sample words left: %w", err)
+	}
+	defer rows.Close()
+
+	sample := appmetrics.NewWordsRemainingSample()
+	for rows.Next() {
+		var wordsLeft int
+		if err := rows.Scan(&wordsLeft); err != nil {
+			return fmt.Errorf("failed to scan words left: %w", err)
+		}
+		sample.Add(wordsLeft)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to sample words left: %w", err)
+	}
+	sample.Publish()
+	return nil
+}
+
+// PurgeStaleUsers deletes users not updated within olderThan; their
+// requests and keys go with them via ON DELETE CASCADE. Rows are deleted in
+// batches so a large backlog doesn't hold locks for long.
+func (s *UserService) PurgeStaleUsers(ctx context.Context, olderThan time.Duration) (int, error) {
+	query := `DELETE FROM users WHERE updated_at < DATE_SUB(NOW(), INTERVAL ? SECOND) LIMIT ?`
+	if s.dialect == dialect.Postgres {
+		// No DELETE ... LIMIT or DATE_SUB on Postgres
+		query = `DELETE FROM users WHERE user_id IN (
+			SELECT user_id FROM users WHERE updated_at < NOW() - ? * INTERVAL '1 second' LIMIT ?)`
+	}
+
+	deleted := 0
+	for {
+		// Each batch gets its own bound; the whole purge may take longer
+		batchCtx, cancel := boundedContext(ctx, s.queryTimeout)
+		result, err := s.db.ExecContext(batchCtx, s.dialect.Rebind(query), int64(olderThan.Seconds()), purgeBatchSize)
+		cancel()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge stale users: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge stale users: %w", err)
+		}
+		deleted += int(n)
+		appmetrics.UsersPurgedTotal.Add(float64(n))
+		if n < purgeBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// DeleteUser deletes the user; their requests and API keys go with them
+// via ON DELETE CASCADE.
+func (s *UserService) DeleteUser(ctx context.Context, userID string) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	var result sql.Result
+	err := withRetry(ctx, func() error {
+		var err error
+		result, err = s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM users WHERE user_id = ?`), userID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to delete user: %w", sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (s *UserService) UsageTotals(ctx context.Context) (int64, int64, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	var users, wordsUsed int64
+	query := `SELECT COUNT(*), COALESCE(SUM(total_words - words_left), 0) FROM users`
+	if err := s.db.QueryRowContext(ctx, query).Scan(&users, &wordsUsed); err != nil {
+		return 0, 0, fmt.Errorf("failed to get usage totals: %w", err)
+	}
+	return users, wordsUsed, nil
+}
+
+// SaveRequest records a completed stream; durationMs is the wall-clock
+// duration in milliseconds. It is stored in duration_ms, and rounded to
+// whole seconds in the legacy duration column.
+func (s *RequestService) SaveRequest(ctx context.Context, requestID, userID, data string, durationMs int64) error {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	data = truncateData(ctx, requestID, data, s.maxDataBytes)
+	query := `INSERT INTO requests (request_id, user_id, data, duration, duration_ms) VALUES (?, ?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), requestID, userID, data, durationSeconds(durationMs), durationMs)
 	if err != nil {
 		return fmt.Errorf("failed to save request: %w", err)
 	}
 	return nil
 }
 
-// Generate random words for streaming with optional stop token support
-func GenerateRandomWords(rng *rand.Rand, count int, stopToken string) (string, bool) {
-	words := []string{
-		"the", "be", "to", "of", "and", "a", "in", "that", "have", "I",
-		"it", "for", "not", "on", "with", "he", "as", "you", "do", "at",
-		"this", "but", "his", "by", "from", "they", "we", "say", "her", "she",
-		"or", "an", "will", "my", "one", "all", "would", "there", "their", "what",
-		"so", "up", "out", "if", "about", "who", "get", "which", "go", "me",
-		"when", "make", "can", "like", "time", "no", "just", "him", "know", "take",
-		"people", "into", "year", "your", "good", "some", "could", "them", "see", "other",
-		"than", "then", "now", "look", "only", "come", "its", "over", "think", "also",
-		"back", "after", "use", "two", "how", "our", "work", "first", "well", "way",
-		"even", "new", "want", "because", "any", "these", "give", "day", "most", "us",
+func (s *RequestService) RequestExists(ctx context.Context, requestID string) (bool, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	return requestExists(ctx, s.db, s.dialect, requestID)
+}
+
+// requestExists is shared by the immediate and batching request services.
+func requestExists(ctx context.Context, db *sql.DB, d dialect.Dialect, requestID string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, d.Rebind(`SELECT 1 FROM requests WHERE request_id = ? LIMIT 1`), requestID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
 	}
-	
-	var result []string
-	stopTokenFound := false
-	
-	for i := 0; i < count; i++ {
-		word := words[rng.Intn(len(words))]
-		result = append(result, word)
-		
-		// Check if stop token was generated (must be an existing word from the list)
-		if stopToken != "" && word == stopToken {
-			stopTokenFound = true
-			break // Stop generating more words
+	if err != nil {
+		return false, fmt.Errorf("failed to look up request: %w", err)
+	}
+	return true, nil
+}
+
+func (s *RequestService) RequestTotals(ctx context.Context) (int64, float64, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	return requestTotals(ctx, s.db)
+}
+
+// durationSeconds rounds durationMs to the whole seconds the legacy
+// requests.duration column holds.
+func durationSeconds(durationMs int64) int64 {
+	return (durationMs + 500) / 1000
+}
+
+// requestTotals is shared by the immediate and batching request services.
+func requestTotals(ctx context.Context, db *sql.DB) (int64, float64, error) {
+	var count int64
+	var avgDurationMs float64
+	query := `SELECT COUNT(*), COALESCE(AVG(duration_ms), 0) FROM requests`
+	if err := db.QueryRowContext(ctx, query).Scan(&count, &avgDurationMs); err != nil {
+		return 0, 0, fmt.Errorf("failed to get request totals: %w", err)
+	}
+	return count, avgDurationMs, nil
+}
+
+func (s *RequestService) ListRequests(ctx context.Context, userID string, afterID, limit int) ([]models.Request, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	return listRequests(ctx, s.db, s.dialect, userID, afterID, limit)
+}
+
+func (s *RequestService) ListRequestsFiltered(ctx context.Context, userID string, from, to time.Time, limit, offset int) (*models.RequestPage, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	return listRequestsFiltered(ctx, s.db, s.dialect, userID, from, to, limit, offset)
+}
+
+// listRequestsFiltered is shared by the immediate and batching request
+// services. The created_at bounds are the predicates idx_created_at
+// serves; the count and the page are separate queries, so a row saved in
+// between can make Total one off.
+func listRequestsFiltered(ctx context.Context, db *sql.DB, d dialect.Dialect, userID string, from, to time.Time, limit, offset int) (*models.RequestPage, error) {
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return nil, ErrInvalidRange
+	}
+
+	where := `user_id = ?`
+	args := []any{userID}
+	if !from.IsZero() {
+		where += ` AND created_at >= ?`
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where += ` AND created_at <= ?`
+		args = append(args, to)
+	}
+
+	page := &models.RequestPage{Requests: []models.Request{}, Limit: limit, Offset: offset}
+	err := withRetry(ctx, func() error {
+		page.Requests = page.Requests[:0]
+		if err := db.QueryRowContext(ctx, d.Rebind(`SELECT COUNT(*) FROM requests WHERE `+where), args...).Scan(&page.Total); err != nil {
+			return err
 		}
+
+		query := `SELECT id, request_id, user_id, data, duration_ms, created_at FROM requests
+			WHERE ` + where + ` ORDER BY created_at, id LIMIT ? OFFSET ?`
+		rows, err := db.QueryContext(ctx, d.Rebind(query), append(args, limit, offset)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var req models.Request
+			var data sql.NullString
+			if err := rows.Scan(&req.ID, &req.RequestID, &req.UserID, &data, &req.DurationMs, &req.CreatedAt); err != nil {
+				return err
+			}
+			req.Data = data.String
+			page.Requests = append(page.Requests, req)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests: %w", err)
 	}
-	
-	return strings.Join(result, " "), stopTokenFound
-}
\ No newline at end of file
+	page.HasMore = offset+len(page.Requests) < page.Total
+	return page, nil
+}
+
+// listRequests is shared by the immediate and batching request services.
+// It seeks on the primary key, so each page costs the same however deep
+// into a user's history it is.
+func listRequests(ctx context.Context, db *sql.DB, d dialect.Dialect, userID string, afterID, limit int) ([]models.Request, error) {
+	query := `SELECT id, request_id, user_id, data, duration_ms, created_at FROM requests
+		WHERE user_id = ? AND id > ? ORDER BY id LIMIT ?`
+
+	var requests []models.Request
+	err := withRetry(ctx, func() error {
+		requests = requests[:0]
+		rows, err := db.QueryContext(ctx, d.Rebind(query), userID, afterID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var req models.Request
+			var data sql.NullString
+			if err := rows.Scan(&req.ID, &req.RequestID, &req.UserID, &data, &req.DurationMs, &req.CreatedAt); err != nil {
+				return err
+			}
+			req.Data = data.String
+			requests = append(requests, req)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests: %w", err)
+	}
+	return requests, nil
+}
+
+// LookupUser returns the owner of an active API key. Keys are stored as
+// SHA-256 hashes; revoked keys are treated as unknown (sql.ErrNoRows).
+func (s *APIKeyService) LookupUser(ctx context.Context, apiKey string) (string, error) {
+	ctx, cancel := boundedContext(ctx, s.queryTimeout)
+	defer cancel()
+
+	sum := sha256.Sum256([]byte(apiKey))
+	query := `SELECT user_id FROM user_keys WHERE key_hash = ? AND revoked_at IS NULL`
+
+	var userID string
+	if err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), hex.EncodeToString(sum[:])).Scan(&userID); err != nil {
+		return "", fmt.Errorf("failed to look up API key: %w", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,451 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"manifold-test/internal/database/dialect"
+	appmetrics "manifold-test/internal/metrics"
+)
+
+func TestSaveRequestStoresMilliseconds(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewRequestService(db, dialect.MySQL, time.Second, 0)
+
+	if err := s.SaveRequest(context.Background(), "req-1", "alice", "some words ", 1499); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := fake.calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d statements, want 1", len(calls))
+	}
+	if !strings.Contains(calls[0].query, "duration, duration_ms") {
+		t.Fatalf("query %q doesn't write duration_ms", calls[0].query)
+	}
+	// request_id, user_id, data, duration (s), duration_ms
+	args := calls[0].args
+	if args[3] != int64(1) || args[4] != int64(1499) {
+		t.Fatalf("duration = %v, duration_ms = %v; want 1 and 1499", args[3], args[4])
+	}
+}
+
+func TestDurationSeconds(t *testing.T) {
+	tests := map[int64]int64{0: 0, 499: 0, 500: 1, 1499: 1, 1500: 2, 60000: 60}
+	for ms, want := range tests {
+		if got := durationSeconds(ms); got != want {
+			t.Errorf("durationSeconds(%d) = %d, want %d", ms, got, want)
+		}
+	}
+}
+
+// wordsRemaining reads the words_remaining gauge for bound le.
+func wordsRemaining(le string) float64 {
+	return testutil.ToFloat64(appmetrics.WordsRemaining.WithLabelValues(le))
+}
+
+func TestSampleWordsLeftReplacesSample(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewUserService(db, dialect.MySQL, 0, time.Second)
+	ctx := context.Background()
+
+	fake.queryRows = [][]driver.Value{{int64(0)}, {int64(500)}, {int64(20000)}, {int64(2000000)}}
+	for i := 0; i < 2; i++ {
+		if err := s.SampleWordsLeft(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sampling twice must not count anyone twice
+	want := map[string]float64{"0": 1, "1000": 2, "10000": 2, "50000": 3, "1000000": 3, "+Inf": 4}
+	for le, n := range want {
+		if got := wordsRemaining(le); got != n {
+			t.Errorf("words_remaining{le=%q} = %v, want %v", le, got, n)
+		}
+	}
+
+	// A user spending words moves between buckets
+	fake.queryRows = [][]driver.Value{{int64(0)}, {int64(0)}}
+	if err := s.SampleWordsLeft(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := wordsRemaining("0"); got != 2 {
+		t.Errorf("words_remaining{le=\"0\"} = %v, want 2", got)
+	}
+	if got := wordsRemaining("+Inf"); got != 2 {
+		t.Errorf("words_remaining{le=\"+Inf\"} = %v, want 2", got)
+	}
+}
+
+func TestMemorySampleWordsLeft(t *testing.T) {
+	users := NewMemoryUserRepository(5000)
+	ctx := context.Background()
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := users.CreateUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users.UpdateWordsLeft(ctx, "alice", 4500)
+
+	for i := 0; i < 2; i++ {
+		if err := users.SampleWordsLeft(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := wordsRemaining("1000"); got != 1 {
+		t.Errorf("words_remaining{le=\"1000\"} = %v, want 1", got)
+	}
+	if got := wordsRemaining("10000"); got != 2 {
+		t.Errorf("words_remaining{le=\"10000\"} = %v, want 2", got)
+	}
+}
+
+func TestPostgresQueriesUseNumberedPlaceholders(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewRequestService(db, dialect.Postgres, time.Second, 0)
+
+	if err := s.SaveRequest(context.Background(), "req-1", "alice", "some words ", 1499); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.calls()
+	if len(calls) != 1 || !strings.Contains(calls[0].query, "VALUES ($1, $2, $3, $4, $5)") || strings.Contains(calls[0].query, "?") {
+		t.Fatalf("statements %+v, want one with $1..$5", calls)
+	}
+}
+
+// stateError is a Postgres driver error reduced to its SQLSTATE.
+type stateError string
+
+func (e stateError) Error() string    { return "pq: " + string(e) }
+func (e stateError) SQLState() string { return string(e) }
+
+func TestPostgresErrorClassification(t *testing.T) {
+	if !isDuplicateKey(fmt.Errorf("insert: %w", stateError(sqlStateUniqueViolation))) {
+		t.Error("unique violation is not a duplicate key")
+	}
+	for _, state := range []string{sqlStateDeadlock, sqlStateLockNotAvailable, sqlStateSerializationFailure} {
+		if !IsRetryableWrite(stateError(state)) || !isTransient(stateError(state)) {
+			t.Errorf("SQLSTATE %s is not retried", state)
+		}
+	}
+	if IsRetryableWrite(stateError("23503")) || isDuplicateKey(stateError("23503")) {
+		t.Error("foreign key violation is treated as retryable or a duplicate")
+	}
+}
+
+func TestRefundWordsSkipsRefundedRequest(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewUserService(db, dialect.Postgres, 1000, time.Second)
+
+	if err := s.RefundWords(context.Background(), "req-1", "alice", 40); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.calls()
+	if len(calls) != 2 || !strings.Contains(calls[0].query, "INSERT INTO refunds") || !strings.Contains(calls[1].query, "UPDATE users") {
+		t.Fatalf("statements %+v, want the ledger insert then the refund", calls)
+	}
+
+	// The ledger already has req-1: the refund committed before
+	fake.execErr = stateError(sqlStateUniqueViolation)
+	if err := s.RefundWords(context.Background(), "req-1", "alice", 40); err != nil {
+		t.Fatalf("replayed refund: %v", err)
+	}
+	if calls := fake.calls(); len(calls) != 3 {
+		t.Fatalf("replayed refund ran %d statements, want only the ledger insert", len(calls)-2)
+	}
+}
+
+func TestMemoryListRequestsFiltered(t *testing.T) {
+	r := NewMemoryRequestRepository()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := r.SaveRequest(context.Background(), fmt.Sprintf("req-%d", i), "alice", "words ", 10); err != nil {
+			t.Fatal(err)
+		}
+		r.requests[i].CreatedAt = day.AddDate(0, 0, i)
+	}
+	if err := r.SaveRequest(context.Background(), "req-bob", "bob", "words ", 10); err != nil {
+		t.Fatal(err)
+	}
+	r.requests[5].CreatedAt = day.AddDate(0, 0, 2)
+
+	tests := []struct {
+		name          string
+		from, to      time.Time
+		limit, offset int
+		wantIDs       []int
+		wantTotal     int
+		wantMore      bool
+	}{
+		{"everything", time.Time{}, time.Time{}, 10, 0, []int{1, 2, 3, 4, 5}, 5, false},
+		{"inclusive range", day.AddDate(0, 0, 1), day.AddDate(0, 0, 3), 10, 0, []int{2, 3, 4}, 3, false},
+		{"open start", time.Time{}, day.AddDate(0, 0, 1), 10, 0, []int{1, 2}, 2, false},
+		{"open end", day.AddDate(0, 0, 3), time.Time{}, 10, 0, []int{4, 5}, 2, false},
+		{"empty range", day.AddDate(0, 0, 10), day.AddDate(0, 0, 20), 10, 0, []int{}, 0, false},
+		{"first page", time.Time{}, time.Time{}, 2, 0, []int{1, 2}, 5, true},
+		{"middle page", time.Time{}, time.Time{}, 2, 2, []int{3, 4}, 5, true},
+		{"last page", time.Time{}, time.Time{}, 2, 4, []int{5}, 5, false},
+		{"past the end", time.Time{}, time.Time{}, 2, 6, []int{}, 5, false},
+		{"page of a range", day, day.AddDate(0, 0, 3), 3, 1, []int{2, 3, 4}, 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := r.ListRequestsFiltered(context.Background(), "alice", tt.from, tt.to, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, req := range page.Requests {
+				ids = append(ids, req.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) || page.Total != tt.wantTotal || page.HasMore != tt.wantMore {
+				t.Fatalf("ids %v, total %d, has_more %v; want %v, %d, %v", ids, page.Total, page.HasMore, tt.wantIDs, tt.wantTotal, tt.wantMore)
+			}
+			if page.Limit != tt.limit || page.Offset != tt.offset {
+				t.Fatalf("limit %d, offset %d; want %d, %d", page.Limit, page.Offset, tt.limit, tt.offset)
+			}
+		})
+	}
+}
+
+func TestListRequestsFilteredRejectsReversedRange(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewRequestService(db, dialect.MySQL, time.Second, 0)
+	from := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+
+	if _, err := s.ListRequestsFiltered(context.Background(), "alice", from, from.Add(-time.Second), 10, 0); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("err = %v, want ErrInvalidRange", err)
+	}
+	if _, err := NewMemoryRequestRepository().ListRequestsFiltered(context.Background(), "alice", from, from.Add(-time.Second), 10, 0); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("memory err = %v, want ErrInvalidRange", err)
+	}
+	if len(fake.queryCalls()) != 0 {
+		t.Fatal("a reversed range reached the database")
+	}
+}
+
+func TestListRequestsFilteredQueriesRange(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewRequestService(db, dialect.Postgres, time.Second, 0)
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	fake.rowsFor = func(query string) [][]driver.Value {
+		if strings.Contains(query, "COUNT(*)") {
+			return [][]driver.Value{{int64(61)}}
+		}
+		return [][]driver.Value{{int64(41), "req-41", "alice", "some words ", int64(1200), from}}
+	}
+
+	page, err := s.ListRequestsFiltered(context.Background(), "alice", from, time.Time{}, 20, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One row at offset 40 of 61 leaves 20 more
+	if page.Total != 61 || !page.HasMore || len(page.Requests) != 1 || page.Requests[0].RequestID != "req-41" {
+		t.Fatalf("page %+v, want row req-41 of 61 with more to come", page)
+	}
+
+	queries := fake.queryCalls()
+	if len(queries) != 2 {
+		t.Fatalf("ran %d queries, want the count and the page", len(queries))
+	}
+	for _, q := range queries {
+		if !strings.Contains(q.query, "created_at >= $2") || strings.Contains(q.query, "created_at <=") {
+			t.Fatalf("query %q doesn't filter on from alone", q.query)
+		}
+	}
+	// user_id, from, limit, offset
+	if args := queries[1].args; len(args) != 4 || args[2] != int64(20) || args[3] != int64(40) {
+		t.Fatalf("page query args %v, want limit 20 and offset 40", args)
+	}
+}
+
+func TestLookupUserMatchesActiveKeyHash(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewAPIKeyService(db, dialect.MySQL, time.Second)
+	sum := sha256.Sum256([]byte("key-alice"))
+
+	fake.queryRows = [][]driver.Value{{"alice"}}
+	if userID, err := s.LookupUser(context.Background(), "key-alice"); err != nil || userID != "alice" {
+		t.Fatalf("LookupUser = %q, %v", userID, err)
+	}
+	query := fake.queryCalls()[0]
+	if !strings.Contains(query.query, "revoked_at IS NULL") || query.args[0] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("query %q with %v doesn't match the active key's hash", query.query, query.args)
+	}
+
+	// Unknown and revoked keys both find no row
+	fake.queryRows = nil
+	if _, err := s.LookupUser(context.Background(), "key-revoked"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("LookupUser(revoked) = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestMemoryPurgeStaleUsers(t *testing.T) {
+	r := NewMemoryUserRepository(10)
+	ctx := context.Background()
+	for _, id := range []string{"alice", "bob", "carol"} {
+		if _, err := r.CreateUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.users["alice"].UpdatedAt = time.Now().Add(-48 * time.Hour)
+	r.users["bob"].UpdatedAt = time.Now().Add(-25 * time.Hour)
+
+	purged := testutil.ToFloat64(appmetrics.UsersPurgedTotal)
+	deleted, err := r.PurgeStaleUsers(ctx, 24*time.Hour)
+	if err != nil || deleted != 2 {
+		t.Fatalf("PurgeStaleUsers = %d, %v; want 2", deleted, err)
+	}
+	if got := testutil.ToFloat64(appmetrics.UsersPurgedTotal) - purged; got != 2 {
+		t.Fatalf("users_purged_total grew by %v, want 2", got)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := r.GetUser(ctx, id); err == nil {
+			t.Errorf("%s survived the purge", id)
+		}
+	}
+	if _, err := r.GetUser(ctx, "carol"); err != nil {
+		t.Fatalf("carol was purged: %v", err)
+	}
+}
+
+func TestPurgeStaleUsersQuery(t *testing.T) {
+	for _, d := range []dialect.Dialect{dialect.MySQL, dialect.Postgres} {
+		db, fake := newFakeDB(t)
+		s := NewUserService(db, d, 0, time.Second)
+
+		if _, err := s.PurgeStaleUsers(context.Background(), 24*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		calls := fake.calls()
+		if len(calls) != 1 {
+			t.Fatalf("%v: got %d statements, want 1", d, len(calls))
+		}
+		if !strings.Contains(calls[0].query, "updated_at <") {
+			t.Fatalf("%v: query %q doesn't filter on updated_at", d, calls[0].query)
+		}
+		// cutoff in seconds, batch size
+		if args := calls[0].args; args[0] != int64(86400) || args[1] != int64(purgeBatchSize) {
+			t.Fatalf("%v: args = %v, want [86400 %d]", d, args, purgeBatchSize)
+		}
+	}
+}
+
+func TestDeleteUserQuery(t *testing.T) {
+	db, fake := newFakeDB(t)
+	s := NewUserService(db, dialect.MySQL, 0, time.Second)
+
+	if err := s.DeleteUser(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// Requests and keys go via ON DELETE CASCADE, so one statement suffices
+	calls := fake.calls()
+	if len(calls) != 1 || calls[0].query != "DELETE FROM users WHERE user_id = ?" || calls[0].args[0] != "alice" {
+		t.Fatalf("statements = %+v, want one DELETE of alice", calls)
+	}
+}
+
+func TestUsageAndRequestTotals(t *testing.T) {
+	ctx := context.Background()
+	users := NewMemoryUserRepository(10)
+	requests := NewMemoryRequestRepository()
+	for id, used := range map[string]int{"alice": 3, "bob": 2} {
+		users.CreateUser(ctx, id)
+		users.ChargeWords(ctx, id, used, false)
+	}
+	requests.SaveRequest(ctx, "req-1", "alice", "a b c ", 100)
+	requests.SaveRequest(ctx, "req-2", "bob", "d e ", 300)
+
+	if n, used, err := users.UsageTotals(ctx); err != nil || n != 2 || used != 5 {
+		t.Fatalf("memory UsageTotals = %d, %d, %v; want 2, 5", n, used, err)
+	}
+	if n, avg, err := requests.RequestTotals(ctx); err != nil || n != 2 || avg != 200 {
+		t.Fatalf("memory RequestTotals = %d, %v, %v; want 2, 200", n, avg, err)
+	}
+
+	db, fake := newFakeDB(t)
+	fake.rowsFor = func(query string) [][]driver.Value {
+		if strings.Contains(query, "FROM users") {
+			return [][]driver.Value{{int64(2), int64(5)}}
+		}
+		return [][]driver.Value{{int64(2), float64(200)}}
+	}
+	if n, used, err := NewUserService(db, dialect.MySQL, 10, time.Second).UsageTotals(ctx); err != nil || n != 2 || used != 5 {
+		t.Fatalf("SQL UsageTotals = %d, %d, %v; want 2, 5", n, used, err)
+	}
+	if n, avg, err := NewRequestService(db, dialect.MySQL, time.Second, 0).RequestTotals(ctx); err != nil || n != 2 || avg != 200 {
+		t.Fatalf("SQL RequestTotals = %d, %v, %v; want 2, 200", n, avg, err)
+	}
+}
+
+func TestBoundedContext(t *testing.T) {
+	ctx, cancel := boundedContext(context.Background(), time.Second)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Second || time.Until(deadline) < 900*time.Millisecond {
+		t.Fatalf("no caller deadline: deadline = %v, want about a second away", deadline)
+	}
+
+	// A caller's own deadline is kept, whether shorter or longer
+	for _, d := range []time.Duration{10 * time.Millisecond, time.Hour} {
+		parent, cancelParent := context.WithTimeout(context.Background(), d)
+		ctx, cancel := boundedContext(parent, time.Second)
+		want, _ := parent.Deadline()
+		if got, _ := ctx.Deadline(); !got.Equal(want) {
+			t.Errorf("caller deadline in %s: got %v, want %v", d, got, want)
+		}
+		cancel()
+		if parent.Err() != nil && d == time.Hour {
+			t.Error("cancelling the bounded context cancelled the caller's")
+		}
+		cancelParent()
+	}
+}
+
+func TestServiceCallsWithoutDeadlineAreBounded(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.hang = true
+	s := NewUserService(db, dialect.MySQL, 0, 50*time.Millisecond)
+
+	start := time.Now()
+	if _, err := s.GetUserStats(context.Background(), "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetUserStats against a stuck server: err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gave up after %s, want about the 50ms query timeout", elapsed)
+	}
+}
+
+func TestCreateUserDuplicateKey(t *testing.T) {
+	tests := []struct {
+		dialect dialect.Dialect
+		err     error
+	}{
+		{dialect.MySQL, &mysql.MySQLError{Number: errDuplicateEntry, Message: "Duplicate entry 'alice' for key 'PRIMARY'"}},
+		{dialect.Postgres, stateError(sqlStateUniqueViolation)},
+	}
+	for _, tt := range tests {
+		db, fake := newFakeDB(t)
+		fake.execErr = tt.err
+		s := NewUserService(db, tt.dialect, 10, time.Second)
+		if _, err := s.CreateUser(context.Background(), "alice"); !errors.Is(err, ErrUserExists) {
+			t.Errorf("%v: err = %v, want ErrUserExists", tt.dialect, err)
+		}
+	}
+
+	// Anything else is not a duplicate
+	db, fake := newFakeDB(t)
+	fake.execErr = driver.ErrBadConn
+	if _, err := NewUserService(db, dialect.MySQL, 10, time.Second).CreateUser(context.Background(), "alice"); err == nil || errors.Is(err, ErrUserExists) {
+		t.Fatalf("bad connection: err = %v, want a plain failure", err)
+	}
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"slices"
+	"strings"
+)
+
+// StopMatcher ends a generation on any of several stop sequences. The spec
+// is comma-separated alternatives, each one or more space-separated words:
+// "by" stops on the word "by", "by,end" on either word, and "the end" only
+// once "the" is directly followed by "end".
+type StopMatcher struct {
+	sequences [][]string
+	recent    []string // the last words pushed, as many as the longest sequence
+	longest   int
+}
+
+// NewStopMatcher parses spec; an empty spec never matches.
+func NewStopMatcher(spec string) *StopMatcher {
+	m := &StopMatcher{}
+	for _, alt := range strings.Split(spec, ",") {
+		if words := strings.Fields(alt); len(words) > 0 {
+			m.sequences = append(m.sequences, words)
+			m.longest = max(m.longest, len(words))
+		}
+	}
+	return m
+}
+
+// Push records the next generated word and reports whether the stream now
+// ends with one of the stop sequences.
+func (m *StopMatcher) Push(word string) bool {
+	if m.longest == 0 {
+		return false
+	}
+	if len(m.recent) == m.longest {
+		m.recent = m.recent[1:]
+	}
+	m.recent = append(m.recent, word)
+
+	for _, seq := range m.sequences {
+		if len(seq) <= len(m.recent) && slices.Equal(seq, m.recent[len(m.recent)-len(seq):]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package services
+
+import "testing"
+
+func TestStopMatcher(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		words []string
+		want  int // index of the word that stops the stream, -1 for none
+	}{
+		{"empty spec", "", []string{"by", "the", "end"}, -1},
+		{"single word", "by", []string{"hello", "by", "world"}, 1},
+		{"alternatives", "by,end", []string{"hello", "end", "by"}, 1},
+		{"spaces around alternatives", " by , end ", []string{"hello", "end"}, 1},
+		{"sequence", "the end", []string{"the", "start", "the", "end"}, 3},
+		{"sequence needs adjacent words", "the end", []string{"the", "big", "end"}, -1},
+		{"sequence across a partial match", "a a b", []string{"a", "a", "a", "b"}, 3},
+		{"shorter alternative first", "the end,end", []string{"end"}, 0},
+		{"case sensitive", "By", []string{"by"}, -1},
+		{"only separators", " , ,", []string{"by"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewStopMatcher(tt.spec)
+			got := -1
+			for i, word := range tt.words {
+				if m.Push(word) {
+					got = i
+					break
+				}
+			}
+			if got != tt.want {
+				t.Fatalf("stopped at word %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
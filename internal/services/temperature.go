@@ -0,0 +1,47 @@
+package services
+
+import "math/rand"
+
+// How many of the latest words a low temperature draws repeats from, and
+// the chance of a repeat at temperature 0. Repeating every word would
+// collapse the stream into its first word
+const (
+	temperatureWindow    = 8
+	temperatureMaxRepeat = 0.5
+)
+
+// temperatureSource repeats recent words more often at low temperatures:
+// each word is, with probability (1-temperature)*temperatureMaxRepeat, one
+// of the last temperatureWindow words instead of a fresh draw from the
+// source.
+type temperatureSource struct {
+	source     WordSource
+	repeatProb float64
+	recent     []string
+}
+
+// WithTemperature wraps source for a temperature in [0, 1]. At 1 it returns
+// source unchanged, so the default stays uniform and seeded sequences match
+// those without a temperature; at 0 about every other word repeats one of
+// the last few.
+func WithTemperature(source WordSource, temperature float64) WordSource {
+	if temperature >= 1 {
+		return source
+	}
+	return &temperatureSource{source: source, repeatProb: (1 - temperature) * temperatureMaxRepeat}
+}
+
+func (s *temperatureSource) Next(r *rand.Rand) string {
+	var word string
+	if len(s.recent) > 0 && r.Float64() < s.repeatProb {
+		word = s.recent[r.Intn(len(s.recent))]
+	} else {
+		word = s.source.Next(r)
+	}
+
+	if len(s.recent) == temperatureWindow {
+		s.recent = s.recent[1:]
+	}
+	s.recent = append(s.recent, word)
+	return word
+}
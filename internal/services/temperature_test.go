@@ -0,0 +1,68 @@
+package services
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// freshSource never repeats a word, so every repeat comes from the
+// temperature.
+type freshSource struct{ n int }
+
+func (s *freshSource) Next(*rand.Rand) string {
+	s.n++
+	return "w" + strconv.Itoa(s.n)
+}
+
+// repeatRate draws n words at temperature and returns the share that
+// repeat one of the last temperatureWindow words.
+func repeatRate(t *testing.T, temperature float64, n int) float64 {
+	t.Helper()
+	source := WithTemperature(&freshSource{}, temperature)
+	r := rand.New(rand.NewSource(42))
+	var words []string
+	repeats := 0
+	for i := 0; i < n; i++ {
+		word := source.Next(r)
+		for j := len(words) - 1; j >= 0; j-- {
+			if words[j] != word {
+				continue
+			}
+			if len(words)-j > temperatureWindow {
+				t.Fatalf("word %d repeats %q from %d words back, past the window", i, word, len(words)-j)
+			}
+			repeats++
+			break
+		}
+		words = append(words, word)
+	}
+	return float64(repeats) / float64(n)
+}
+
+func TestTemperatureRepetition(t *testing.T) {
+	tests := []struct {
+		temperature float64
+		want        float64
+	}{
+		{1, 0},
+		{0.5, 0.25},
+		{0, temperatureMaxRepeat},
+	}
+	for _, tt := range tests {
+		if got := repeatRate(t, tt.temperature, 4000); got < tt.want-0.03 || got > tt.want+0.03 {
+			t.Errorf("temperature %v: %.3f of words repeat, want about %.2f", tt.temperature, got, tt.want)
+		}
+	}
+}
+
+func TestTemperatureOneKeepsSeededSequence(t *testing.T) {
+	source := SliceWordSource{"a", "b", "c", "d"}
+	plain, warmed := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	wrapped := WithTemperature(source, 1)
+	for i := 0; i < 20; i++ {
+		if a, b := source.Next(plain), wrapped.Next(warmed); a != b {
+			t.Fatalf("word %d: %q with temperature 1, %q without", i, b, a)
+		}
+	}
+}
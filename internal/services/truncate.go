@@ -0,0 +1,26 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"unicode/utf8"
+)
+
+// TruncationMarker ends request data that was cut to fit the data column.
+const TruncationMarker = " [truncated]"
+
+// truncateData cuts data to at most maxBytes, including TruncationMarker,
+// without splitting a UTF-8 sequence. maxBytes 0 leaves data as is.
+func truncateData(ctx context.Context, requestID, data string, maxBytes int) string {
+	if maxBytes <= 0 || len(data) <= maxBytes {
+		return data
+	}
+
+	cut := max(maxBytes-len(TruncationMarker), 0)
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	slog.WarnContext(ctx, "Request data exceeds the stored limit, truncating",
+		"request_id", requestID, "bytes", len(data), "max_bytes", maxBytes)
+	return data[:cut] + TruncationMarker
+}
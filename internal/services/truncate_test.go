@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateData(t *testing.T) {
+	ctx := context.Background()
+	marker := len(TruncationMarker)
+	tests := []struct {
+		name     string
+		data     string
+		maxBytes int
+		want     string
+	}{
+		{"no limit", "hello world", 0, "hello world"},
+		{"fits", "hello world", 11, "hello world"},
+		{"ascii", "hello world, again", marker + 5, "hello" + TruncationMarker},
+		// "é" is two bytes; cutting after one would split it
+		{"two-byte rune", "héllo world, again", marker + 2, "h" + TruncationMarker},
+		// "日" is three bytes
+		{"three-byte rune", "日本語日本語", marker + 5, "日" + TruncationMarker},
+		{"four-byte rune", "😀😀😀😀😀", marker + 7, "😀" + TruncationMarker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateData(ctx, "req-1", tt.data, tt.maxBytes)
+			if got != tt.want {
+				t.Fatalf("truncateData = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Fatalf("truncateData produced invalid UTF-8 %q", got)
+			}
+		})
+	}
+}
+
+func TestTruncateDataNeverExceedsLimit(t *testing.T) {
+	data := strings.Repeat("aé日😀", 50)
+	for maxBytes := len(TruncationMarker); maxBytes < len(data); maxBytes++ {
+		got := truncateData(context.Background(), "req-1", data, maxBytes)
+		if len(got) > maxBytes || !utf8.ValidString(got) {
+			t.Fatalf("maxBytes %d: got %d bytes, valid UTF-8 %v", maxBytes, len(got), utf8.ValidString(got))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// WordSource picks the next word for a stream.
+type WordSource interface {
+	Next(r *rand.Rand) string
+}
+
+// SliceWordSource draws uniformly from a fixed list of words.
+type SliceWordSource []string
+
+func (s SliceWordSource) Next(r *rand.Rand) string {
+	return s[r.Intn(len(s))]
+}
+
+// Filter returns the words whose length is within [minLen, maxLen].
+// A maxLen of 0 means no upper bound.
+func (s SliceWordSource) Filter(minLen, maxLen int) SliceWordSource {
+	var candidates SliceWordSource
+	for _, word := range s {
+		if len(word) < minLen || (maxLen > 0 && len(word) > maxLen) {
+			continue
+		}
+		candidates = append(candidates, word)
+	}
+	return candidates
+}
+
+// Built-in word bank used when no word list file is configured
+var defaultWords = SliceWordSource{
+	"the", "be", "to", "of", "and", "a", "in", "that", "have", "I",
+	"it", "for", "not", "on", "with", "he", "as", "you", "do", "at",
+	"this", "but", "his", "by", "from", "they", "we", "say", "her", "she",
+	"or", "an", "will", "my", "one", "all", "would", "there", "their", "what",
+	"so", "up", "out", "if", "about", "who", "get", "which", "go", "me",
+	"when", "make", "can", "like", "time", "no", "just", "him", "know", "take",
+	"people", "into", "year", "your", "good", "some", "could", "them", "see", "other",
+	"than", "then", "now", "look", "only", "come", "its", "over", "think", "also",
+	"back", "after", "use", "two", "how", "our", "work", "first", "well", "way",
+	"even", "new", "want", "because", "any", "these", "give", "day", "most", "us",
+}
+
+// DefaultProfile names the word bank used when a user has no profile set.
+const DefaultProfile = "default"
+
+// WordBanks is the registry of word banks keyed by profile name.
+type WordBanks map[string]SliceWordSource
+
+// NewWordBanks registers the built-in profiles, with defaultSource (the
+// built-in list or WORD_LIST_PATH) under DefaultProfile.
+func NewWordBanks(defaultSource SliceWordSource) WordBanks {
+	return WordBanks{
+		DefaultProfile: defaultSource,
+		"technical":    technicalWords,
+		"es":           spanishWords,
+	}
+}
+
+var technicalWords = SliceWordSource{
+	"algorithm", "latency", "throughput", "cache", "buffer", "kernel", "thread", "mutex",
+	"socket", "protocol", "schema", "index", "query", "replica", "shard", "cluster",
+	"container", "runtime", "compiler", "pointer", "allocation", "garbage", "collector", "stream",
+	"pipeline", "payload", "endpoint", "gateway", "proxy", "handshake", "checksum", "bandwidth",
+	"deadlock", "semaphore", "scheduler", "interrupt", "register", "bytecode", "serializer", "timeout",
+}
+
+var spanishWords = SliceWordSource{
+	"el", "la", "de", "que", "y", "a", "en", "un", "ser", "se",
+	"no", "haber", "por", "con", "su", "para", "como", "estar", "tener", "le",
+	"lo", "todo", "pero", "más", "hacer", "o", "poder", "decir", "este", "ir",
+	"otro", "ese", "si", "me", "ya", "ver", "porque", "dar", "cuando", "él",
+	"muy", "sin", "vez", "mucho", "saber", "qué", "sobre", "mi", "alguno", "mismo",
+}
+
+// DefaultWordSource returns the built-in word bank.
+func DefaultWordSource() SliceWordSource {
+	return defaultWords
+}
+
+// NewFileWordSource loads a newline-delimited dictionary. Surrounding
+// whitespace and blank lines are ignored; a file with no words is an error.
+func NewFileWordSource(path string) (SliceWordSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open word list: %w", err)
+	}
+	defer f.Close()
+
+	var words SliceWordSource
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read word list: %w", err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("word list %s contains no words", path)
+	}
+
+	return words, nil
+}
+
+// LoadWordSource returns the dictionary at path, or the built-in word bank
+// when path is empty.
+func LoadWordSource(path string) (SliceWordSource, error) {
+	if path == "" {
+		return DefaultWordSource(), nil
+	}
+	return NewFileWordSource(path)
+}
+
+// Generate random words for streaming with optional stop token support
+func GenerateRandomWords(rng *rand.Rand, count int, stopToken string) (string, bool) {
+	return GenerateRandomWordsFrom(rng, defaultWords, count, stopToken)
+}
+
+// GenerateRandomWordsFrom is GenerateRandomWords over a caller-supplied
+// word source, e.g. a filtered or file-backed one. stopToken is a
+// StopMatcher spec.
+func GenerateRandomWordsFrom(rng *rand.Rand, source WordSource, count int, stopToken string) (string, bool) {
+	var result []string
+	stopTokenFound := false
+	stop := NewStopMatcher(stopToken)
+
+	for i := 0; i < count; i++ {
+		word := source.Next(rng)
+		result = append(result, word)
+
+		// Stop tokens only match words from the list
+		if stop.Push(word) {
+			stopTokenFound = true
+			break // Stop generating more words
+		}
+	}
+
+	return strings.Join(result, " "), stopTokenFound
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewFileWordSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("alpha\n\n  beta  \r\ngamma"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	words, err := NewFileWordSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SliceWordSource{"alpha", "beta", "gamma"}); !reflect.DeepEqual(words, want) {
+		t.Fatalf("words = %q, want %q", words, want)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		if word := words.Next(rng); word != "alpha" && word != "beta" && word != "gamma" {
+			t.Fatalf("Next = %q, not from the file", word)
+		}
+	}
+}
+
+func TestNewFileWordSourceRejectsMissingOrEmpty(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, []byte("\n  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, filepath.Join(t.TempDir(), "missing.txt")} {
+		if _, err := NewFileWordSource(path); err == nil {
+			t.Errorf("NewFileWordSource(%s) succeeded", path)
+		}
+	}
+}
+
+func TestLoadWordSourceFallsBackToBuiltIn(t *testing.T) {
+	words, err := LoadWordSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(words, DefaultWordSource()) {
+		t.Fatal("an empty WORD_LIST_PATH didn't load the built-in words")
+	}
+}
+
+// lockedSource is a mutex-guarded rand.Source, as the global math/rand
+// source was before generation took a per-request *rand.Rand.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// BenchmarkGenerateRandomWordsSharedSource generates from every goroutine
+// through one locked source.
+func BenchmarkGenerateRandomWordsSharedSource(b *testing.B) {
+	rng := rand.New(&lockedSource{src: rand.NewSource(1).(rand.Source64)})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			GenerateRandomWords(rng, 100, "")
+		}
+	})
+}
+
+// BenchmarkGenerateRandomWordsPerGoroutine gives each goroutine its own
+// source, as each request has, so generation doesn't contend on a lock.
+func BenchmarkGenerateRandomWordsPerGoroutine(b *testing.B) {
+	var seed atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			GenerateRandomWords(rng, 100, "")
+		}
+	})
+}